@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+)
+
+// animation is the range of frames to render and the clock values at
+// either end, from the command line
+type animation struct {
+	initialFrame, finalFrame int
+	initialClock, finalClock float64
+	// resume skips frames whose image already exists
+	resume bool
+}
+
+// frameJob is one frame being rendered by the worker pool, in passes that
+// each add a sample to every pixel
+type frameJob struct {
+	scene *scene
+	// sum and count are the samples taken so far for each pixel
+	sum    []fColor
+	count  []int
+	mu     sync.Mutex
+	passes []sync.WaitGroup
+}
+
+func (anim animation) validate() error {
+	if anim.finalFrame < anim.initialFrame {
+		return errors.New("final_frame is before initial_frame")
+	}
+	return nil
+}
+
+// animated is true when more than one frame is rendered, so images are
+// numbered
+func (anim animation) animated() bool {
+	return anim.finalFrame > anim.initialFrame
+}
+
+// clockDelta is how far the clock moves between frames
+func (anim animation) clockDelta() float64 {
+	if !anim.animated() {
+		return 0
+	}
+	return (anim.finalClock - anim.initialClock) /
+		float64(anim.finalFrame-anim.initialFrame)
+}
+
+func (anim animation) clock(frame int) float64 {
+	return anim.initialClock + float64(frame-anim.initialFrame)*anim.clockDelta()
+}
+
+// symbols are the identifiers a scene reads its frame from
+func (anim animation) symbols(frame int) map[string]exprValue {
+	return map[string]exprValue{
+		"clock":         floatValue(anim.clock(frame)),
+		"frame_number":  floatValue(float64(frame)),
+		"initial_frame": floatValue(float64(anim.initialFrame)),
+		"final_frame":   floatValue(float64(anim.finalFrame)),
+		"initial_clock": floatValue(anim.initialClock),
+		"final_clock":   floatValue(anim.finalClock),
+		"clock_delta":   floatValue(anim.clockDelta()),
+		"clock_on":      boolValue(anim.animated()),
+	}
+}
+
+// outputName is the image file for a frame, numbered when animating
+func (anim animation) outputName(scenePath string, frame int) string {
+	name := sceneName(scenePath)
+	if anim.animated() {
+		name = fmt.Sprintf("%s_%0*d", name, frameDigits(anim.finalFrame), frame)
+	}
+	return fileDir + name + ext
+}
+
+// frameDigits is how wide frame numbers are padded, at least four digits
+// so the files sort in order
+func frameDigits(final int) int {
+	digits := len(fmt.Sprint(final))
+	if digits < 4 {
+		return 4
+	}
+	return digits
+}
+
+// render queues every frame's pixels on the worker pool. A frame is parsed
+// while the workers are still busy with the one before it, and written
+// once its last pixel is done
+func (anim animation) render(scenePath string, argsChan chan<- goArgs) error {
+	writers := sync.WaitGroup{}
+	defer writers.Wait()
+	for frame := anim.initialFrame; frame <= anim.finalFrame; frame++ {
+		outFile := anim.outputName(scenePath, frame)
+		if anim.resume {
+			if _, err := os.Stat(outFile); err == nil {
+				fmt.Println("Skipping", outFile)
+				continue
+			}
+		}
+		sc, err := loadScene(scenePath, anim.symbols(frame))
+		if err != nil {
+			return err
+		}
+		if anim.animated() {
+			fmt.Println("Rendering frame", frame)
+		}
+		job := &frameJob{scene: sc, sum: make([]fColor, imgWidth*imgHeight),
+			count: make([]int, imgWidth*imgHeight), passes: make([]sync.WaitGroup, renderPasses())}
+		for i := range job.passes {
+			job.passes[i].Add(imgWidth * imgHeight)
+		}
+		writers.Add(1)
+		go func() {
+			job.write(outFile)
+			writers.Done()
+		}()
+		job.queue(argsChan)
+	}
+	return nil
+}
+
+// renderPasses is how many samples are taken for each pixel
+func renderPasses() int {
+	if renderMode == pathMode {
+		return samplesPerPixel
+	}
+	return 1
+}
+
+func (job *frameJob) queue(argsChan chan<- goArgs) {
+	eye := &job.scene.eye
+	for pass := range job.passes {
+		for x := 0; x < imgWidth; x++ {
+			for y := 0; y < imgHeight; y++ {
+				u := (float64(x)+0.5)/float64(imgWidth) - 0.5
+				v := 0.5 - (float64(y)+0.5)/float64(imgHeight)
+				if renderMode == pathMode {
+					// Spread the samples over the pixel
+					u += (rand.Float64() - 0.5) / float64(imgWidth)
+					v += (rand.Float64() - 0.5) / float64(imgHeight)
+				}
+				if ray, ok := eye.ray(u, v); ok {
+					rays := eye.samples(ray)
+					width, spread := eye.footprint(u, v, ray)
+					for i := range rays {
+						rays[i].Width, rays[i].Spread = width, spread
+					}
+					if renderMode == pathMode {
+						// Each pass takes one lens and shutter sample
+						i := rand.Intn(len(rays))
+						rays = rays[i : i+1]
+					}
+					argsChan <- goArgs{job, rays, x, y, pass}
+				} else {
+					job.add(x, y, bkgndColor)
+					job.passes[pass].Done()
+				}
+			}
+		}
+	}
+}
+
+// add takes another sample for pixel (x, y)
+func (job *frameJob) add(x, y int, c fColor) {
+	r, g, b, _ := c.rgba()
+	ndx := y*imgWidth + x
+	job.mu.Lock()
+	sum := job.sum[ndx]
+	job.sum[ndx] = fColor{R: sum.R + r, G: sum.G + g, B: sum.B + b, A: 1}
+	job.count[ndx]++
+	job.mu.Unlock()
+}
+
+// image is the average of the samples taken so far for each pixel
+func (job *frameJob) image() *image.RGBA {
+	img := image.NewRGBA(image.Rectangle{image.ZP, image.Point{imgWidth, imgHeight}})
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	for ndx, sum := range job.sum {
+		if n := float64(job.count[ndx]); n > 0 {
+			img.Set(ndx%imgWidth, ndx/imgWidth, sum.Scale(1/n))
+		}
+	}
+	return img
+}
+
+// write saves the frame once every pass is done. Longer renders also save
+// a preview as the passes double, so they can be watched as they clear
+func (job *frameJob) write(outFile string) {
+	preview := strings.TrimSuffix(outFile, ext) + ".preview" + ext
+	last := len(job.passes) - 1
+	for i := range job.passes {
+		job.passes[i].Wait()
+		if i < last && (i+1)&i == 0 {
+			fmt.Println("Finished pass", i+1, "of", last+1)
+			writeFile(job.image(), preview)
+		}
+	}
+	writeFile(job.image(), outFile)
+	if last > 0 {
+		os.Remove(preview)
+	}
+}
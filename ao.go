@@ -0,0 +1,67 @@
+package main
+
+// aoMode renders only how occluded each surface is, white where nothing
+// is near and darker in creases and contact areas
+const aoMode = "ao"
+
+// defaultAOSamples is used by -mode ao when -ao_samples isn't given
+const defaultAOSamples = 16
+
+// occlusion is the share of the hemisphere above pt, weighted towards the
+// normal, that's open for aoDistance. Objects with no_shadow don't occlude
+func (sc *scene) occlusion(pt Point3D, normal Vector3D, time float64, exclude castable,
+	samples int) float64 {
+	exclude = primitive(exclude)
+	open := 0
+	for i := 0; i < samples; i++ {
+		r := Ray{Origin: pt, Direction: cosineSample(normal), Time: time}
+		if !sc.occluded(r, exclude) {
+			open++
+		}
+	}
+	return float64(open) / float64(samples)
+}
+
+func (sc *scene) occluded(r Ray, exclude castable) bool {
+	for ndx := range sc.objects {
+		if sc.objects[ndx] != exclude && !sc.objects[ndx].base().noShadow {
+			if surface, ok := nearestSurface(sc.objects[ndx], r, exclude); ok && surface.t < aoDistance {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ambientOcclusion is how much of the ambient light reaches pt, or all of
+// it with ambient occlusion off
+func (sc *scene) ambientOcclusion(ray Ray, obj castable, pt Point3D, normal Vector3D) float64 {
+	if aoSamples <= 0 {
+		return 1
+	}
+	return sc.occlusion(pt, facingNormal(ray, normal), ray.Time, obj, aoSamples)
+}
+
+// occlusionPass is the gray level of the occlusion pass where ray lands,
+// white for rays that miss everything
+func (sc *scene) occlusionPass(ray Ray) fColor {
+	hit, t, obj := sc.hitAnything(ray, nil)
+	if !hit {
+		return white
+	}
+	samples := aoSamples
+	if samples <= 0 {
+		samples = defaultAOSamples
+	}
+	pt := ray.PointAt(t)
+	open := sc.occlusion(pt, facingNormal(ray, obj.Normal(pt, ray.Time)), ray.Time, obj, samples)
+	return fColor{R: open, G: open, B: open, A: 1}
+}
+
+// facingNormal turns normal to the side of the surface ray arrives from
+func facingNormal(ray Ray, normal Vector3D) Vector3D {
+	if ray.Direction.Dot(normal) > 0 {
+		return normal.Scale(-1)
+	}
+	return normal
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+)
+
+// bsdf is how a finish scatters light off a surface, apart from its
+// mirror reflection and refraction. Directions are unit vectors leaving
+// the surface, with normal facing the side view is on. Shading is pi times
+// the BRDF times the cosine at L, so a light of color C along L lights the
+// surface by C times its shading
+type bsdf interface {
+	// shade is the shading the Whitted renderer uses for direct light
+	shade(c fColor, normal, view, L Vector3D) fColor
+	// eval is the energy conserving shading the path tracer uses
+	eval(c fColor, normal, view, L Vector3D) fColor
+	// sample picks a direction for the path tracer to scatter towards,
+	// more likely where eval is large, with its pdf
+	sample(c fColor, normal, view Vector3D) (L Vector3D, pdf float64)
+	pdf(c fColor, normal, view, L Vector3D) float64
+	// albedo is about how much of the light arriving the surface scatters
+	albedo(c fColor) float64
+}
+
+// bsdfModels builds the BSDF a finish picks with brdf. classic is used
+// when it's left out
+var bsdfModels = map[string]func(fin finish) bsdf{
+	"classic": func(fin finish) bsdf { return classic{fin} },
+	"ggx":     func(fin finish) bsdf { return ggx{fin} },
+}
+
+func (fin finish) bsdf() bsdf {
+	if model, ok := bsdfModels[fin.brdf]; ok {
+		return model(fin)
+	}
+	return classic{fin}
+}
+
+func parseBRDF(scanner *povScanner) (string, error) {
+	if !scanner.Scan() {
+		return "", eofErr
+	}
+	if _, ok := bsdfModels[scanner.Text()]; !ok {
+		return "", errors.New("Unknown brdf: '" + scanner.Text() + "'")
+	}
+	return scanner.Text(), nil
+}
+
+// highlightTint is the color highlights take on, white for plastics and
+// the pigment's own for metals
+func (fin finish) highlightTint(c fColor) fColor {
+	m := fin.metallic
+	return fColor{R: lerp(m, 1, c.R), G: lerp(m, 1, c.G), B: lerp(m, 1, c.B), A: 1}
+}
+
+// classic is POV's finish: diffuse raised to brilliance, a specular
+// highlight about the half vector whose size is roughness and a phong
+// highlight about the mirror direction whose size is phong_size
+type classic struct {
+	fin finish
+}
+
+func (m classic) shade(c fColor, normal, view, L Vector3D) fColor {
+	cos := normal.Dot(L)
+	if cos <= 0 {
+		return fColor{A: 1}
+	}
+	fin := m.fin
+	diffuse := fin.diffuse * math.Pow(math.Min(1, cos), fin.brilliance)
+	highlight := 0.0
+	if fin.specular > 0 {
+		half := math.Max(0, normal.Dot(L.Add(view).Normalize()))
+		highlight += fin.specular * math.Pow(math.Min(1, half), 1/fin.roughness)
+	}
+	if fin.phong > 0 {
+		highlight += fin.phong * math.Pow(math.Max(0, mirror(view, normal).Dot(L)), fin.phongSize)
+	}
+	tint := fin.highlightTint(c)
+	return fColor{R: c.R*diffuse + tint.R*highlight, G: c.G*diffuse + tint.G*highlight,
+		B: c.B*diffuse + tint.B*highlight, A: 1}
+}
+
+// eval normalizes each lobe so it scatters no more than its amount, and
+// scales the amounts down when they add up to more than all the light
+func (m classic) eval(c fColor, normal, view, L Vector3D) fColor {
+	cos := normal.Dot(L)
+	if cos <= 0 {
+		return fColor{A: 1}
+	}
+	fin := m.fin
+	kd, ks, kp := m.weights()
+	diffuse := kd * math.Pow(cos, fin.brilliance) * (fin.brilliance + 1) / 2
+	n := 1 / fin.roughness
+	highlight := ks * math.Pow(math.Max(0, normal.Dot(L.Add(view).Normalize())), n) * blinnScale(n) * cos
+	highlight += kp * math.Pow(math.Max(0, mirror(view, normal).Dot(L)), fin.phongSize) *
+		(fin.phongSize + 2) / 2 * cos
+	tint := fin.highlightTint(c)
+	return fColor{R: c.R*diffuse + tint.R*highlight, G: c.G*diffuse + tint.G*highlight,
+		B: c.B*diffuse + tint.B*highlight, A: 1}
+}
+
+func (m classic) weights() (kd, ks, kp float64) {
+	kd, ks, kp = m.fin.diffuse, m.fin.specular, m.fin.phong
+	if sum := kd + ks + kp; sum > 1 {
+		kd, ks, kp = kd/sum, ks/sum, kp/sum
+	}
+	return
+}
+
+func (m classic) sample(c fColor, normal, view Vector3D) (Vector3D, float64) {
+	kd, ks, kp := m.weights()
+	var L Vector3D
+	switch pick := rand.Float64() * (kd + ks + kp); {
+	case pick < kd:
+		L = cosineSample(normal)
+	case pick < kd+ks:
+		half := lobeSample(normal, 1/m.fin.roughness)
+		L = mirror(view, half)
+	default:
+		L = lobeSample(mirror(view, normal), m.fin.phongSize)
+	}
+	return L, m.pdf(c, normal, view, L)
+}
+
+func (m classic) pdf(c fColor, normal, view, L Vector3D) float64 {
+	kd, ks, kp := m.weights()
+	cos := normal.Dot(L)
+	if cos <= 0 || kd+ks+kp <= 0 {
+		return 0
+	}
+	pdf := kd * cos / math.Pi
+	if ks > 0 {
+		half := L.Add(view).Normalize()
+		if vh := view.Dot(half); vh > 0 {
+			pdf += ks * lobePdf(normal.Dot(half), 1/m.fin.roughness) / (4 * vh)
+		}
+	}
+	if kp > 0 {
+		pdf += kp * lobePdf(mirror(view, normal).Dot(L), m.fin.phongSize)
+	}
+	return pdf / (kd + ks + kp)
+}
+
+func (m classic) albedo(c fColor) float64 {
+	kd, ks, kp := m.weights()
+	tint := m.fin.highlightTint(c)
+	return kd*maxChannel(c) + (ks+kp)*maxChannel(tint)
+}
+
+// ggx is a Cook-Torrance microfacet finish with the GGX distribution.
+// roughness is the spread of the facets' slopes, stretched along and
+// squeezed across the surface's up direction by anisotropy. Plastics
+// reflect 4% straight on and take the rest as diffuse; metals reflect
+// their own color and have no diffuse. specular scales the highlight
+type ggx struct {
+	fin finish
+}
+
+// alphas are the facet slopes' spread along and across the tangent
+func (m ggx) alphas() (ax, ay float64) {
+	r := math.Max(m.fin.roughness, 1e-3)
+	aspect := math.Sqrt(1 - 0.9*m.fin.anisotropy)
+	return r / aspect, r * aspect
+}
+
+// f0 is the share of light reflected straight on
+func (m ggx) f0(c fColor) fColor {
+	mt := m.fin.metallic
+	return fColor{R: lerp(mt, 0.04, c.R), G: lerp(mt, 0.04, c.G), B: lerp(mt, 0.04, c.B), A: 1}
+}
+
+// The Whitted renderer lights with the same microfacet shading
+func (m ggx) shade(c fColor, normal, view, L Vector3D) fColor {
+	return m.eval(c, normal, view, L)
+}
+
+func (m ggx) eval(c fColor, normal, view, L Vector3D) fColor {
+	cosL, cosV := normal.Dot(L), normal.Dot(view)
+	if cosL <= 0 || cosV <= 0 {
+		return fColor{A: 1}
+	}
+	t, b := tangentFrame(normal)
+	half := L.Add(view).Normalize()
+	ax, ay := m.alphas()
+	d := ggxD(half.Dot(t), half.Dot(b), half.Dot(normal), ax, ay)
+	g := 1 / (1 + ggxLambda(view.Dot(t), view.Dot(b), cosV, ax, ay) +
+		ggxLambda(L.Dot(t), L.Dot(b), cosL, ax, ay))
+	f0 := m.f0(c)
+	schlick := math.Pow(1-math.Max(0, view.Dot(half)), 5)
+	// pi times the BRDF times cosL
+	spec := m.fin.specular * math.Pi * d * g / (4 * cosV)
+	kd := m.fin.diffuse * (1 - m.fin.metallic) * (1 - math.Pow(1-cosV, 5)*0.96 - 0.04)
+	return fColor{R: c.R*kd*cosL + spec*(f0.R+(1-f0.R)*schlick),
+		G: c.G*kd*cosL + spec*(f0.G+(1-f0.G)*schlick),
+		B: c.B*kd*cosL + spec*(f0.B+(1-f0.B)*schlick), A: 1}
+}
+
+// diffuseShare is the chance of sampling the diffuse lobe
+func (m ggx) diffuseShare(c fColor) float64 {
+	kd := m.fin.diffuse * (1 - m.fin.metallic) * maxChannel(c)
+	ks := m.fin.specular * maxChannel(m.f0(c))
+	if kd+ks <= 0 {
+		return 1
+	}
+	// Facets reflect more than f0 at grazing angles, so don't starve them
+	return kd / (kd + math.Max(ks, 0.25*m.fin.specular))
+}
+
+func (m ggx) sample(c fColor, normal, view Vector3D) (Vector3D, float64) {
+	var L Vector3D
+	if rand.Float64() < m.diffuseShare(c) {
+		L = cosineSample(normal)
+	} else {
+		// Pick a facet by its slope, then mirror view in it
+		ax, ay := m.alphas()
+		t, b := tangentFrame(normal)
+		u := rand.Float64()
+		phi := 2 * math.Pi * rand.Float64()
+		slope := math.Sqrt(u / (1 - u))
+		half := t.Scale(ax * slope * math.Cos(phi)).Add(b.Scale(ay * slope * math.Sin(phi))).
+			Add(normal).Normalize()
+		L = mirror(view, half)
+	}
+	return L, m.pdf(c, normal, view, L)
+}
+
+func (m ggx) pdf(c fColor, normal, view, L Vector3D) float64 {
+	cosL := normal.Dot(L)
+	if cosL <= 0 {
+		return 0
+	}
+	share := m.diffuseShare(c)
+	pdf := share * cosL / math.Pi
+	half := L.Add(view).Normalize()
+	if vh := view.Dot(half); vh > 0 && share < 1 {
+		ax, ay := m.alphas()
+		t, b := tangentFrame(normal)
+		nh := half.Dot(normal)
+		pdf += (1 - share) * ggxD(half.Dot(t), half.Dot(b), nh, ax, ay) * nh / (4 * vh)
+	}
+	return pdf
+}
+
+func (m ggx) albedo(c fColor) float64 {
+	return m.fin.diffuse*(1-m.fin.metallic)*maxChannel(c) + m.fin.specular*maxChannel(m.f0(c))
+}
+
+// ggxD is the density of facets facing the half vector with components
+// (x, y, z) along the tangent, bitangent and normal
+func ggxD(x, y, z, ax, ay float64) float64 {
+	if z <= 0 {
+		return 0
+	}
+	s := x*x/(ax*ax) + y*y/(ay*ay) + z*z
+	return 1 / (math.Pi * ax * ay * s * s)
+}
+
+// ggxLambda is Smith's share of facets hidden from direction (x, y, z)
+func ggxLambda(x, y, z, ax, ay float64) float64 {
+	if z <= 0 {
+		return math.Inf(1)
+	}
+	return (math.Sqrt(1+(ax*ax*x*x+ay*ay*y*y)/(z*z)) - 1) / 2
+}
+
+// tangentFrame is the surface's up direction, the world y axis flattened
+// onto it, and the direction across that. Anisotropic highlights stretch
+// along the first
+func tangentFrame(normal Vector3D) (t, b Vector3D) {
+	up := yAxis
+	if math.Abs(normal.Dot(up)) > 0.999 {
+		up = xAxis
+	}
+	t = up.Sub(normal.Scale(up.Dot(normal))).Normalize()
+	return t, normal.Cross(t)
+}
+
+// mirror reflects v, leaving the surface, in n
+func mirror(v, n Vector3D) Vector3D {
+	return n.Scale(2 * v.Dot(n)).Sub(v).Normalize()
+}
+
+// blinnScale normalizes a highlight of cos^n of the half angle, times the
+// cosine at L, so it scatters all the light for a viewer straight above,
+// where it scatters the most
+func blinnScale(n float64) float64 {
+	s := math.Sqrt(0.5)
+	return 1 / (8 * (2*(1-math.Pow(s, n+4))/(n+4) - (1-math.Pow(s, n+2))/(n+2)))
+}
+
+// lobeSample picks a direction about axis with pdf lobePdf
+func lobeSample(axis Vector3D, exponent float64) Vector3D {
+	cos := math.Pow(rand.Float64(), 1/(exponent+1))
+	sin, phi := math.Sqrt(math.Max(0, 1-cos*cos)), 2*math.Pi*rand.Float64()
+	u, v := orthoBasis(axis)
+	return u.Scale(sin * math.Cos(phi)).Add(v.Scale(sin * math.Sin(phi))).Add(axis.Scale(cos)).Normalize()
+}
+
+// lobePdf is the pdf of a direction at cos from the axis, for directions
+// picked with density in proportion to cos^exponent
+func lobePdf(cos, exponent float64) float64 {
+	if cos <= 0 {
+		return 0
+	}
+	return (exponent + 1) / (2 * math.Pi) * math.Pow(cos, exponent)
+}
+
+func maxChannel(c fColor) float64 {
+	return math.Max(c.R, math.Max(c.G, c.B))
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// testFinishes cover each model's lobes. All have some diffuse, so every
+// direction above the surface can be sampled
+func testFinishes() map[string]finish {
+	with := func(set func(fin *finish)) finish {
+		fin := defaultFinish()
+		set(&fin)
+		return fin
+	}
+	return map[string]finish{
+		"classic diffuse": defaultFinish(),
+		"classic brilliance": with(func(fin *finish) {
+			fin.diffuse, fin.brilliance = 0.9, 4
+		}),
+		"classic specular": with(func(fin *finish) {
+			fin.diffuse, fin.specular, fin.roughness = 0.6, 0.4, 0.02
+		}),
+		"classic phong": with(func(fin *finish) {
+			fin.diffuse, fin.phong, fin.phongSize = 0.7, 0.6, 60
+		}),
+		"classic over one": with(func(fin *finish) {
+			fin.diffuse, fin.specular, fin.phong = 1, 1, 1
+		}),
+		"ggx plastic": with(func(fin *finish) {
+			fin.brdf, fin.diffuse, fin.specular, fin.roughness = "ggx", 0.8, 1, 0.3
+		}),
+		"ggx shiny metal": with(func(fin *finish) {
+			fin.brdf, fin.diffuse, fin.specular, fin.roughness, fin.metallic = "ggx", 0.5, 1, 0.1, 0.9
+		}),
+		"ggx anisotropic": with(func(fin *finish) {
+			fin.brdf, fin.diffuse, fin.specular, fin.roughness, fin.anisotropy = "ggx", 0.5, 1, 0.2, 0.8
+		}),
+	}
+}
+
+// testViews look at a surface facing up from straight above to grazing
+func testViews() []Vector3D {
+	var views []Vector3D
+	for _, deg := range []float64{0, 30, 60, 85} {
+		a := deg * degToRad
+		views = append(views, Vector3D{math.Sin(a) * 0.6, math.Cos(a), math.Sin(a) * 0.8})
+	}
+	return views
+}
+
+// The average of 1/pdf over sampled directions is the solid angle they
+// can land in, the whole hemisphere, only if sample and pdf agree
+func TestBSDFSamplePdf(t *testing.T) {
+	rand.Seed(1)
+	normal := yAxis
+	const n = 200000
+	for name, fin := range testFinishes() {
+		model := fin.bsdf()
+		for _, view := range testViews() {
+			sum := 0.0
+			for i := 0; i < n; i++ {
+				L, pdf := model.sample(white, normal, view)
+				if pdf <= 0 {
+					continue
+				}
+				if again := model.pdf(white, normal, view, L); math.Abs(again-pdf) > 1e-9*pdf {
+					t.Fatalf("%s: sample gave pdf %v, pdf gives %v", name, pdf, again)
+				}
+				sum += 1 / pdf
+			}
+			if got := sum / n; math.Abs(got-2*math.Pi) > 0.05*2*math.Pi {
+				t.Errorf("%s, view %v: hemisphere measures %v, want %v", name, view, got, 2*math.Pi)
+			}
+		}
+	}
+}
+
+// Surfaces scatter no more light than reaches them. Shading is pi times
+// the BRDF times the cosine, so the light scattered is eval/pi over the
+// hemisphere, estimated here by importance sampling
+func TestBSDFEnergy(t *testing.T) {
+	rand.Seed(2)
+	normal := yAxis
+	const n = 200000
+	for name, fin := range testFinishes() {
+		model := fin.bsdf()
+		for _, view := range testViews() {
+			sum := 0.0
+			for i := 0; i < n; i++ {
+				L, pdf := model.sample(white, normal, view)
+				if pdf <= 0 {
+					continue
+				}
+				sum += maxChannel(model.eval(white, normal, view, L)) / (math.Pi * pdf)
+			}
+			if got := sum / n; got > 1.02 {
+				t.Errorf("%s, view %v: scatters %v of the light", name, view, got)
+			}
+		}
+	}
+}
+
+// A lone diffuse surface scatters its diffuse amount
+func TestBSDFDiffuseAlbedo(t *testing.T) {
+	rand.Seed(3)
+	fin := defaultFinish()
+	fin.diffuse = 0.7
+	model := fin.bsdf()
+	sum := 0.0
+	const n = 50000
+	for i := 0; i < n; i++ {
+		L, pdf := model.sample(white, yAxis, yAxis)
+		sum += model.eval(white, yAxis, yAxis, L).R / (math.Pi * pdf)
+	}
+	if got := sum / n; math.Abs(got-0.7) > 1e-6 {
+		t.Errorf("diffuse 0.7 scatters %v", got)
+	}
+}
+
+// A lone classic highlight scatters its specular amount to a viewer
+// straight above, its brightest view
+func TestBSDFSpecularAlbedo(t *testing.T) {
+	rand.Seed(4)
+	for _, roughness := range []float64{1, 0.2, 0.05, 0.002} {
+		fin := defaultFinish()
+		fin.diffuse, fin.specular, fin.roughness = 0, 0.5, roughness
+		model := fin.bsdf()
+		sum := 0.0
+		const n = 200000
+		for i := 0; i < n; i++ {
+			if L, pdf := model.sample(white, yAxis, yAxis); pdf > 0 {
+				sum += model.eval(white, yAxis, yAxis, L).R / (math.Pi * pdf)
+			}
+		}
+		if got := sum / n; math.Abs(got-0.5) > 0.01 {
+			t.Errorf("roughness %v: specular 0.5 scatters %v", roughness, got)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+)
+
+// Keywords allowed in a camera block, used to tell whether a spherical
+// camera's angle is followed by a vertical angle
+var cameraKeywords = map[string]bool{"perspective": true, "orthographic": true,
+	"fisheye": true, "panoramic": true, "cylinder": true, "spherical": true,
+	"location": true, "direction": true, "up": true, "right": true,
+	"sky": true, "look_at": true, "angle": true, "aperture": true,
+	"focal_point": true, "blur_samples": true, "aperture_blades": true,
+	"shutter_open": true, "shutter_close": true, "translate": true,
+	"rotate": true, "scale": true, "motion": true}
+
+type camera struct {
+	projection string
+	// cylinderType is 1 to 4, as in POV-Ray's 'cylinder' camera
+	cylinderType int
+	location     Point3D
+	direction    Vector3D
+	up, right    Vector3D
+	sky          Vector3D
+	lookAt       Point3D
+	hasLookAt    bool
+	// angle is the horizontal field of view in degrees, and vAngle the
+	// vertical one for spherical cameras. Zero means the projection default
+	angle, vAngle float64
+	// aperture is the lens diameter, zero for a pinhole. Rays through the
+	// lens converge on the plane through focalPoint
+	aperture    float64
+	focalPoint  Point3D
+	blurSamples int
+	// blades is the number of sides of a polygonal aperture, zero for a
+	// round one
+	blades int
+	// Rays are cast at times spread between shutterOpen and shutterClose
+	shutterOpen, shutterClose float64
+	placement
+}
+
+func makeCamera() camera {
+	return camera{projection: "perspective",
+		location:    Point3D{X: 0, Y: 0, Z: 0},
+		direction:   Vector3D{X: 0, Y: 0, Z: -1},
+		up:          Vector3D{X: 0, Y: 1, Z: 0},
+		right:       Vector3D{X: 1.333, Y: 0, Z: 0},
+		sky:         Vector3D{X: 0, Y: 1, Z: 0},
+		blurSamples: 12,
+		placement:   makePlacement()}
+}
+
+// orient turns the camera to face look_at with up along sky, and sizes the
+// image plane to match angle. The lengths of up, right and direction, and
+// their handedness, are kept
+func (c *camera) orient() error {
+	if c.hasLookAt {
+		dirLen := c.direction.Length()
+		// The image is mirrored when right is on the other side
+		mirrored := c.right.Dot(c.up.Cross(c.direction)) > 0
+		dir := c.lookAt.Sub(c.location)
+		if dir.Length() == 0 {
+			return errors.New("Camera look_at is the same as its location")
+		}
+		dir = dir.Normalize()
+		right := dir.Cross(c.sky)
+		if right.Length() < exprEpsilon {
+			return errors.New("Camera sky is parallel to its viewing direction")
+		}
+		right = right.Normalize()
+		up := right.Cross(dir)
+		if mirrored {
+			right = right.Scale(-1)
+		}
+		c.direction = dir.Scale(dirLen)
+		c.right = right.Scale(c.right.Length())
+		c.up = up.Scale(c.up.Length())
+	}
+
+	switch c.projection {
+	case "perspective":
+		if c.angle != 0 {
+			if c.angle >= 180 {
+				return errors.New("Perspective camera angle must be less than 180")
+			}
+			c.direction = c.direction.Normalize().
+				Scale(0.5 * c.right.Length() / math.Tan(c.angle*degToRad/2))
+		}
+	case "orthographic":
+		// Show the same width at look_at as a perspective camera would
+		if c.angle != 0 {
+			dist := c.direction.Length()
+			if c.hasLookAt {
+				dist = c.lookAt.Sub(c.location).Length()
+			}
+			width := 2 * dist * math.Tan(c.angle*degToRad/2)
+			scale := width / c.right.Length()
+			c.right, c.up = c.right.Scale(scale), c.up.Scale(scale)
+		}
+	case "fisheye", "panoramic":
+		if c.angle == 0 {
+			c.angle = 180
+		}
+	case "cylinder":
+		if c.angle == 0 {
+			c.angle = 90
+		}
+	case "spherical":
+		if c.angle == 0 {
+			c.angle = 360
+		}
+		if c.vAngle == 0 {
+			c.vAngle = c.angle / 2
+		}
+	}
+	return nil
+}
+
+// ray returns the ray through the image at (u, v), where both run from
+// -0.5 to 0.5 across the image, left to right and bottom to top. It
+// returns false where the projection doesn't cover the image, as in the
+// corners of a fisheye
+func (c *camera) ray(u, v float64) (Ray, bool) {
+	dir := c.direction.Normalize()
+	right := c.right.Normalize()
+	up := c.up.Normalize()
+	aspect := c.up.Length() / c.right.Length()
+	switch c.projection {
+	case "orthographic":
+		origin := c.location.Translate(c.right.Scale(u)).Translate(c.up.Scale(v))
+		return Ray{Origin: origin, Direction: dir}, true
+	case "fisheye":
+		x, y := 2*u, 2*v*aspect
+		r := math.Hypot(x, y)
+		if r > 1 {
+			return Ray{}, false
+		}
+		if r == 0 {
+			return Ray{Origin: c.location, Direction: dir}, true
+		}
+		theta := r * c.angle * degToRad / 2
+		side := right.Scale(x / r).Add(up.Scale(y / r))
+		return c.rayAlong(dir.Scale(math.Cos(theta)).Add(side.Scale(math.Sin(theta)))), true
+	case "panoramic":
+		phi := u * c.angle * degToRad
+		psi := v * math.Pi
+		return c.rayAlong(dir.Scale(math.Cos(phi)).Add(right.Scale(math.Sin(phi))).
+			Add(up.Scale(math.Tan(psi)))), true
+	case "cylinder":
+		dist := c.direction.Length()
+		switch c.cylinderType {
+		case 1:
+			phi := u * c.angle * degToRad
+			return c.rayAlong(dir.Scale(dist * math.Cos(phi)).
+				Add(right.Scale(dist * math.Sin(phi))).Add(c.up.Scale(v))), true
+		case 2:
+			psi := v * aspect * c.angle * degToRad
+			return c.rayAlong(dir.Scale(dist * math.Cos(psi)).
+				Add(up.Scale(dist * math.Sin(psi))).Add(c.right.Scale(u))), true
+		case 3:
+			phi := u * c.angle * degToRad
+			return Ray{Origin: c.location.Translate(c.up.Scale(v)),
+				Direction: dir.Scale(math.Cos(phi)).Add(right.Scale(math.Sin(phi)))}, true
+		default:
+			psi := v * aspect * c.angle * degToRad
+			return Ray{Origin: c.location.Translate(c.right.Scale(u)),
+				Direction: dir.Scale(math.Cos(psi)).Add(up.Scale(math.Sin(psi)))}, true
+		}
+	case "spherical":
+		phi := u * c.angle * degToRad
+		theta := v * c.vAngle * degToRad
+		return c.rayAlong(dir.Scale(math.Cos(theta) * math.Cos(phi)).
+			Add(right.Scale(math.Cos(theta) * math.Sin(phi))).
+			Add(up.Scale(math.Sin(theta)))), true
+	}
+	return c.rayAlong(c.direction.Add(c.right.Scale(u)).Add(c.up.Scale(v))), true
+}
+
+// footprint is how wide a pixel is where r, the ray through (u, v),
+// leaves the camera and how fast that grows along it, found from the ray
+// through the next pixel across
+func (c *camera) footprint(u, v float64, r Ray) (width, spread float64) {
+	next, ok := c.ray(u+1/float64(imgWidth), v)
+	if !ok {
+		if next, ok = c.ray(u-1/float64(imgWidth), v); !ok {
+			return 0, 0
+		}
+	}
+	cos := math.Min(1, r.Direction.Normalize().Dot(next.Direction.Normalize()))
+	return r.Origin.Dist(next.Origin), math.Acos(cos)
+}
+
+func (c *camera) rayAlong(dir Vector3D) Ray {
+	return Ray{Origin: c.location, Direction: dir.Normalize()}
+}
+
+// samples spreads the pinhole ray r over the lens, all of them meeting
+// again at the focal plane, and over the time the shutter is open. The
+// camera's transforms are then applied at each ray's time
+func (c *camera) samples(r Ray) []Ray {
+	n := 1
+	if c.aperture > 0 || c.shutterClose > c.shutterOpen {
+		n = c.blurSamples
+	}
+	rays := make([]Ray, n)
+	for i := range rays {
+		rays[i] = r
+		if c.aperture > 0 {
+			rays[i] = c.throughLens(r)
+		}
+		// Stratify the times so short sample counts still cover the shutter
+		rays[i].Time = c.shutterOpen
+		if c.shutterClose > c.shutterOpen {
+			rays[i].Time += (float64(i) + rand.Float64()) / float64(n) *
+				(c.shutterClose - c.shutterOpen)
+		}
+		m, _ := c.at(rays[i].Time)
+		rays[i].Origin = rays[i].Origin.Transform(m)
+		rays[i].Direction = rays[i].Direction.Transform(m).Normalize()
+	}
+	return rays
+}
+
+// throughLens moves r to a random point on the lens, aimed where it
+// crosses the focal plane
+func (c *camera) throughLens(r Ray) Ray {
+	dir := c.direction.Normalize()
+	right := c.right.Normalize()
+	up := c.up.Normalize()
+	// Rays that don't cross the focal plane, as in the wider projections,
+	// focus at the same distance instead
+	focalDist := c.focalPoint.Sub(c.location).Dot(dir)
+	t := focalDist
+	if cos := r.Direction.Dot(dir); cos > exprEpsilon {
+		t /= cos
+	}
+	x, y := c.lensPoint()
+	origin := r.Origin.Translate(right.Scale(x * c.aperture / 2)).
+		Translate(up.Scale(y * c.aperture / 2))
+	return CreateRay(origin, r.PointAt(t))
+}
+
+// lensPoint picks a random point on the unit aperture, a disk or a regular
+// polygon with a corner on the x axis
+func (c *camera) lensPoint() (x, y float64) {
+	if c.blades < 3 {
+		r, theta := math.Sqrt(rand.Float64()), 2*math.Pi*rand.Float64()
+		return r * math.Cos(theta), r * math.Sin(theta)
+	}
+	// Pick one of the triangles fanning out from the center, then a point
+	// in it
+	side := 2 * math.Pi / float64(c.blades)
+	theta := side * float64(rand.Intn(c.blades))
+	a, b := rand.Float64(), rand.Float64()
+	if a+b > 1 {
+		a, b = 1-a, 1-b
+	}
+	return a*math.Cos(theta) + b*math.Cos(theta+side),
+		a*math.Sin(theta) + b*math.Sin(theta+side)
+}
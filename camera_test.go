@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// testCamera looks from the origin along +z with the given projection.
+// Cylinder cameras are of the first type, with a vertical axis
+func testCamera(t *testing.T, projection string, angle float64) camera {
+	c := makeCamera()
+	c.projection, c.angle, c.cylinderType = projection, angle, 1
+	c.lookAt, c.hasLookAt = Point3D{0, 0, 1}, true
+	if err := c.orient(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCameraProjections(t *testing.T) {
+	tests := []struct {
+		projection string
+		angle      float64
+		u, v       float64
+		// Degrees from the viewing direction, and up from the horizontal
+		off, elevation float64
+	}{
+		{"perspective", 90, 0, 0, 0, 0},
+		{"perspective", 90, 0.5, 0, 45, 0},
+		{"perspective", 60, -0.5, 0, 30, 0},
+		{"fisheye", 180, 0.5, 0, 90, 0},
+		{"fisheye", 180, 0, 0.25, 45 / 1.333, 45 / 1.333},
+		{"panoramic", 180, 0.5, 0, 90, 0},
+		{"cylinder", 90, 0.5, 0, 45, 0},
+		{"spherical", 360, 0.5, 0, 180, 0},
+		{"spherical", 360, 0.25, 0, 90, 0},
+		{"spherical", 360, 0, 0.5, 90, 90},
+	}
+	for _, test := range tests {
+		c := testCamera(t, test.projection, test.angle)
+		r, ok := c.ray(test.u, test.v)
+		if !ok {
+			t.Errorf("%s (%v, %v): no ray", test.projection, test.u, test.v)
+			continue
+		}
+		dir := r.Direction.Normalize()
+		off := math.Acos(math.Max(-1, math.Min(1, dir.Z))) / degToRad
+		elevation := math.Asin(math.Max(-1, math.Min(1, dir.Y))) / degToRad
+		if math.Abs(off-test.off) > 1e-6 || math.Abs(elevation-test.elevation) > 1e-6 {
+			t.Errorf("%s %v (%v, %v): %v off axis and %v up, want %v and %v", test.projection,
+				test.angle, test.u, test.v, off, elevation, test.off, test.elevation)
+		}
+	}
+}
+
+func TestCameraOrthographic(t *testing.T) {
+	c := testCamera(t, "orthographic", 0)
+	center, _ := c.ray(0, 0)
+	corner, _ := c.ray(0.5, 0.5)
+	if corner.Direction != center.Direction {
+		t.Errorf("orthographic rays aren't parallel: %v and %v", center.Direction, corner.Direction)
+	}
+	if d := corner.Origin.Dist(center.Origin); math.Abs(d-math.Hypot(1.333, 1)/2) > 1e-9 {
+		t.Errorf("orthographic corner starts %v from the center", d)
+	}
+}
+
+func TestCameraFisheyeCorner(t *testing.T) {
+	c := testCamera(t, "fisheye", 180)
+	if _, ok := c.ray(0.5, 0.5); ok {
+		t.Error("fisheye covers the corner of the image")
+	}
+}
+
+func TestCameraErrors(t *testing.T) {
+	c := makeCamera()
+	c.lookAt, c.hasLookAt = Point3D{0, 1, 0}, true
+	if err := c.orient(); err == nil {
+		t.Error("sky parallel to the view: no error")
+	}
+	c = makeCamera()
+	c.angle, c.lookAt, c.hasLookAt = 180, Point3D{0, 0, 1}, true
+	if err := c.orient(); err == nil {
+		t.Error("perspective angle of 180: no error")
+	}
+}
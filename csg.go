@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+)
+
+// Distance a CSG surface must be in front of a ray to count as a hit, so
+// rays leaving one of its surfaces don't immediately hit it again
+const csgEpsilon = 1e-4
+
+// span is a stretch of a ray that lies inside an object
+type span struct {
+	enter, exit surfaceHit
+}
+
+// surfaceHit is where a ray crosses a primitive's surface. The unbounded
+// ends of half spaces such as planes have no object
+type surfaceHit struct {
+	t   float64
+	obj castable
+	// inverted is set when the primitive's outside faces into the solid,
+	// as on the hollow a difference cuts out
+	inverted bool
+}
+
+type csg struct {
+	op       string
+	children []castable
+	object
+}
+
+// invertedSurface flips the normal of a primitive seen from its inside
+type invertedSurface struct {
+	castable
+}
+
+func makeCSG(op string) (c csg) {
+	c.op = op
+	c.init()
+	return
+}
+
+func parseCSG(scanner *povScanner, op string) (castable, error) {
+	if !scanner.Scan() || scanner.Text() != "{" {
+		return nil, errors.New("Missing '{' token")
+	}
+	c := makeCSG(op)
+	for scanner.Scan() {
+		if scanner.Text() == "}" {
+			if len(c.children) == 0 {
+				return nil, nil
+			}
+			c.inherit()
+			return &c, nil
+		}
+		child, isObject, err := parseObject(scanner)
+		if !isObject {
+			err = c.parseModifier(scanner)
+		} else if child != nil {
+			c.children = append(c.children, child)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, eofErr
+}
+
+// inherit pushes the CSG's transforms and motions down to its primitives,
+// and gives its pigment, finish and interior to those without their own
+func (c *csg) inherit() {
+	c.eachLeaf(func(leaf *object) {
+		leaf.place(&c.placement)
+		// The CSG's own textures already carry its transforms
+		for i := range leaf.textures {
+			leaf.textures[i].place(&c.placement)
+		}
+		own := &leaf.textures[0]
+		switch {
+		case !leaf.hasTexture && !own.given():
+			leaf.textures = make([]texture, len(c.textures))
+			for i := range c.textures {
+				leaf.textures[i] = c.textures[i].clone()
+			}
+			leaf.hasTexture = c.hasTexture
+		case !leaf.hasTexture && len(c.textures) == 1:
+			// A leaf giving only some of pigment, normal and finish takes
+			// the rest from the CSG
+			from := c.textures[0]
+			if from.hasPigment && !own.hasPigment {
+				own.pigment, own.hasPigment = from.clone().pigment, true
+			}
+			if from.hasNormal && !own.hasNormal {
+				own.normalPattern, own.hasNormal = from.clone().normalPattern, true
+			}
+			if from.hasFinish && !own.hasFinish {
+				own.finish, own.hasFinish = from.finish, true
+			}
+		}
+		if c.hasInterior && !leaf.hasInterior {
+			leaf.interior, leaf.hasInterior = c.interior, true
+		}
+		if c.hasPhotons && !leaf.hasPhotons {
+			leaf.photons, leaf.hasPhotons = c.photons, true
+		}
+	})
+	c.placement = makePlacement()
+}
+
+func (c *csg) eachLeaf(fn func(leaf *object)) {
+	for _, child := range c.children {
+		if sub, ok := child.(*csg); ok {
+			sub.eachLeaf(fn)
+		} else {
+			fn(child.base())
+		}
+	}
+}
+
+func (c *csg) Intervals(r Ray) []span {
+	var spans []span
+	for i, child := range c.children {
+		childSpans := child.Intervals(r)
+		switch {
+		case i == 0:
+			spans = childSpans
+		case c.op == "intersection":
+			spans = intersectSpans(spans, childSpans)
+		case c.op == "difference":
+			spans = intersectSpans(spans, complementSpans(childSpans))
+		default:
+			spans = unionSpans(spans, childSpans)
+		}
+	}
+	return spans
+}
+
+// nearest finds the first surface in front of the ray, skipping the
+// primitive the ray is leaving. A union keeps all of its children's
+// surfaces, while merge only keeps those on the outside of the solid
+func (c *csg) nearest(r Ray, exclude castable) (hit surfaceHit, found bool) {
+	var spans []span
+	if c.op == "union" {
+		for _, child := range c.children {
+			spans = append(spans, child.Intervals(r)...)
+		}
+	} else {
+		spans = c.Intervals(r)
+	}
+	hit.t = math.Inf(1)
+	for _, s := range spans {
+		for _, bound := range [2]surfaceHit{s.enter, s.exit} {
+			if bound.obj != nil && bound.obj != exclude &&
+				bound.t > csgEpsilon && bound.t < hit.t {
+				hit, found = bound, true
+			}
+		}
+	}
+	return
+}
+
+func (c *csg) Hit(r Ray) (bool, float64) {
+	hit, found := c.nearest(r, nil)
+	return found, hit.t
+}
+
+// Normal is only defined for the primitives a CSG is built from, which
+// hitAnything reports in its place
+func (c *csg) Normal(pt Point3D, time float64) Vector3D {
+	return Vector3D{}
+}
+
+func (inv invertedSurface) Normal(pt Point3D, time float64) Vector3D {
+	return inv.castable.Normal(pt, time).Scale(-1)
+}
+
+// compound objects are made of parts, and report the part a ray hits
+type compound interface {
+	nearest(r Ray, exclude castable) (hit surfaceHit, found bool)
+}
+
+// nearestSurface finds where r first hits obj, descending into CSG
+// objects and meshes to report the primitive whose surface was hit
+func nearestSurface(obj castable, r Ray, exclude castable) (surfaceHit, bool) {
+	if c, ok := obj.(compound); ok {
+		return c.nearest(r, exclude)
+	}
+	hit, t := obj.Hit(r)
+	return surfaceHit{t: t, obj: obj}, hit
+}
+
+// primitive strips the invertedSurface wrapper from a hit object
+func primitive(obj castable) castable {
+	if inv, ok := obj.(invertedSurface); ok {
+		return inv.castable
+	}
+	return obj
+}
+
+func (h surfaceHit) invert() surfaceHit {
+	h.inverted = !h.inverted
+	return h
+}
+
+func unionSpans(a, b []span) []span {
+	all := append(append([]span{}, a...), b...)
+	sort.Slice(all, func(i, j int) bool { return all[i].enter.t < all[j].enter.t })
+	merged := make([]span, 0, len(all))
+	for _, s := range all {
+		if n := len(merged); n > 0 && s.enter.t <= merged[n-1].exit.t {
+			if s.exit.t > merged[n-1].exit.t {
+				merged[n-1].exit = s.exit
+			}
+		} else {
+			merged = append(merged, s)
+		}
+	}
+	return merged
+}
+
+func intersectSpans(a, b []span) []span {
+	var spans []span
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		enter, exit := a[i].enter, a[i].exit
+		if b[j].enter.t > enter.t {
+			enter = b[j].enter
+		}
+		if b[j].exit.t < exit.t {
+			exit = b[j].exit
+		}
+		if enter.t < exit.t {
+			spans = append(spans, span{enter: enter, exit: exit})
+		}
+		if a[i].exit.t < b[j].exit.t {
+			i++
+		} else {
+			j++
+		}
+	}
+	return spans
+}
+
+// complementSpans returns the gaps between spans, whose surfaces face the
+// other way
+func complementSpans(a []span) []span {
+	var spans []span
+	prev := surfaceHit{t: math.Inf(-1)}
+	for _, s := range a {
+		if s.enter.t > prev.t {
+			spans = append(spans, span{enter: prev, exit: s.enter.invert()})
+		}
+		prev = s.exit.invert()
+	}
+	if !math.IsInf(prev.t, 1) {
+		spans = append(spans, span{enter: prev, exit: surfaceHit{t: math.Inf(1)}})
+	}
+	return spans
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// spansOf makes spans from pairs of entry and exit distances
+func spansOf(ts ...float64) []span {
+	var spans []span
+	for i := 0; i+1 < len(ts); i += 2 {
+		spans = append(spans, span{enter: surfaceHit{t: ts[i]}, exit: surfaceHit{t: ts[i+1]}})
+	}
+	return spans
+}
+
+// distances flattens spans back into pairs of distances
+func distances(spans []span) []float64 {
+	ts := []float64{}
+	for _, s := range spans {
+		ts = append(ts, s.enter.t, s.exit.t)
+	}
+	return ts
+}
+
+func TestSpanOps(t *testing.T) {
+	inf := math.Inf(1)
+	tests := []struct {
+		name string
+		got  []span
+		want []float64
+	}{
+		{"union apart", unionSpans(spansOf(1, 2), spansOf(3, 4)), []float64{1, 2, 3, 4}},
+		{"union overlapping", unionSpans(spansOf(1, 3), spansOf(2, 4)), []float64{1, 4}},
+		{"union inside", unionSpans(spansOf(1, 5), spansOf(2, 3)), []float64{1, 5}},
+		{"union touching", unionSpans(spansOf(3, 4), spansOf(1, 3)), []float64{1, 4}},
+		{"intersect overlapping", intersectSpans(spansOf(1, 3), spansOf(2, 4)), []float64{2, 3}},
+		{"intersect apart", intersectSpans(spansOf(1, 2), spansOf(3, 4)), []float64{}},
+		{"intersect several", intersectSpans(spansOf(0, 2, 3, 5), spansOf(1, 4)), []float64{1, 2, 3, 4}},
+		{"complement", complementSpans(spansOf(1, 2, 3, 4)), []float64{-inf, 1, 2, 3, 4, inf}},
+		{"complement of half space", complementSpans(spansOf(-inf, 2)), []float64{2, inf}},
+		{"complement of nothing", complementSpans(nil), []float64{-inf, inf}},
+	}
+	for _, test := range tests {
+		if got := distances(test.got); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestComplementInverts(t *testing.T) {
+	for _, s := range complementSpans(spansOf(1, 2)) {
+		for _, hit := range []surfaceHit{s.enter, s.exit} {
+			if !math.IsInf(hit.t, 0) && !hit.inverted {
+				t.Errorf("surface at %v isn't inverted", hit.t)
+			}
+		}
+	}
+}
+
+func TestDifferenceSpans(t *testing.T) {
+	// A unit sphere with one of radius 0.5 cut from its middle, along x
+	outer, inner := makeSphere(), makeSphere()
+	outer.radius, inner.radius = 1, 0.5
+	c := makeCSG("difference")
+	c.children = []castable{&outer, &inner}
+	r := Ray{Origin: Point3D{-2, 0, 0}, Direction: Vector3D{1, 0, 0}}
+	want := []float64{1, 1.5, 2.5, 3}
+	got := distances(c.Intervals(r))
+	if len(got) != len(want) {
+		t.Fatalf("difference = %v, want %v", got, want)
+	}
+	for i := range want {
+		if math.Abs(got[i]-want[i]) > 1e-9 {
+			t.Fatalf("difference = %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Emitters are sampled over a grid of about emissionSamples points from
+// each point the Whitted renderer shades
+var emissionSamples = 16
+
+// emitter is an object whose finish gives off light from its outer side.
+// Its surface is sampled evenly by area so it lights the scene like an
+// area light, with soft shadows
+type emitter struct {
+	shape sampledShape
+}
+
+// sampledShape is a primitive whose surface can be picked points on
+type sampledShape interface {
+	castable
+	// surfacePoint spreads u and v, each from 0 to 1, evenly over the
+	// surface in object space, giving the point and its outward normal
+	surfacePoint(u, v float64) (Point3D, Vector3D)
+	// surfaceArea is the area of the surface in object space
+	surfaceArea() float64
+}
+
+// findEmitters collects the objects that glow and can be sampled: spheres,
+// boxes, triangles and meshes, on their own or in unions
+func (sc *scene) findEmitters() {
+	var visit func(obj castable)
+	visit = func(obj castable) {
+		if c, ok := obj.(*csg); ok {
+			if c.op == "union" {
+				for _, child := range c.children {
+					visit(child)
+				}
+			}
+			return
+		}
+		shape, ok := obj.(sampledShape)
+		if !ok || shape.surfaceArea() <= 0 {
+			return
+		}
+		for i := range shape.base().textures {
+			if shape.base().textures[i].emits() {
+				sc.emitters = append(sc.emitters, emitter{shape})
+				return
+			}
+		}
+	}
+	for _, obj := range sc.objects {
+		visit(obj)
+	}
+}
+
+// emits is true if any part of tx gives off light
+func (tx *texture) emits() bool {
+	if !tx.finish.emission.isBlack() {
+		return true
+	}
+	for i := range tx.textureMap {
+		if tx.textureMap[i].texture.emits() {
+			return true
+		}
+	}
+	for i := range tx.materials {
+		if tx.materials[i].emits() {
+			return true
+		}
+	}
+	return false
+}
+
+// emitted is the light a surface of pigment c and finish fin gives off
+func emitted(fin finish, c fColor) fColor {
+	return fColor{R: fin.emission.R * c.R, G: fin.emission.G * c.G, B: fin.emission.B * c.B, A: c.A}
+}
+
+// emitterFor is the emitter obj is sampled as, if it is one
+func (sc *scene) emitterFor(obj castable) *emitter {
+	for i := range sc.emitters {
+		if sc.emitters[i].is(obj) {
+			return &sc.emitters[i]
+		}
+	}
+	return nil
+}
+
+// is true if obj is the emitter's shape, or one of its mesh's faces
+func (e *emitter) is(obj castable) bool {
+	obj = primitive(obj)
+	if f, ok := obj.(meshFace); ok {
+		obj = f.mesh
+	}
+	return castable(e.shape) == obj
+}
+
+// sample picks the point (u, v) on the emitter as placed at time t, with
+// its outward normal and the pdf of picking it over the world space area
+func (e *emitter) sample(u, v, t float64) (Point3D, Vector3D, float64) {
+	m, inv := e.shape.base().at(t)
+	pt, normal := e.shape.surfacePoint(u, v)
+	// Areas stretch by the determinant and shrink by how much the normal
+	// is lengthened
+	normal = normal.Transform(inv.Transpose())
+	stretch := normal.Length() / math.Abs(inv.Det())
+	return pt.Transform(m), normal.Normalize(), 1 / (e.shape.surfaceArea() * stretch)
+}
+
+// pdf is the pdf over solid angle of sampling pt, with world space normal
+// normal, from the point from
+func (e *emitter) pdf(from, pt Point3D, normal Vector3D, t float64) float64 {
+	m, inv := e.shape.base().at(t)
+	areaPdf := normal.Transform(m.Transpose()).Length() * math.Abs(inv.Det()) / e.shape.surfaceArea()
+	toPt := pt.Sub(from)
+	dist := toPt.Length()
+	cosLight := math.Abs(toPt.Dot(normal)) / dist
+	if cosLight == 0 {
+		return math.Inf(1)
+	}
+	return areaPdf * dist * dist / cosLight
+}
+
+// sampleEmitter picks point (u, v) on e to light pt from, giving the
+// direction to it, the light it sends that way, its pdf over solid angle
+// and how much reaches pt past whatever is in between. The pdf is 0 where
+// the emitter faces away
+func (sc *scene) sampleEmitter(e *emitter, pt Point3D, u, v, time float64, exclude castable) (L Vector3D,
+	light fColor, pdf float64, lit fColor) {
+	lightPt, normal, areaPdf := e.sample(u, v, time)
+	toLight := lightPt.Sub(pt)
+	dist := toLight.Length()
+	L = toLight.Scale(1 / dist)
+	cosLight := -L.Dot(normal)
+	if cosLight <= 0 {
+		return L, fColor{}, 0, fColor{}
+	}
+	r := CreateRay(pt, lightPt)
+	r.Time = time
+	// A mesh is shaded as the face picked, for its uv
+	var shape castable = e.shape
+	if m, ok := shape.(*mesh); ok {
+		i, _ := m.pick(u)
+		shape = meshFace{m, i}
+	}
+	light = emitted(shape.Finish(lightPt, r), shape.Color(lightPt, r))
+	// Stop short so the emitter doesn't shadow itself
+	lit = sc.shadowFilter(pt, time, r.PointAt(dist-csgEpsilon), exclude, false)
+	return L, light, areaPdf * dist * dist / cosLight, lit
+}
+
+// emitterLight is the light from every emitter but obj reaching pt,
+// shaded by fin for a viewer at eye. Each emitter is sampled once in each
+// cell of a grid, at a random point within it
+func (sc *scene) emitterLight(obj castable, fin finish, color fColor, normal Vector3D, pt,
+	eye Point3D, time float64) fColor {
+	view := eye.Sub(pt).Normalize()
+	model := fin.bsdf()
+	n := int(math.Ceil(math.Sqrt(float64(emissionSamples))))
+	sum := fColor{A: 1}
+	for i := range sc.emitters {
+		e := &sc.emitters[i]
+		if e.is(obj) {
+			continue
+		}
+		for j := 0; j < n*n; j++ {
+			u, v := (float64(j/n)+rand.Float64())/float64(n), (float64(j%n)+rand.Float64())/float64(n)
+			L, light, pdf, lit := sc.sampleEmitter(e, pt, u, v, time, obj)
+			if pdf <= 0 || lit.isBlack() {
+				continue
+			}
+			shade := model.shade(color, normal, view, L)
+			sum = sum.Add(light.Tint(shade).Tint(lit).Scale(1 / (math.Pi * pdf * float64(n*n))))
+		}
+	}
+	return fColor{R: sum.R, G: sum.G, B: sum.B, A: color.A}
+}
+
+func (s *sphere) surfacePoint(u, v float64) (Point3D, Vector3D) {
+	y := 1 - 2*u
+	r, phi := math.Sqrt(math.Max(0, 1-y*y)), 2*math.Pi*v
+	normal := Vector3D{r * math.Cos(phi), y, r * math.Sin(phi)}
+	return s.center.Translate(normal.Scale(s.radius)), normal
+}
+
+func (s *sphere) surfaceArea() float64 {
+	return 4 * math.Pi * s.radius * s.radius
+}
+
+// surfacePoint picks a face by its share of the area, then a point on it
+func (b *box) surfacePoint(u, v float64) (Point3D, Vector3D) {
+	low := [3]float64{b.corner1.X, b.corner1.Y, b.corner1.Z}
+	high := [3]float64{b.corner2.X, b.corner2.Y, b.corner2.Z}
+	faces := b.faceAreas()
+	pick := u * b.surfaceArea()
+	axis := 0
+	for axis < 2 && pick >= 2*faces[axis] {
+		pick -= 2 * faces[axis]
+		axis++
+	}
+	// The low face then the high one
+	side, sign := low, -1.0
+	if pick >= faces[axis] {
+		pick, side, sign = pick-faces[axis], high, 1
+	}
+	s := 0.0
+	if faces[axis] > 0 {
+		s = math.Min(1, pick/faces[axis])
+	}
+	var pt, normal [3]float64
+	pt[axis], normal[axis] = side[axis], sign
+	a, c := (axis+1)%3, (axis+2)%3
+	pt[a], pt[c] = low[a]+s*(high[a]-low[a]), low[c]+v*(high[c]-low[c])
+	return Point3D{pt[0], pt[1], pt[2]}, Vector3D{normal[0], normal[1], normal[2]}
+}
+
+func (b *box) surfaceArea() float64 {
+	faces := b.faceAreas()
+	return 2 * (faces[0] + faces[1] + faces[2])
+}
+
+// faceAreas is the area of the faces across the x, y and z axes
+func (b *box) faceAreas() [3]float64 {
+	size := b.corner2.Sub(b.corner1)
+	return [3]float64{size.Y * size.Z, size.X * size.Z, size.X * size.Y}
+}
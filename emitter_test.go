@@ -0,0 +1,165 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// placed moves obj by the given transforms, applied in order
+func placed(obj *object, ops ...transformOp) {
+	for _, op := range ops {
+		obj.transform(op.matrix())
+	}
+}
+
+// tetrahedron is the corner of the unit cube cut off by x + y + z = 1, as
+// a mesh with its normals pointing out
+const tetrahedron = `{
+	triangle { <0,0,0>, <0,1,0>, <1,0,0> }
+	triangle { <0,0,0>, <1,0,0>, <0,0,1> }
+	triangle { <0,0,0>, <0,0,1>, <0,1,0> }
+	triangle { <1,0,0>, <0,1,0>, <0,0,1> }
+}`
+
+// tetrahedronArea is three right triangles and an equilateral one
+var tetrahedronArea = 1.5 + math.Sqrt(3)/2
+
+func parseTestMesh(t *testing.T, src string) *mesh {
+	scanner := newPOVScanner(strings.NewReader(src), "test.pov")
+	defer scanner.Close()
+	obj, err := parseMesh(scanner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return obj.(*mesh)
+}
+
+// The average of the inverse area pdf is the surface's area in world
+// space. Faces stretched unevenly have pdfs of their own, so it's only
+// exact on average
+func TestEmitterAreaPdf(t *testing.T) {
+	rand.Seed(5)
+	scale := func(x, y, z float64) transformOp { return transformOp{kind: "scale", vec: Vector3D{x, y, z}} }
+	rotate := transformOp{kind: "rotate", vec: Vector3D{30, 45, 10}}
+	move := transformOp{kind: "translate", vec: Vector3D{1, -2, 3}}
+
+	ball := makeSphere()
+	ball.radius = 0.5
+	placed(&ball.object, scale(3, 3, 3), rotate, move)
+	cube := makeBox()
+	cube.corner1, cube.corner2 = Point3D{0, 0, 0}, Point3D{1, 2, 3}
+	placed(&cube.object, scale(2, 1, 0.5), rotate, move)
+	tetra := parseTestMesh(t, tetrahedron)
+	placed(&tetra.object, scale(2, 2, 2), rotate, move)
+	// The 1 x 2 x 3 box stretched to 2 x 2 x 1.5
+	tests := []struct {
+		name  string
+		shape sampledShape
+		area  float64
+	}{
+		{"sphere", &ball, 4 * math.Pi * 1.5 * 1.5},
+		{"box", &cube, 2 * (2*2 + 2*1.5 + 2*1.5)},
+		{"mesh", tetra, 4 * tetrahedronArea},
+	}
+	for _, test := range tests {
+		e := emitter{test.shape}
+		sum := 0.0
+		const n = 100000
+		for i := 0; i < n; i++ {
+			_, _, pdf := e.sample(rand.Float64(), rand.Float64(), 0)
+			sum += 1 / pdf
+		}
+		if got := sum / n; math.Abs(got-test.area) > 0.01*test.area {
+			t.Errorf("%s: area %v, want %v", test.name, got, test.area)
+		}
+	}
+}
+
+// Over the points facing it, the solid angle pdf from a point outside a
+// sphere covers the cone the sphere fills once, and pdf agrees with sample
+func TestEmitterSolidAnglePdf(t *testing.T) {
+	rand.Seed(6)
+	ball := makeSphere()
+	ball.radius = 1
+	placed(&ball.object, transformOp{kind: "translate", vec: Vector3D{0, 0, 3}})
+	e := emitter{&ball}
+	from := Point3D{}
+	sum := 0.0
+	const n = 200000
+	for i := 0; i < n; i++ {
+		pt, normal, areaPdf := e.sample(rand.Float64(), rand.Float64(), 0)
+		toPt := pt.Sub(from)
+		if toPt.Dot(normal) >= 0 {
+			continue
+		}
+		pdf := e.pdf(from, pt, normal, 0)
+		dist := toPt.Length()
+		if want := areaPdf * dist * dist / (-toPt.Dot(normal) / dist); math.Abs(pdf-want) > 1e-9*want {
+			t.Fatalf("pdf %v, want %v", pdf, want)
+		}
+		sum += 1 / pdf
+	}
+	want := 2 * math.Pi * (1 - math.Sqrt(1-1.0/9))
+	if got := sum / n; math.Abs(got-want) > 0.02*want {
+		t.Errorf("solid angle %v, want %v", got, want)
+	}
+}
+
+func TestBoxSurfacePoints(t *testing.T) {
+	b := makeBox()
+	b.corner1, b.corner2 = Point3D{-1, 0, 2}, Point3D{1, 3, 2.5}
+	for i := 0; i < 1000; i++ {
+		pt, normal := b.surfacePoint(rand.Float64(), rand.Float64())
+		// The normal picks the face the point lies on
+		low := [3]float64{b.corner1.X, b.corner1.Y, b.corner1.Z}
+		high := [3]float64{b.corner2.X, b.corner2.Y, b.corner2.Z}
+		p, n := [3]float64{pt.X, pt.Y, pt.Z}, [3]float64{normal.X, normal.Y, normal.Z}
+		for axis := range p {
+			face := (n[axis] < 0 && p[axis] == low[axis]) || (n[axis] > 0 && p[axis] == high[axis])
+			inside := low[axis] <= p[axis] && p[axis] <= high[axis]
+			if (n[axis] != 0 && !face) || !inside {
+				t.Fatalf("point %v with normal %v isn't on the box", pt, normal)
+			}
+		}
+	}
+}
+
+// Faces are picked by their share of the mesh's area, and the points
+// picked lie on them
+func TestMeshSurfacePoints(t *testing.T) {
+	rand.Seed(8)
+	m := parseTestMesh(t, tetrahedron)
+	if got := m.surfaceArea(); math.Abs(got-tetrahedronArea) > 1e-9 {
+		t.Fatalf("area %v, want %v", got, tetrahedronArea)
+	}
+	picked := make([]int, len(m.triangles))
+	const n = 100000
+	for i := 0; i < n; i++ {
+		pt, normal := m.surfacePoint(rand.Float64(), rand.Float64())
+		face := -1
+		for j := range m.triangles {
+			e1, e2 := m.triangles[j].edges()
+			if e1.Cross(e2).Normalize().Sub(normal).Length() < 1e-9 {
+				face = j
+			}
+		}
+		if face < 0 {
+			t.Fatalf("normal %v isn't a face's", normal)
+		}
+		// The point is in the face's plane and inside its edges
+		tri := &m.triangles[face]
+		r := Ray{Origin: pt.Translate(normal), Direction: normal.Scale(-1)}
+		if ok, dist, _, _ := tri.hit(r); !ok || math.Abs(dist-1) > 1e-9 {
+			t.Fatalf("point %v isn't on face %d", pt, face)
+		}
+		picked[face]++
+	}
+	for j := range m.triangles {
+		want := m.triangles[j].area() / tetrahedronArea
+		if got := float64(picked[j]) / n; math.Abs(got-want) > 0.01 {
+			t.Errorf("face %d picked %v of the time, want %v", j, got, want)
+		}
+	}
+}
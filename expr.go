@@ -0,0 +1,492 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// exprValue is the result of evaluating a numeric expression. Floats have a
+// size of 1, vectors 2 or 3 and colors up to 5 (filter and transmit)
+type exprValue struct {
+	v    [5]float64
+	size int
+}
+
+// Tolerance for float equality and truth tests
+const exprEpsilon = 1e-10
+
+type exprFunc struct {
+	args int
+	call func(args []exprValue) (exprValue, error)
+}
+
+var (
+	exprConstants = map[string]exprValue{
+		"pi":      floatValue(math.Pi),
+		"x":       vectorValue(xAxis),
+		"y":       vectorValue(yAxis),
+		"z":       vectorValue(zAxis),
+		"true":    floatValue(1),
+		"yes":     floatValue(1),
+		"on":      floatValue(1),
+		"false":   floatValue(0),
+		"no":      floatValue(0),
+		"off":     floatValue(0),
+		"version": floatValue(3.7),
+	}
+
+	// Components selected by the dot operator, as in Vec.x or Color.red
+	vectorItems = map[string]int{
+		"x": 0, "y": 1, "z": 2, "t": 3,
+		"u": 0, "v": 1,
+		"red": 0, "green": 1, "blue": 2, "filter": 3, "transmit": 4,
+	}
+
+	exprFuncs = map[string]exprFunc{
+		"sin":     floatFunc(math.Sin),
+		"cos":     floatFunc(math.Cos),
+		"tan":     floatFunc(math.Tan),
+		"asin":    floatFunc(math.Asin),
+		"acos":    floatFunc(math.Acos),
+		"atan":    floatFunc(math.Atan),
+		"sqrt":    floatFunc(math.Sqrt),
+		"abs":     floatFunc(math.Abs),
+		"exp":     floatFunc(math.Exp),
+		"ln":      floatFunc(math.Log),
+		"log":     floatFunc(math.Log10),
+		"floor":   floatFunc(math.Floor),
+		"ceil":    floatFunc(math.Ceil),
+		"int":     floatFunc(math.Trunc),
+		"radians": floatFunc(func(a float64) float64 { return a * degToRad }),
+		"degrees": floatFunc(func(a float64) float64 { return a / degToRad }),
+		"pow":     floatFunc2(math.Pow),
+		"atan2":   floatFunc2(math.Atan2),
+		"mod":     floatFunc2(math.Mod),
+		"min":     floatFunc2(math.Min),
+		"max":     floatFunc2(math.Max),
+		"vlength": {args: 1, call: func(args []exprValue) (exprValue, error) {
+			return floatValue(args[0].vector().Length()), nil
+		}},
+		"vnormalize": {args: 1, call: func(args []exprValue) (exprValue, error) {
+			vec := args[0].vector()
+			if vec.Length() == 0 {
+				return vectorValue(vec), nil
+			}
+			return vectorValue(vec.Normalize()), nil
+		}},
+		"vdot": {args: 2, call: func(args []exprValue) (exprValue, error) {
+			return floatValue(args[0].vector().Dot(args[1].vector())), nil
+		}},
+		"vcross": {args: 2, call: func(args []exprValue) (exprValue, error) {
+			return vectorValue(args[0].vector().Cross(args[1].vector())), nil
+		}},
+	}
+)
+
+func floatValue(f float64) exprValue {
+	return exprValue{v: [5]float64{f}, size: 1}
+}
+
+func vectorValue(vec Vector3D) exprValue {
+	return exprValue{v: [5]float64{vec.X, vec.Y, vec.Z}, size: 3}
+}
+
+func floatFunc(f func(float64) float64) exprFunc {
+	return exprFunc{args: 1, call: func(args []exprValue) (exprValue, error) {
+		a, err := args[0].float()
+		return floatValue(f(a)), err
+	}}
+}
+
+func floatFunc2(f func(float64, float64) float64) exprFunc {
+	return exprFunc{args: 2, call: func(args []exprValue) (exprValue, error) {
+		a, err := args[0].float()
+		if err != nil {
+			return exprValue{}, err
+		}
+		b, err := args[1].float()
+		return floatValue(f(a, b)), err
+	}}
+}
+
+func (val exprValue) float() (float64, error) {
+	if val.size != 1 {
+		return 0, errors.New("Float expected but vector found")
+	}
+	return val.v[0], nil
+}
+
+// promote widens a float to a vector of the given size by repeating it, and
+// pads shorter vectors with zeros
+func (val exprValue) promote(size int) exprValue {
+	if val.size >= size {
+		return val
+	}
+	if val.size == 1 {
+		for i := 1; i < size; i++ {
+			val.v[i] = val.v[0]
+		}
+	}
+	val.size = size
+	return val
+}
+
+func (val exprValue) vector() Vector3D {
+	val = val.promote(3)
+	return Vector3D{X: val.v[0], Y: val.v[1], Z: val.v[2]}
+}
+
+func binaryOp(a, b exprValue, op string) (exprValue, error) {
+	size := a.size
+	if b.size > size {
+		size = b.size
+	}
+	a, b = a.promote(size), b.promote(size)
+	for i := 0; i < size; i++ {
+		switch op {
+		case "+":
+			a.v[i] += b.v[i]
+		case "-":
+			a.v[i] -= b.v[i]
+		case "*":
+			a.v[i] *= b.v[i]
+		case "/":
+			if b.v[i] == 0 {
+				return a, errors.New("Divide by zero")
+			}
+			a.v[i] /= b.v[i]
+		}
+	}
+	return a, nil
+}
+
+// parseExpr evaluates a numeric expression, consuming the comma that may
+// separate it from the next parameter
+func parseExpr(scanner *povScanner) (exprValue, error) {
+	val, err := parseCond(scanner)
+	if err == nil && scanner.ScanRaw() && scanner.Text() != "," {
+		scanner.Unscan()
+	}
+	return val, err
+}
+
+func parseFloat(scanner *povScanner) (float64, error) {
+	val, err := parseExpr(scanner)
+	if err != nil {
+		return 0, err
+	}
+	return val.float()
+}
+
+func boolValue(b bool) exprValue {
+	if b {
+		return floatValue(1)
+	}
+	return floatValue(0)
+}
+
+// scanOp checks whether the next token is one of ops, consuming it if so.
+// Lookahead is raw so a directive after an expression isn't run early
+func scanOp(scanner *povScanner, ops ...string) (string, bool) {
+	if !scanner.ScanRaw() {
+		return "", false
+	}
+	for _, op := range ops {
+		if scanner.Text() == op {
+			return op, true
+		}
+	}
+	scanner.Unscan()
+	return "", false
+}
+
+// parseCond handles the ternary operator, the lowest precedence level
+func parseCond(scanner *povScanner) (exprValue, error) {
+	cond, err := parseOr(scanner)
+	if err != nil {
+		return cond, err
+	}
+	if _, ok := scanOp(scanner, "?"); !ok {
+		return cond, nil
+	}
+	truth, err := cond.float()
+	if err != nil {
+		return cond, err
+	}
+	ifTrue, err := parseCond(scanner)
+	if err != nil {
+		return ifTrue, err
+	}
+	if _, ok := scanOp(scanner, ":"); !ok {
+		return ifTrue, errors.New("Expected ':' in conditional expression")
+	}
+	ifFalse, err := parseCond(scanner)
+	if math.Abs(truth) > exprEpsilon {
+		return ifTrue, err
+	}
+	return ifFalse, err
+}
+
+func parseOr(scanner *povScanner) (exprValue, error) {
+	left, err := parseAnd(scanner)
+	for err == nil {
+		if _, ok := scanOp(scanner, "|"); !ok {
+			break
+		}
+		var right exprValue
+		if right, err = parseAnd(scanner); err == nil {
+			left, err = logicOp(left, right, func(a, b bool) bool { return a || b })
+		}
+	}
+	return left, err
+}
+
+func parseAnd(scanner *povScanner) (exprValue, error) {
+	left, err := parseCompare(scanner)
+	for err == nil {
+		if _, ok := scanOp(scanner, "&"); !ok {
+			break
+		}
+		var right exprValue
+		if right, err = parseCompare(scanner); err == nil {
+			left, err = logicOp(left, right, func(a, b bool) bool { return a && b })
+		}
+	}
+	return left, err
+}
+
+func logicOp(a, b exprValue, op func(a, b bool) bool) (exprValue, error) {
+	fa, err := a.float()
+	if err != nil {
+		return a, err
+	}
+	fb, err := b.float()
+	return boolValue(op(math.Abs(fa) > exprEpsilon, math.Abs(fb) > exprEpsilon)), err
+}
+
+// parseCompare handles <, <=, =, !=, >= and >. Inside a vector literal
+// comparisons must be parenthesized since > would end the vector
+func parseCompare(scanner *povScanner) (exprValue, error) {
+	left, err := parseSum(scanner)
+	if err != nil {
+		return left, err
+	}
+	op, ok := scanOp(scanner, "<", ">", "=", "!")
+	if !ok {
+		return left, nil
+	}
+	if op != "=" {
+		if _, ok := scanOp(scanner, "="); ok {
+			op += "="
+		} else if op == "!" {
+			return left, errors.New("Expected '=' after '!'")
+		}
+	}
+	right, err := parseSum(scanner)
+	if err != nil {
+		return right, err
+	}
+	a, err := left.float()
+	if err != nil {
+		return left, err
+	}
+	b, err := right.float()
+	switch op {
+	case "<":
+		return boolValue(a < b), err
+	case "<=":
+		return boolValue(a <= b), err
+	case "=":
+		return boolValue(math.Abs(a-b) < exprEpsilon), err
+	case "!=":
+		return boolValue(math.Abs(a-b) >= exprEpsilon), err
+	case ">=":
+		return boolValue(a >= b), err
+	}
+	return boolValue(a > b), err
+}
+
+func parseSum(scanner *povScanner) (exprValue, error) {
+	left, err := parseProduct(scanner)
+	for err == nil {
+		op, ok := scanOp(scanner, "+", "-")
+		if !ok {
+			break
+		}
+		var right exprValue
+		if right, err = parseProduct(scanner); err == nil {
+			left, err = binaryOp(left, right, op)
+		}
+	}
+	return left, err
+}
+
+func parseProduct(scanner *povScanner) (exprValue, error) {
+	left, err := parseUnary(scanner)
+	for err == nil {
+		op, ok := scanOp(scanner, "*", "/")
+		if !ok {
+			break
+		}
+		var right exprValue
+		if right, err = parseUnary(scanner); err == nil {
+			left, err = binaryOp(left, right, op)
+		}
+	}
+	return left, err
+}
+
+func parseUnary(scanner *povScanner) (exprValue, error) {
+	if !scanner.Scan() {
+		return exprValue{}, eofErr
+	}
+	switch scanner.Text() {
+	case "-":
+		val, err := parseUnary(scanner)
+		for i := 0; i < val.size; i++ {
+			val.v[i] = -val.v[i]
+		}
+		return val, err
+	case "+":
+		return parseUnary(scanner)
+	case "!":
+		val, err := parseUnary(scanner)
+		if err != nil {
+			return val, err
+		}
+		f, err := val.float()
+		return boolValue(math.Abs(f) <= exprEpsilon), err
+	}
+	scanner.Unscan()
+	return parsePrimary(scanner)
+}
+
+func parsePrimary(scanner *povScanner) (exprValue, error) {
+	if !scanner.Scan() {
+		return exprValue{}, eofErr
+	}
+	token := scanner.Text()
+	switch token {
+	case "(":
+		val, err := parseCond(scanner)
+		if err == nil && (!scanner.ScanRaw() || scanner.Text() != ")") {
+			err = errors.New("Expected ')', found: '" + scanner.Text() + "'")
+		}
+		return val, err
+	case "<":
+		return parseVectorLiteral(scanner)
+	case "color", "colour":
+		return parseUnary(scanner)
+	case "rgb", "rgbf", "rgbt", "rgbft":
+		return parseColorKeyword(scanner, token)
+	}
+
+	if f, err := strconv.ParseFloat(token, 64); err == nil {
+		return floatValue(f), nil
+	}
+	if val, ok := exprConstants[token]; ok {
+		return val, nil
+	}
+	if fn, ok := exprFuncs[token]; ok {
+		return parseCall(scanner, token, fn)
+	}
+	if val, ok := lookupValue(scanner, token); ok {
+		return val, nil
+	}
+	return exprValue{}, errors.New("Expected numeric expression, found: '" + token + "'")
+}
+
+// lookupValue resolves a declared identifier, with an optional .x, .red,
+// etc. suffix selecting a single component
+func lookupValue(scanner *povScanner, token string) (exprValue, bool) {
+	name, item := token, ""
+	if dot := strings.IndexByte(token, '.'); dot > 0 {
+		name, item = token[:dot], token[dot+1:]
+	}
+	sym, ok := scanner.lookup(name)
+	if !ok || sym.tokens != nil || sym.macro != nil {
+		return exprValue{}, false
+	}
+	if item == "" {
+		return sym.value, true
+	}
+	ndx, ok := vectorItems[item]
+	if !ok || ndx >= sym.value.size {
+		return exprValue{}, false
+	}
+	return floatValue(sym.value.v[ndx]), true
+}
+
+// parseColorKeyword reads the vector after rgb, rgbf, rgbt or rgbft into
+// a five component color, filling in the channels the keyword names
+func parseColorKeyword(scanner *povScanner, keyword string) (exprValue, error) {
+	val, err := parseSum(scanner)
+	if err != nil {
+		return val, err
+	}
+	size := len(keyword)
+	if val.size == 2 {
+		return val, errors.New("Too few components for " + keyword)
+	}
+	val = val.promote(size)
+	if size < 5 && val.size > size {
+		return val, errors.New("Too many components for " + keyword)
+	}
+	if keyword == "rgbt" {
+		val.v[3], val.v[4] = 0, val.v[3]
+	}
+	val.size = 5
+	return val, nil
+}
+
+func parseVectorLiteral(scanner *povScanner) (exprValue, error) {
+	val := exprValue{}
+	for {
+		if !scanner.Scan() {
+			return val, eofErr
+		}
+		if scanner.Text() == ">" {
+			break
+		}
+		scanner.Unscan()
+		if val.size == len(val.v) {
+			return val, errors.New("Unterminated Vector")
+		}
+		component, err := parseSum(scanner)
+		if err != nil {
+			return val, err
+		}
+		f, err := component.float()
+		if err != nil {
+			return val, err
+		}
+		if scanner.ScanRaw() && scanner.Text() != "," {
+			scanner.Unscan()
+		}
+		val.v[val.size] = f
+		val.size++
+	}
+	if val.size < 2 {
+		return val, errors.New("Vector needs at least 2 components")
+	}
+	return val, nil
+}
+
+func parseCall(scanner *povScanner, name string, fn exprFunc) (exprValue, error) {
+	if !scanner.ScanRaw() || scanner.Text() != "(" {
+		return exprValue{}, errors.New("Expected '(' after " + name)
+	}
+	args := make([]exprValue, fn.args)
+	for i := range args {
+		var err error
+		if args[i], err = parseExpr(scanner); err != nil {
+			return exprValue{}, err
+		}
+	}
+	if !scanner.ScanRaw() || scanner.Text() != ")" {
+		return exprValue{}, errors.New("Expected ')' after arguments to " + name)
+	}
+	return fn.call(args)
+}
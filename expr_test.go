@@ -0,0 +1,132 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+// evalExpr evaluates src as a single expression
+func evalExpr(src string) (exprValue, error) {
+	scanner := newPOVScanner(strings.NewReader(src), "test.pov")
+	defer scanner.Close()
+	return parseExpr(scanner)
+}
+
+func TestExprFloats(t *testing.T) {
+	tests := []struct {
+		src  string
+		want float64
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"12 / 4 / 3", 1},
+		{"-2 * -3", 6},
+		{"2 * pi", 2 * math.Pi},
+		{"sqrt(16) + abs(-1)", 5},
+		{"pow(2, 10)", 1024},
+		{"max(3, 7) - min(3, 7)", 4},
+		{"mod(7, 3)", 1},
+		{"int(-2.5) + floor(-2.5)", -5},
+		{"degrees(radians(90))", 90},
+		{"vlength(<3, 4, 0>)", 5},
+		{"vdot(x, y + z)", 0},
+		{"1 < 2", 1},
+		{"2 <= 1", 0},
+		{"1 = 1 & 2 != 3", 1},
+		{"0 | !0", 1},
+		{"1 > 2 ? 10 : 20", 20},
+		{"on + yes + true", 3},
+	}
+	for _, test := range tests {
+		val, err := evalExpr(test.src)
+		if err != nil {
+			t.Errorf("%q: %v", test.src, err)
+			continue
+		}
+		if got, err := val.float(); err != nil || math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%q = %v (%v), want %v", test.src, got, err, test.want)
+		}
+	}
+}
+
+func TestExprVectors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want exprValue
+	}{
+		{"<1, 2, 3> + 1", exprValue{v: [5]float64{2, 3, 4}, size: 3}},
+		{"2 * <1, 2>", exprValue{v: [5]float64{2, 4}, size: 2}},
+		{"<1, 2> + <1, 1, 1>", exprValue{v: [5]float64{2, 3, 1}, size: 3}},
+		{"vcross(x, y)", exprValue{v: [5]float64{0, 0, 1}, size: 3}},
+		{"vnormalize(<0, 3, 0>)", exprValue{v: [5]float64{0, 1, 0}, size: 3}},
+		{"rgb <1, 0.5, 0>", exprValue{v: [5]float64{1, 0.5, 0}, size: 5}},
+		{"rgbf <1, 0.5, 0, 0.9>", exprValue{v: [5]float64{1, 0.5, 0, 0.9}, size: 5}},
+		{"rgbt <1, 0.5, 0, 0.9>", exprValue{v: [5]float64{1, 0.5, 0, 0, 0.9}, size: 5}},
+		{"color rgb 0.5", exprValue{v: [5]float64{0.5, 0.5, 0.5}, size: 5}},
+	}
+	for _, test := range tests {
+		got, err := evalExpr(test.src)
+		if err != nil {
+			t.Errorf("%q: %v", test.src, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q = %v, want %v", test.src, got, test.want)
+		}
+	}
+}
+
+func TestExprErrors(t *testing.T) {
+	for _, src := range []string{
+		"1 / 0",
+		"(1 + 2",
+		"sin 1",
+		"pow(1)",
+		"<1>",
+		"<1, 2, 3, 4, 5, 6>",
+		"rgb <1, 2, 3, 4>",
+		"rgb <1 -2 3>",
+		"undeclared",
+	} {
+		if _, err := evalExpr(src); err == nil {
+			t.Errorf("%q: no error", src)
+		}
+	}
+	if val, err := evalExpr("<1, 2, 3>"); err != nil {
+		t.Fatal(err)
+	} else if _, err := val.float(); err == nil {
+		t.Error("vector used as a float: no error")
+	}
+}
+
+// A minus sign without a comma before it subtracts, so <1 -2 3> is the two
+// component <-1, 3>, which points, vectors and colors reject
+func TestVectorSizes(t *testing.T) {
+	parse := map[string]func(scanner *povScanner) error{
+		"point":  func(scanner *povScanner) error { _, err := parsePoint(scanner); return err },
+		"vector": func(scanner *povScanner) error { _, err := parseVector(scanner); return err },
+		"color":  func(scanner *povScanner) error { _, err := parseColor(scanner); return err },
+	}
+	tests := []struct {
+		kind, src string
+		ok        bool
+	}{
+		{"point", "<1, -2, 3>", true},
+		{"point", "<1 -2 3>", false},
+		{"vector", "2", true},
+		{"vector", "<1, 2>", false},
+		{"vector", "<1, 2, 3, 4>", false},
+		{"color", "<1 -2 3>", false},
+		{"color", "<1, 0.5, 0, 0.9>", true},
+		{"color", "rgb 1", true},
+	}
+	for _, test := range tests {
+		scanner := newPOVScanner(strings.NewReader(test.src), "test.pov")
+		if err := parse[test.kind](scanner); (err == nil) != test.ok {
+			t.Errorf("%s %q: error %v", test.kind, test.src, err)
+		}
+		scanner.Close()
+	}
+}
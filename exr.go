@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+)
+
+// exrMagic starts every OpenEXR file
+var exrMagic = []byte{0x76, 0x2f, 0x31, 0x01}
+
+// OpenEXR compressions that can be read, and the pixel types of channels
+const (
+	exrNone = 0
+	exrRLE  = 1
+	exrZIPS = 2
+	exrZIP  = 3
+
+	exrUint  = 0
+	exrHalf  = 1
+	exrFloat = 2
+)
+
+// exrChannel is one channel of an OpenEXR image, as its header lists it
+type exrChannel struct {
+	name      string
+	pixelType int
+	// size is how many bytes each sample takes
+	size int
+}
+
+// decodeEXR reads a single part OpenEXR image stored in scanlines,
+// uncompressed or with RLE or ZIP compression. R, G and B, or Y for grey
+// images, are read in half, float or uint, with A as the transmit where
+// there is one. Channels of other layers are skipped
+func decodeEXR(data []byte) (raster, error) {
+	if len(data) < 8 || !bytes.HasPrefix(data, exrMagic) {
+		return raster{}, errors.New("Missing OpenEXR header")
+	}
+	// Tiled, deep and multipart files
+	if flags := binary.LittleEndian.Uint32(data[4:]); flags&0xff != 2 || flags&0x1a00 != 0 {
+		return raster{}, errors.New("Unsupported OpenEXR file: only scanline images can be read")
+	}
+	var channels []exrChannel
+	compression, window, haveWindow := -1, [4]int{}, false
+	at := 8
+	short := errors.New("Unexpected end of OpenEXR header")
+	for {
+		name, ok := exrString(data, &at)
+		if !ok {
+			return raster{}, short
+		}
+		if name == "" {
+			break
+		}
+		kind, ok := exrString(data, &at)
+		if !ok || at+4 > len(data) {
+			return raster{}, short
+		}
+		size := int(binary.LittleEndian.Uint32(data[at:]))
+		at += 4
+		if size < 0 || at+size > len(data) {
+			return raster{}, short
+		}
+		value := data[at : at+size]
+		at += size
+		switch {
+		case name == "channels" && kind == "chlist":
+			var err error
+			if channels, err = exrChannels(value); err != nil {
+				return raster{}, err
+			}
+		case name == "compression" && kind == "compression" && size == 1:
+			compression = int(value[0])
+		case name == "dataWindow" && kind == "box2i" && size == 16:
+			for i := range window {
+				window[i] = int(int32(binary.LittleEndian.Uint32(value[4*i:])))
+			}
+			haveWindow = true
+		}
+	}
+	if channels == nil || compression < 0 || !haveWindow {
+		return raster{}, errors.New("OpenEXR header needs channels, compression and dataWindow")
+	}
+	lines := 1
+	switch compression {
+	case exrNone, exrRLE, exrZIPS:
+	case exrZIP:
+		lines = 16
+	default:
+		return raster{}, errors.New("Unsupported OpenEXR compression: only none, RLE and ZIP can be read")
+	}
+	width, height := window[2]-window[0]+1, window[3]-window[1]+1
+	if width < 1 || height < 1 || width > 1<<16 || height > 1<<16 {
+		return raster{}, errors.New("Invalid OpenEXR data window")
+	}
+	r, g, b, a, y := -1, -1, -1, -1, -1
+	rowSize := 0
+	for i, ch := range channels {
+		switch ch.name {
+		case "R":
+			r = i
+		case "G":
+			g = i
+		case "B":
+			b = i
+		case "A":
+			a = i
+		case "Y":
+			y = i
+		}
+		rowSize += ch.size * width
+	}
+	if r < 0 || g < 0 || b < 0 {
+		if y < 0 {
+			return raster{}, errors.New("OpenEXR image has no R, G and B or Y channels")
+		}
+		r, g, b = y, y, y
+	}
+
+	tex := raster{width: width, height: height, pixels: make([]fColor, width*height)}
+	chunks := (height + lines - 1) / lines
+	if at+8*chunks > len(data) {
+		return raster{}, errors.New("Unexpected end of OpenEXR offsets")
+	}
+	sample := make([]float64, len(channels))
+	for chunk := 0; chunk < chunks; chunk++ {
+		offset := binary.LittleEndian.Uint64(data[at+8*chunk:])
+		if offset > uint64(len(data)-8) {
+			return raster{}, errors.New("Invalid OpenEXR chunk offset")
+		}
+		start := int(offset)
+		first := int(int32(binary.LittleEndian.Uint32(data[start:]))) - window[1]
+		size := int(binary.LittleEndian.Uint32(data[start+4:]))
+		if first < 0 || first >= height || first%lines != 0 || size < 0 || start+8+size > len(data) {
+			return raster{}, errors.New("Invalid OpenEXR chunk")
+		}
+		count := int(math.Min(float64(lines), float64(height-first)))
+		pixels, err := exrUnpack(data[start+8:start+8+size], compression, count*rowSize)
+		if err != nil {
+			return raster{}, err
+		}
+		for line := 0; line < count; line++ {
+			row := pixels[line*rowSize:]
+			for x := 0; x < width; x++ {
+				// Each channel's samples for the whole row come one after another
+				pos := 0
+				for i, ch := range channels {
+					sample[i] = exrSample(row[pos+x*ch.size:], ch.pixelType)
+					pos += ch.size * width
+				}
+				c := fColor{R: sample[r], G: sample[g], B: sample[b], A: 1}
+				if a >= 0 {
+					c.A = math.Max(0, math.Min(1, sample[a]))
+					c.T = 1 - c.A
+				}
+				tex.pixels[(first+line)*width+x] = c
+			}
+		}
+	}
+	return tex, nil
+}
+
+// exrString reads a null terminated string from data at at, moving at
+// past it
+func exrString(data []byte, at *int) (string, bool) {
+	end := bytes.IndexByte(data[*at:], 0)
+	if end < 0 {
+		return "", false
+	}
+	s := string(data[*at : *at+end])
+	*at += end + 1
+	return s, true
+}
+
+// exrChannels reads a channel list, which comes sorted by name, the order
+// the channels are stored in
+func exrChannels(value []byte) ([]exrChannel, error) {
+	var channels []exrChannel
+	at := 0
+	for {
+		name, ok := exrString(value, &at)
+		if !ok || (name != "" && at+16 > len(value)) {
+			return nil, errors.New("Invalid OpenEXR channel list")
+		}
+		if name == "" {
+			break
+		}
+		ch := exrChannel{name: name, pixelType: int(binary.LittleEndian.Uint32(value[at:]))}
+		xSampling := binary.LittleEndian.Uint32(value[at+8:])
+		ySampling := binary.LittleEndian.Uint32(value[at+12:])
+		at += 16
+		switch ch.pixelType {
+		case exrHalf:
+			ch.size = 2
+		case exrUint, exrFloat:
+			ch.size = 4
+		default:
+			return nil, errors.New("Invalid OpenEXR pixel type for channel '" + name + "'")
+		}
+		if xSampling != 1 || ySampling != 1 {
+			return nil, errors.New("Unsupported OpenEXR subsampled channel '" + name + "'")
+		}
+		channels = append(channels, ch)
+	}
+	if len(channels) == 0 {
+		return nil, errors.New("OpenEXR image has no channels")
+	}
+	sort.SliceStable(channels, func(i, j int) bool { return channels[i].name < channels[j].name })
+	return channels, nil
+}
+
+// exrUnpack gives the size bytes of pixels a chunk holds. Chunks that
+// wouldn't get smaller are stored as they are
+func exrUnpack(chunk []byte, compression, size int) ([]byte, error) {
+	if compression == exrNone || len(chunk) == size {
+		if len(chunk) != size {
+			return nil, errors.New("OpenEXR chunk has the wrong size")
+		}
+		return chunk, nil
+	}
+	var packed []byte
+	if compression == exrRLE {
+		for at := 0; at < len(chunk) && len(packed) <= size; {
+			run := int(int8(chunk[at]))
+			at++
+			if run < 0 {
+				if at-run > len(chunk) {
+					return nil, errors.New("Invalid OpenEXR run length")
+				}
+				packed = append(packed, chunk[at:at-run]...)
+				at -= run
+			} else {
+				if at >= len(chunk) {
+					return nil, errors.New("Invalid OpenEXR run length")
+				}
+				for i := 0; i <= run; i++ {
+					packed = append(packed, chunk[at])
+				}
+				at++
+			}
+		}
+	} else {
+		inflater, err := zlib.NewReader(bytes.NewReader(chunk))
+		if err != nil {
+			return nil, errors.New("Invalid OpenEXR ZIP data: " + err.Error())
+		}
+		// No more than a chunk too big, however much the data would inflate to
+		if packed, err = ioutil.ReadAll(io.LimitReader(inflater, int64(size)+1)); err != nil {
+			return nil, errors.New("Invalid OpenEXR ZIP data: " + err.Error())
+		}
+	}
+	if len(packed) != size {
+		return nil, errors.New("OpenEXR chunk has the wrong size")
+	}
+	// Bytes are stored as differences from the one before, with the first
+	// halves of the samples ahead of the second halves
+	for i := 1; i < len(packed); i++ {
+		packed[i] += packed[i-1] - 128
+	}
+	pixels := make([]byte, size)
+	half := (size + 1) / 2
+	for i := range pixels {
+		if i%2 == 0 {
+			pixels[i] = packed[i/2]
+		} else {
+			pixels[i] = packed[half+i/2]
+		}
+	}
+	return pixels, nil
+}
+
+// exrSample reads one little endian sample of type pixelType. Infinities,
+// and the NaNs that would spoil sampling the image, are read as the
+// largest half and 0
+func exrSample(b []byte, pixelType int) float64 {
+	var f float64
+	switch pixelType {
+	case exrHalf:
+		f = halfFloat(binary.LittleEndian.Uint16(b))
+	case exrFloat:
+		f = float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+	default:
+		return float64(binary.LittleEndian.Uint32(b))
+	}
+	switch {
+	case math.IsNaN(f):
+		return 0
+	case math.IsInf(f, 0):
+		return math.Copysign(65504, f)
+	}
+	return f
+}
+
+// halfFloat converts a 16 bit float
+func halfFloat(h uint16) float64 {
+	sign, exp, mantissa := 1.0, int(h>>10&0x1f), float64(h&0x3ff)
+	if h&0x8000 != 0 {
+		sign = -1
+	}
+	switch exp {
+	case 0:
+		return sign * math.Ldexp(mantissa, -24)
+	case 0x1f:
+		if mantissa != 0 {
+			return math.NaN()
+		}
+		return math.Inf(int(sign))
+	}
+	return sign * math.Ldexp(1024+mantissa, exp-25)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// encodeEXR writes a scanline OpenEXR image with the channels given by
+// name, each sample stored as pixelType, compressed as given. Lines are
+// read from each channel's values, which run row by row
+func encodeEXR(t *testing.T, width, height, pixelType, compression int, channels map[string][]float64) []byte {
+	var names []string
+	for name := range channels {
+		names = append(names, name)
+	}
+	// Stored in name order, but listed backwards for decodeEXR to sort
+	sort.Strings(names)
+	var header bytes.Buffer
+	le := func(v interface{}) { binary.Write(&header, binary.LittleEndian, v) }
+	header.Write(exrMagic)
+	le(uint32(2))
+	attribute := func(name, kind string, value []byte) {
+		header.WriteString(name + "\x00" + kind + "\x00")
+		le(uint32(len(value)))
+		header.Write(value)
+	}
+	var list bytes.Buffer
+	for i := len(names) - 1; i >= 0; i-- {
+		list.WriteString(names[i] + "\x00")
+		binary.Write(&list, binary.LittleEndian, []uint32{uint32(pixelType), 0, 1, 1})
+	}
+	list.WriteByte(0)
+	attribute("channels", "chlist", list.Bytes())
+	attribute("compression", "compression", []byte{byte(compression)})
+	window := make([]byte, 16)
+	for i, v := range []int32{3, 5, int32(3 + width - 1), int32(5 + height - 1)} {
+		binary.LittleEndian.PutUint32(window[4*i:], uint32(v))
+	}
+	attribute("dataWindow", "box2i", window)
+	attribute("displayWindow", "box2i", window)
+	attribute("lineOrder", "lineOrder", []byte{0})
+	header.WriteByte(0)
+
+	lines := 1
+	if compression == exrZIP {
+		lines = 16
+	}
+	var chunks [][]byte
+	for first := 0; first < height; first += lines {
+		var raw bytes.Buffer
+		for y := first; y < first+lines && y < height; y++ {
+			for _, name := range names {
+				for x := 0; x < width; x++ {
+					v := channels[name][y*width+x]
+					switch pixelType {
+					case exrHalf:
+						binary.Write(&raw, binary.LittleEndian, toHalf(v))
+					case exrFloat:
+						binary.Write(&raw, binary.LittleEndian, math.Float32bits(float32(v)))
+					default:
+						binary.Write(&raw, binary.LittleEndian, uint32(v))
+					}
+				}
+			}
+		}
+		data := raw.Bytes()
+		if compression != exrNone {
+			data = exrPack(t, data, compression)
+		}
+		var chunk bytes.Buffer
+		binary.Write(&chunk, binary.LittleEndian, []int32{int32(5 + first), int32(len(data))})
+		chunk.Write(data)
+		chunks = append(chunks, chunk.Bytes())
+	}
+	offset := header.Len() + 8*len(chunks)
+	for _, chunk := range chunks {
+		le(uint64(offset))
+		offset += len(chunk)
+	}
+	for _, chunk := range chunks {
+		header.Write(chunk)
+	}
+	return header.Bytes()
+}
+
+// exrPack splits the bytes into halves, stores their differences and
+// compresses them with RLE, as literal runs, or zlib
+func exrPack(t *testing.T, raw []byte, compression int) []byte {
+	half := (len(raw) + 1) / 2
+	packed := make([]byte, len(raw))
+	for i, b := range raw {
+		if i%2 == 0 {
+			packed[i/2] = b
+		} else {
+			packed[half+i/2] = b
+		}
+	}
+	for i := len(packed) - 1; i > 0; i-- {
+		packed[i] = packed[i] - packed[i-1] + 128
+	}
+	var out bytes.Buffer
+	if compression == exrRLE {
+		for len(packed) > 0 {
+			// A repeated byte, then what's left as literals
+			if len(packed) > 3 && packed[0] == packed[1] && packed[1] == packed[2] {
+				run := 1
+				for run < len(packed) && run < 128 && packed[run] == packed[0] {
+					run++
+				}
+				out.Write([]byte{byte(run - 1), packed[0]})
+				packed = packed[run:]
+				continue
+			}
+			n := int(math.Min(127, float64(len(packed))))
+			out.WriteByte(byte(-n))
+			out.Write(packed[:n])
+			packed = packed[n:]
+		}
+		return out.Bytes()
+	}
+	w := zlib.NewWriter(&out)
+	if _, err := w.Write(packed); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	return out.Bytes()
+}
+
+// toHalf rounds v to the nearest 16 bit float, for values that are normal
+// halfs or 0
+func toHalf(v float64) uint16 {
+	if v == 0 {
+		return 0
+	}
+	var sign uint16
+	if v < 0 {
+		sign, v = 0x8000, -v
+	}
+	frac, exp := math.Frexp(v)
+	mantissa := uint16(math.Round((frac*2-1)*1024)) & 0x3ff
+	return sign | uint16(exp-1+15)<<10 | mantissa
+}
+
+func TestHalfFloat(t *testing.T) {
+	for h, want := range map[uint16]float64{
+		0x0000: 0, 0x3c00: 1, 0xc000: -2, 0x3555: 0.333251953125, 0x7bff: 65504,
+		0x0001: math.Ldexp(1, -24), 0x0400: math.Ldexp(1, -14),
+	} {
+		if got := halfFloat(h); got != want {
+			t.Errorf("half %#04x is %v, want %v", h, got, want)
+		}
+	}
+	if got := exrSample([]byte{0x00, 0x7c}, exrHalf); got != 65504 {
+		t.Errorf("infinity read as %v", got)
+	}
+	if got := exrSample([]byte{0x01, 0x7c}, exrHalf); got != 0 {
+		t.Errorf("NaN read as %v", got)
+	}
+}
+
+func TestDecodeEXR(t *testing.T) {
+	const width, height = 5, 19
+	channels := map[string][]float64{}
+	for _, name := range []string{"R", "G", "B", "A"} {
+		for i := 0; i < width*height; i++ {
+			// Brighter than white, and with runs for RLE to find
+			v := float64((i/3*7+len(name)*int(name[0]))%40) / 8
+			if name == "A" {
+				v = float64(i%3) / 2
+			}
+			channels[name] = append(channels[name], v)
+		}
+	}
+	for _, test := range []struct {
+		name                   string
+		pixelType, compression int
+	}{
+		{"half", exrHalf, exrNone},
+		{"float", exrFloat, exrNone},
+		{"uint", exrUint, exrNone},
+		{"RLE", exrHalf, exrRLE},
+		{"ZIPS", exrHalf, exrZIPS},
+		{"ZIP", exrFloat, exrZIP},
+	} {
+		data := encodeEXR(t, width, height, test.pixelType, test.compression, channels)
+		tex, err := decodeEXR(data)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if tex.width != width || tex.height != height {
+			t.Errorf("%s: %d x %d, want %d x %d", test.name, tex.width, tex.height, width, height)
+			continue
+		}
+		for i, c := range tex.pixels {
+			want := fColor{R: channels["R"][i], G: channels["G"][i], B: channels["B"][i],
+				A: channels["A"][i], T: 1 - channels["A"][i]}
+			if test.pixelType == exrUint {
+				want.R, want.G, want.B = math.Floor(want.R), math.Floor(want.G), math.Floor(want.B)
+				want.A = math.Min(1, math.Floor(channels["A"][i]))
+				want.T = 1 - want.A
+			}
+			if c != want {
+				t.Fatalf("%s: pixel %d is %v, want %v", test.name, i, c, want)
+			}
+		}
+	}
+
+	grey := encodeEXR(t, 2, 1, exrHalf, exrNone, map[string][]float64{"Y": {0.5, 4}})
+	if tex, err := decodeEXR(grey); err != nil || tex.pixels[1] != (fColor{R: 4, G: 4, B: 4, A: 1}) {
+		t.Errorf("grey image read as %v, %v", tex.pixels, err)
+	}
+	// Image maps find EXR files by their contents
+	path := filepath.Join(t.TempDir(), "grey.exr")
+	if err := os.WriteFile(path, grey, 0644); err != nil {
+		t.Fatal(err)
+	}
+	scanner := newPOVScanner(strings.NewReader(`{ exr "`+path+`" }`), "test.pov")
+	defer scanner.Close()
+	if im, err := parseImageMap(scanner, nil); err != nil || im.levels[0].pixels[0].R != 0.5 {
+		t.Errorf("image map of an EXR file: %v", err)
+	}
+	for name, bad := range map[string][]byte{
+		"truncated":      grey[:len(grey)-3],
+		"tiled":          append(append([]byte{}, exrMagic...), 2, 2, 0, 0),
+		"no colors":      encodeEXR(t, 2, 1, exrHalf, exrNone, map[string][]float64{"Z": {0.5, 4}}),
+		"PIZ":            bytes.Replace(grey, []byte("compression\x00compression\x00\x01\x00\x00\x00\x00"), []byte("compression\x00compression\x00\x01\x00\x00\x00\x04"), 1),
+		"missing header": grey[:8],
+	} {
+		if _, err := decodeEXR(bad); err == nil || !strings.Contains(err.Error(), "OpenEXR") {
+			t.Errorf("%s: error %v", name, err)
+		}
+	}
+}
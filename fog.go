@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+)
+
+// Fog types
+const (
+	constantFog = 1
+	groundFog   = 2
+)
+
+// fog hides what lies further along a ray behind its color. Constant fog
+// lets through exp(-d/distance) of the light from d away. Ground fog is
+// that thick below offset, measured along up, and thins above it as
+// 1/(1+h/alt)^2 at h above
+type fog struct {
+	fogType  int
+	distance float64
+	// color's filter and transmit are the least of what shows through
+	color       fColor
+	offset, alt float64
+	up          Vector3D
+	// turbulence thickens and thins the fog by up to its length, by noise
+	// at turbDepth of the way along the ray
+	turbulence    Vector3D
+	turbDepth     float64
+	octaves       int
+	omega, lambda float64
+}
+
+func makeFog() fog {
+	return fog{fogType: constantFog, color: fColor{A: 1}, alt: 1, up: yAxis, turbDepth: 0.5,
+		octaves: 6, omega: 0.5, lambda: 2}
+}
+
+// parseFog reads a fog block. Each one layers on those before
+func parseFog(scanner *povScanner) error {
+	if !scanner.Scan() || scanner.Text() != "{" {
+		return errors.New("Missing '{' token")
+	}
+	f := makeFog()
+	var err error
+	for scanner.Scan() {
+		switch token := scanner.Text(); token {
+		case "}":
+			if f.distance <= 0 {
+				return errors.New("Fog distance must be positive")
+			}
+			if f.fogType == groundFog && f.alt <= 0 {
+				return errors.New("Fog fog_alt must be positive")
+			}
+			if f.up.Length() == 0 {
+				return errors.New("Fog up must not be zero")
+			}
+			f.up = f.up.Normalize()
+			fogs = append(fogs, f)
+			return nil
+		case "fog_type":
+			var kind float64
+			if kind, err = parseFloat(scanner); err == nil {
+				if f.fogType = int(kind); f.fogType != constantFog && f.fogType != groundFog {
+					err = errors.New("Unsupported fog_type: " + strconv.Itoa(f.fogType))
+				}
+			}
+		case "distance":
+			f.distance, err = parseFloat(scanner)
+		case "fog_offset":
+			f.offset, err = parseFloat(scanner)
+		case "fog_alt":
+			f.alt, err = parseFloat(scanner)
+		case "up":
+			f.up, err = parseVector(scanner)
+		case "turbulence":
+			f.turbulence, err = parseVector(scanner)
+		case "turb_depth":
+			f.turbDepth, err = parseFloat(scanner)
+		case "octaves":
+			f.octaves, err = parseCount(scanner, token)
+		case "omega":
+			f.omega, err = parseFloat(scanner)
+		case "lambda":
+			f.lambda, err = parseFloat(scanner)
+		default:
+			// color rgb <...>, or an identifier holding a color
+			scanner.Unscan()
+			f.color, err = parseColor(scanner)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return eofErr
+}
+
+// clear is the share of light that gets through the fog along ray for
+// dist, which is infinite for rays that miss everything
+func (f *fog) clear(ray Ray, dist float64) float64 {
+	dir := ray.Direction.Normalize()
+	dist *= ray.Direction.Length()
+	depth := dist
+	if f.fogType == groundFog {
+		depth = f.groundDepth(ray.Origin, dir, dist)
+	}
+	if f.turbulence != (Vector3D{}) && !math.IsInf(dist, 1) {
+		at := ray.Origin.Translate(dir.Scale(dist * f.turbDepth))
+		warp := turbulence(at, f.octaves, f.omega, f.lambda)
+		depth *= math.Max(0, 1+warp.X*f.turbulence.Length())
+	}
+	through := 0.0
+	if !math.IsInf(depth, 1) {
+		through = math.Exp(-depth / f.distance)
+	}
+	// The fog color's own transparency always shows through
+	return math.Max(through, 1-f.color.A)
+}
+
+// groundDepth is how much fog lies between from and dist along dir, as
+// the distance through fog as thick as it is below the offset
+func (f *fog) groundDepth(from Point3D, dir Vector3D, dist float64) float64 {
+	// height integrates the fog's thickness from the offset up to h, or
+	// down to h, where it's full
+	height := func(h float64) float64 {
+		if h <= f.offset {
+			return h - f.offset
+		}
+		return f.alt * (1 - 1/(1+(h-f.offset)/f.alt))
+	}
+	h1, rise := from.AsVector().Dot(f.up), dir.Dot(f.up)
+	if math.Abs(rise) < 1e-9 {
+		// Level rays stay in fog of one thickness
+		if h1 <= f.offset {
+			return dist
+		}
+		u := 1 + (h1-f.offset)/f.alt
+		return dist / (u * u)
+	}
+	if math.IsInf(dist, 1) {
+		if rise < 0 {
+			return dist
+		}
+		return (f.alt - height(h1)) / rise
+	}
+	return (height(h1+rise*dist) - height(h1)) / rise
+}
+
+// fogAlong is the share of light from dist along ray that gets through
+// every fog, and the color the fogs lay over it
+func fogAlong(fogs []fog, ray Ray, dist float64) (through float64, glow fColor) {
+	through, glow = 1, fColor{A: 1}
+	for i := range fogs {
+		f := &fogs[i]
+		clear := f.clear(ray, dist)
+		through *= clear
+		glow.R = glow.R*clear + f.color.R*(1-clear)
+		glow.G = glow.G*clear + f.color.G*(1-clear)
+		glow.B = glow.B*clear + f.color.B*(1-clear)
+	}
+	return through, glow
+}
+
+// fogged hides c, seen at dist along ray, behind the fogs
+func fogged(fogs []fog, ray Ray, dist float64, c fColor) fColor {
+	if len(fogs) == 0 {
+		return c
+	}
+	through, glow := fogAlong(fogs, ray, dist)
+	return fColor{R: c.R*through + glow.R, G: c.G*through + glow.G, B: c.B*through + glow.B,
+		A: c.A*through + 1 - through, T: c.T * through}
+}
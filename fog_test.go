@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// thickness is the ground fog's density at h along up, relative to that
+// below the offset
+func thickness(f *fog, h float64) float64 {
+	if h <= f.offset {
+		return 1
+	}
+	u := 1 + (h-f.offset)/f.alt
+	return 1 / (u * u)
+}
+
+func TestGroundDepth(t *testing.T) {
+	f := makeFog()
+	f.fogType, f.offset, f.alt, f.up = groundFog, 1, 0.5, Vector3D{0, 0.6, 0.8}
+	tests := []struct {
+		name string
+		from Point3D
+		dir  Vector3D
+		dist float64
+	}{
+		{"rising from below", Point3D{0, -1, 0}, Vector3D{1, 2, 1}, 4},
+		{"rising above", Point3D{0, 2, 1}, Vector3D{0, 1, 0}, 3},
+		{"falling into it", Point3D{0, 3, 2}, Vector3D{1, -1, -1}, 6},
+		{"falling below", Point3D{0, 0, 0}, Vector3D{0, -1, 0}, 2},
+		{"level below", Point3D{0, 0, 0}, Vector3D{0, 0.8, -0.6}, 5},
+		{"level above", Point3D{0, 2, 2}, Vector3D{0, 0.8, -0.6}, 5},
+	}
+	for _, test := range tests {
+		dir := test.dir.Normalize()
+		// Midpoint rule along the ray
+		const n = 100000
+		step, want := test.dist/n, 0.0
+		for i := 0; i < n; i++ {
+			at := test.from.Translate(dir.Scale((float64(i) + 0.5) * step))
+			want += thickness(&f, at.AsVector().Dot(f.up)) * step
+		}
+		if got := f.groundDepth(test.from, dir, test.dist); math.Abs(got-want) > 1e-6*test.dist {
+			t.Errorf("%s: depth %v, want %v", test.name, got, want)
+		}
+	}
+}
+
+// Rays that miss everything go through all the fog above them, or
+// endless fog below
+func TestGroundDepthEndless(t *testing.T) {
+	f := makeFog()
+	f.fogType, f.offset, f.alt = groundFog, 1, 0.5
+	up := Vector3D{1, 2, 0}.Normalize()
+	for _, from := range []Point3D{{0, 0, 0}, {0, 3, 0}} {
+		far := f.groundDepth(from, up, 1e9)
+		if got := f.groundDepth(from, up, math.Inf(1)); math.Abs(got-far) > 1e-6 {
+			t.Errorf("up from %v: depth %v, want %v", from, got, far)
+		}
+	}
+	if got := f.groundDepth(Point3D{0, 3, 0}, up.Scale(-1), math.Inf(1)); !math.IsInf(got, 1) {
+		t.Errorf("endless ray down: depth %v", got)
+	}
+}
+
+func TestFogClear(t *testing.T) {
+	f := makeFog()
+	f.distance, f.color = 2, fColor{R: 1, G: 1, B: 1, A: 1}
+	// Ray directions needn't be unit length
+	ray := Ray{Origin: Point3D{}, Direction: Vector3D{0, 0, 3}}
+	if got, want := f.clear(ray, 1), math.Exp(-1.5); math.Abs(got-want) > 1e-9 {
+		t.Errorf("constant fog lets through %v, want %v", got, want)
+	}
+	if got := f.clear(ray, math.Inf(1)); got != 0 {
+		t.Errorf("constant fog lets through %v of the background", got)
+	}
+	// The fog color's filter and transmit always show through
+	f.color = fColor{R: 1, G: 1, B: 1, A: 0.7, T: 0.3}
+	if got := f.clear(ray, math.Inf(1)); math.Abs(got-0.3) > 1e-9 {
+		t.Errorf("transparent fog lets through %v of the background, want 0.3", got)
+	}
+}
@@ -14,6 +14,18 @@ var (
 type Ray struct {
 	Origin    Point3D
 	Direction Vector3D
+	// Time is when the ray is cast, for motion blur
+	Time float64
+	// Wavelength in nm once dispersion has split the light, or 0 for
+	// white light
+	Wavelength float64
+	// Width is how wide the pixel's beam is at Origin and Spread how much
+	// wider it gets per unit along the ray, for picking a texture's detail
+	Width, Spread float64
+	// UV is where the ray hit a mesh face with uv vectors, if HasUV, for
+	// uv mapped pigments
+	UV    Point3D
+	HasUV bool
 }
 
 type Point3D struct {
@@ -36,8 +48,9 @@ func (pt Point3D) Transform(m mgl64.Mat4) (ret Point3D) {
 	return
 }
 
+// Transform applies m to a direction, so translation has no effect
 func (vec Vector3D) Transform(m mgl64.Mat4) (ret Vector3D) {
-	vecRow := [4]float64{vec.X, vec.Y, vec.Z, 1}
+	vecRow := [4]float64{vec.X, vec.Y, vec.Z, 0}
 	ret.X = dot([4]float64{m[0*4+0], m[1*4+0], m[2*4+0], m[3*4+0]}, vecRow)
 	ret.Y = dot([4]float64{m[0*4+1], m[1*4+1], m[2*4+1], m[3*4+1]}, vecRow)
 	ret.Z = dot([4]float64{m[0*4+2], m[1*4+2], m[2*4+2], m[3*4+2]}, vecRow)
@@ -53,6 +66,18 @@ func (r Ray) PointAt(t float64) Point3D {
 	return r.Origin.Translate(r.Direction.Scale(t))
 }
 
+// spawn is the ray leaving pt along dir after r hits there, cast at the
+// same time and wavelength with r's beam carried on
+func (r Ray) spawn(pt Point3D, dir Vector3D) Ray {
+	return Ray{Origin: pt, Direction: dir, Time: r.Time, Wavelength: r.Wavelength,
+		Width: r.footprint(pt), Spread: r.Spread}
+}
+
+// footprint is how wide r's beam is where it reaches pt
+func (r Ray) footprint(pt Point3D) float64 {
+	return r.Width + r.Spread*pt.Dist(r.Origin)
+}
+
 func (pt Point3D) Add(pt2 Point3D) Vector3D {
 	return Vector3D{X: pt.X + pt2.X, Y: pt.Y + pt2.Y, Z: pt.Z + pt2.Z}
 }
@@ -81,6 +106,12 @@ func (vec Vector3D) Dot(vec2 Vector3D) float64 {
 	return vec.X*vec2.X + vec.Y*vec2.Y + vec.Z*vec2.Z
 }
 
+func (vec Vector3D) Cross(vec2 Vector3D) Vector3D {
+	return Vector3D{X: vec.Y*vec2.Z - vec.Z*vec2.Y,
+		Y: vec.Z*vec2.X - vec.X*vec2.Z,
+		Z: vec.X*vec2.Y - vec.Y*vec2.X}
+}
+
 func (vec Vector3D) Scale(multiplier float64) Vector3D {
 	return Vector3D{X: vec.X * multiplier, Y: vec.Y * multiplier, Z: vec.Z * multiplier}
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// decodeHDR reads a Radiance RGBE image, whose pixels can be brighter
+// than white. Only the usual top to bottom, left to right orientation is
+// supported
+func decodeHDR(data []byte) (raster, error) {
+	reader := bufio.NewReader(bytes.NewReader(data))
+	line, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "#?") {
+		return raster{}, errors.New("Missing Radiance header")
+	}
+	// Variables such as FORMAT and EXPOSURE run until a blank line
+	for {
+		if line, err = reader.ReadString('\n'); err != nil {
+			return raster{}, errors.New("Unexpected end of Radiance header")
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "FORMAT=") && line != "FORMAT=32-bit_rle_rgbe" {
+			return raster{}, errors.New("Unsupported Radiance format: '" + line[7:] + "'")
+		}
+	}
+	if line, err = reader.ReadString('\n'); err != nil {
+		return raster{}, errors.New("Missing Radiance resolution")
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 4 || fields[0] != "-Y" || fields[2] != "+X" {
+		return raster{}, errors.New("Unsupported Radiance orientation: '" + strings.TrimSpace(line) + "'")
+	}
+	height, err1 := strconv.Atoi(fields[1])
+	width, err2 := strconv.Atoi(fields[3])
+	if err1 != nil || err2 != nil || width < 1 || height < 1 {
+		return raster{}, errors.New("Invalid Radiance resolution")
+	}
+
+	tex := raster{width: width, height: height, pixels: make([]fColor, 0, width*height)}
+	scanline := make([]byte, 4*width)
+	for y := 0; y < height; y++ {
+		if err = readScanline(reader, scanline, width); err != nil {
+			return raster{}, err
+		}
+		for x := 0; x < width; x++ {
+			rgbe := scanline[4*x : 4*x+4]
+			c := fColor{A: 1}
+			if rgbe[3] != 0 {
+				f := math.Ldexp(1, int(rgbe[3])-(128+8))
+				c.R, c.G, c.B = float64(rgbe[0])*f, float64(rgbe[1])*f, float64(rgbe[2])*f
+			}
+			tex.pixels = append(tex.pixels, c)
+		}
+	}
+	return tex, nil
+}
+
+// readScanline reads one row of RGBE pixels into scanline, either run
+// length encoded channel by channel or stored flat
+func readScanline(reader *bufio.Reader, scanline []byte, width int) error {
+	head, err := reader.Peek(4)
+	if err != nil {
+		return errors.New("Unexpected end of Radiance data")
+	}
+	if width < 8 || width > 0x7fff || head[0] != 2 || head[1] != 2 || head[2]&0x80 != 0 {
+		if _, err = io.ReadFull(reader, scanline); err != nil {
+			return errors.New("Unexpected end of Radiance data")
+		}
+		return nil
+	}
+	if int(head[2])<<8|int(head[3]) != width {
+		return errors.New("Radiance scanline has the wrong width")
+	}
+	reader.Discard(4)
+	for channel := 0; channel < 4; channel++ {
+		for x := 0; x < width; {
+			count, err := reader.ReadByte()
+			if err != nil {
+				return errors.New("Unexpected end of Radiance data")
+			}
+			run := int(count)
+			repeat := run > 128
+			if repeat {
+				run -= 128
+			}
+			if run == 0 || x+run > width {
+				return errors.New("Invalid Radiance run length")
+			}
+			value, err := reader.ReadByte()
+			for i := 0; i < run && err == nil; i++ {
+				scanline[4*(x+i)+channel] = value
+				if !repeat && i+1 < run {
+					value, err = reader.ReadByte()
+				}
+			}
+			if err != nil {
+				return errors.New("Unexpected end of Radiance data")
+			}
+			x += run
+		}
+	}
+	return nil
+}
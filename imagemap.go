@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// Projections an image map can wrap around the pigment's space with
+const (
+	planarMap      = 0
+	sphericalMap   = 1
+	cylindricalMap = 2
+	torusMap       = 5
+)
+
+// imageMap wraps an image around the pigment's space. Planar maps cover
+// the unit square in x and y, the others go once around the y axis, with
+// the torus map fitting a torus of major radius 1
+type imageMap struct {
+	// levels holds the image at full size and then, when mip-mapped, each
+	// level at half the size of the one before
+	levels  []raster
+	mapType int
+	// interpolate 0 takes the nearest pixel, otherwise pixels are blended
+	// bilinearly
+	interpolate int
+	// once leaves the pigment clear outside the image instead of repeating
+	once bool
+	// filter and transmit are added to every pixel
+	filter, transmit float64
+	// bumpSize is how high white stands above black when used as a
+	// bump_map, per pixel across
+	bumpSize float64
+}
+
+// raster is one level of an image's pixels, from the top row down
+type raster struct {
+	width, height int
+	pixels        []fColor
+	// indices are the palette indices of the pixels of paletted images
+	indices []int
+}
+
+// images caches the files image maps have loaded, each with its mip levels
+var images = struct {
+	sync.Mutex
+	byPath map[string][]raster
+}{byPath: map[string][]raster{}}
+
+// parseImageMap reads an image map block. other, if given, is offered
+// the tokens an image map doesn't know, and returns true for those it has
+// read
+func parseImageMap(scanner *povScanner, other func(token string) (bool, error)) (*imageMap, error) {
+	if !scanner.Scan() || scanner.Text() != "{" {
+		return nil, errors.New("Missing '{' token")
+	}
+	im := &imageMap{bumpSize: 1}
+	var name string
+	mipmap := false
+	var err error
+	for scanner.Scan() {
+		switch token := scanner.Text(); token {
+		case "}":
+			if name == "" {
+				return nil, errors.New("Image map needs a file name")
+			}
+			if im.levels, err = loadImage(name, filepath.Dir(scanner.path())); err != nil {
+				return nil, err
+			}
+			if !mipmap {
+				im.levels = im.levels[:1]
+			}
+			return im, nil
+		case "png", "jpeg", "gif", "hdr", "exr":
+			// The decoder is picked from the file's contents
+		case "tga", "iff", "ppm", "pgm", "sys", "tiff", "bmp":
+			return nil, errors.New("Unsupported image type: '" + token + "'")
+		case "map_type":
+			var f float64
+			if f, err = parseFloat(scanner); err != nil {
+				return nil, err
+			}
+			switch im.mapType = int(f); im.mapType {
+			case planarMap, sphericalMap, cylindricalMap, torusMap:
+			default:
+				return nil, errors.New("Unsupported map_type: " + strconv.Itoa(im.mapType))
+			}
+		case "interpolate":
+			var f float64
+			f, err = parseFloat(scanner)
+			im.interpolate = int(f)
+		case "once":
+			im.once = true
+		case "mipmap":
+			mipmap = true
+		case "bump_size":
+			im.bumpSize, err = parseFloat(scanner)
+		case "filter", "transmit":
+			if !scanner.Scan() || scanner.Text() != "all" {
+				return nil, errors.New("Expected 'all' after " + token)
+			}
+			amount := &im.filter
+			if token == "transmit" {
+				amount = &im.transmit
+			}
+			*amount, err = parseFloat(scanner)
+		default:
+			if other != nil {
+				var handled bool
+				if handled, err = other(token); handled {
+					break
+				}
+			}
+			if len(token) < 2 || token[0] != '"' || token[len(token)-1] != '"' {
+				return nil, errors.New("Unexpected token in image map: '" + token + "'")
+			}
+			name = token[1 : len(token)-1]
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, eofErr
+}
+
+// loadImage reads the image file name, looked for like an include file,
+// into a full chain of mip levels
+func loadImage(name, dir string) ([]raster, error) {
+	path, err := findInclude(name, dir)
+	if err != nil {
+		return nil, errors.New("Cannot find image file: '" + name + "'")
+	}
+	images.Lock()
+	defer images.Unlock()
+	if levels, ok := images.byPath[path]; ok {
+		return levels, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var full raster
+	if bytes.HasPrefix(data, []byte("#?")) {
+		full, err = decodeHDR(data)
+	} else if bytes.HasPrefix(data, exrMagic) {
+		full, err = decodeEXR(data)
+	} else {
+		var img image.Image
+		if img, _, err = image.Decode(bytes.NewReader(data)); err == nil {
+			full = makeRaster(img)
+		}
+	}
+	if err != nil {
+		return nil, errors.New("Cannot read image file '" + name + "': " + err.Error())
+	}
+	levels := []raster{full}
+	for top := levels[0]; top.width > 1 || top.height > 1; top = levels[len(levels)-1] {
+		levels = append(levels, top.half())
+	}
+	images.byPath[path] = levels
+	return levels, nil
+}
+
+// makeRaster converts img's pixels, treating alpha as transmit
+func makeRaster(img image.Image) raster {
+	bounds := img.Bounds()
+	tex := raster{width: bounds.Dx(), height: bounds.Dy()}
+	tex.pixels = make([]fColor, 0, tex.width*tex.height)
+	paletted, _ := img.(*image.Paletted)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if paletted != nil {
+				tex.indices = append(tex.indices, int(paletted.ColorIndexAt(x, y)))
+			}
+			c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			alpha := float64(c.A) / 0xffff
+			tex.pixels = append(tex.pixels, fColor{R: float64(c.R) / 0xffff,
+				G: float64(c.G) / 0xffff, B: float64(c.B) / 0xffff, A: alpha, T: 1 - alpha})
+		}
+	}
+	return tex
+}
+
+// half averages each two by two block of pixels into one, repeating the
+// last row or column of odd sized images
+func (tex raster) half() raster {
+	next := raster{width: (tex.width + 1) / 2, height: (tex.height + 1) / 2}
+	next.pixels = make([]fColor, next.width*next.height)
+	for y := 0; y < next.height; y++ {
+		for x := 0; x < next.width; x++ {
+			top := mixColor(0.5, tex.pixel(2*x, 2*y, true), tex.pixel(2*x+1, 2*y, true))
+			bottom := mixColor(0.5, tex.pixel(2*x, 2*y+1, true), tex.pixel(2*x+1, 2*y+1, true))
+			next.pixels[y*next.width+x] = mixColor(0.5, top, bottom)
+		}
+	}
+	return next
+}
+
+// at is the image's color at p, in the pigment's space, for a beam that's
+// footprint wide there
+func (im *imageMap) at(p Point3D, footprint float64) fColor {
+	u, v, rate := im.project(p)
+	if im.once && (u < 0 || u >= 1 || v < 0 || v >= 1) {
+		return fColor{T: 1}
+	}
+	u, v = frac(u), frac(v)
+	var c fColor
+	if len(im.levels) == 1 {
+		c = im.sample(im.levels[0], u, v)
+	} else {
+		// Pick the levels whose pixels are about as wide as the beam
+		full := im.levels[0]
+		lod := math.Log2(footprint * rate * math.Max(float64(full.width), float64(full.height)))
+		lod = math.Max(0, math.Min(float64(len(im.levels)-1), lod))
+		lo := int(lod)
+		c = im.sample(im.levels[lo], u, v)
+		if f := lod - float64(lo); f > 0 && lo+1 < len(im.levels) {
+			c = mixColor(f, c, im.sample(im.levels[lo+1], u, v))
+		}
+	}
+	c.T = math.Min(1, c.T+im.transmit)
+	c.A = math.Max(0, c.A-im.filter-im.transmit)
+	return c
+}
+
+// index is the color index of the pixel nearest p, for picking between n
+// materials. Images without a palette are indexed by brightness, black
+// picking the first and white the last. Outside an image used once, it's
+// the first
+func (im *imageMap) index(p Point3D, n int) int {
+	u, v, _ := im.project(p)
+	if im.once && (u < 0 || u >= 1 || v < 0 || v >= 1) {
+		return 0
+	}
+	tex := im.levels[0]
+	x, y := int(frac(u)*float64(tex.width)), int((1-frac(v))*float64(tex.height))
+	if tex.indices != nil {
+		x, y = clampIndex(x, tex.width), clampIndex(y, tex.height)
+		return tex.indices[y*tex.width+x] % n
+	}
+	c := tex.pixel(x, y, true)
+	return clampIndex(int((0.299*c.R+0.587*c.G+0.114*c.B)*float64(n-1)+0.5), n)
+}
+
+// project is where p lands on the image, with v running bottom to top,
+// and about how far across the image a unit step near p moves
+func (im *imageMap) project(p Point3D) (u, v, rate float64) {
+	// Around the y axis, starting and ending behind it
+	around := 0.5 + math.Atan2(p.X, -p.Z)/(2*math.Pi)
+	radius := math.Hypot(p.X, p.Z)
+	switch im.mapType {
+	case sphericalMap:
+		dist := math.Max(exprEpsilon, p.AsVector().Length())
+		return around, 0.5 + math.Asin(math.Max(-1, math.Min(1, p.Y/dist)))/math.Pi, 1 / (math.Pi * dist)
+	case cylindricalMap:
+		return around, p.Y, math.Max(1, 1/(2*math.Pi*math.Max(exprEpsilon, radius)))
+	case torusMap:
+		minor := math.Max(exprEpsilon, math.Hypot(radius-1, p.Y))
+		return around, 0.5 + math.Atan2(p.Y, radius-1)/(2*math.Pi), 1 / (2 * math.Pi * minor)
+	}
+	return p.X, p.Y, 1
+}
+
+// sample reads tex at (u, v), each from 0 to 1, blending the four nearest
+// pixels when interpolating
+func (im *imageMap) sample(tex raster, u, v float64) fColor {
+	x, y := u*float64(tex.width), (1-v)*float64(tex.height)
+	if im.interpolate == 0 {
+		return tex.pixel(int(x), int(y), im.once)
+	}
+	x, y = x-0.5, y-0.5
+	x0, y0 := math.Floor(x), math.Floor(y)
+	fx, fy := x-x0, y-y0
+	ix, iy := int(x0), int(y0)
+	top := mixColor(fx, tex.pixel(ix, iy, im.once), tex.pixel(ix+1, iy, im.once))
+	bottom := mixColor(fx, tex.pixel(ix, iy+1, im.once), tex.pixel(ix+1, iy+1, im.once))
+	return mixColor(fy, top, bottom)
+}
+
+// pixel is the pixel at (x, y), wrapping around the edges or, for images
+// used once, holding the edge pixels
+func (tex raster) pixel(x, y int, once bool) fColor {
+	if once {
+		x, y = clampIndex(x, tex.width), clampIndex(y, tex.height)
+	} else {
+		x, y = (x%tex.width+tex.width)%tex.width, (y%tex.height+tex.height)%tex.height
+	}
+	return tex.pixels[y*tex.width+x]
+}
+
+func clampIndex(i, n int) int {
+	if i < 0 {
+		return 0
+	} else if i >= n {
+		return n - 1
+	}
+	return i
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"math"
+)
+
+// interior describes the material inside an object
+type interior struct {
+	ior float64
+	// dispersion is the ratio of the ior for violet light to that for
+	// red, split over dispersionSamples wavelengths. 1 doesn't disperse
+	dispersion        float64
+	dispersionSamples int
+	// Light crossing the interior fades towards fadeColor, to half by
+	// fadeDistance. A fadePower of 1000 or more gives exponential
+	// absorption, following Beer's law
+	fadeDistance, fadePower float64
+	fadeColor               fColor
+}
+
+// The visible spectrum split by dispersion, in nm
+const (
+	violetWavelength = 400.0
+	redWavelength    = 700.0
+)
+
+func makeInterior() interior {
+	return interior{ior: 1, dispersion: 1, dispersionSamples: 7,
+		fadeColor: fColor{A: 1}}
+}
+
+func (obj *object) parseInterior(scanner *povScanner) error {
+	if !scanner.Scan() || scanner.Text() != "{" {
+		return errors.New("Missing '{' token")
+	}
+
+	var err error
+	for scanner.Scan() {
+		token := scanner.Text()
+		switch token {
+		case "}":
+			return nil
+		case "interior":
+			// A #declare'd interior used as the starting point
+			err = obj.parseInterior(scanner)
+		case "ior":
+			obj.interior.ior, err = parseFloat(scanner)
+			if err == nil && obj.interior.ior <= 0 {
+				err = errors.New("ior must be positive")
+			}
+		case "dispersion":
+			obj.interior.dispersion, err = parseFloat(scanner)
+			if err == nil && obj.interior.dispersion <= 0 {
+				err = errors.New("dispersion must be positive")
+			}
+		case "dispersion_samples":
+			obj.interior.dispersionSamples, err = parseCount(scanner, token)
+			if err == nil && obj.interior.dispersionSamples < 2 {
+				err = errors.New("dispersion_samples must be at least 2")
+			}
+		case "fade_distance":
+			obj.interior.fadeDistance, err = parseFloat(scanner)
+		case "fade_power":
+			obj.interior.fadePower, err = parseFloat(scanner)
+		case "fade_color", "fade_colour":
+			obj.interior.fadeColor, err = parseColor(scanner)
+		default:
+			return errors.New("Unexpected token: '" + token + "'")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return eofErr
+}
+
+// fresnel is the share of light reflected where a ray crosses from a
+// medium of ior n1 into one of n2, cosI being the cosine of its angle to
+// the normal. It's 1 under total internal reflection
+func fresnel(cosI, n1, n2 float64) float64 {
+	sinT2 := (n1 / n2) * (n1 / n2) * (1 - cosI*cosI)
+	if sinT2 >= 1 {
+		return 1
+	}
+	cosT := math.Sqrt(1 - sinT2)
+	rs := (n1*cosI - n2*cosT) / (n1*cosI + n2*cosT)
+	rp := (n2*cosI - n1*cosT) / (n2*cosI + n1*cosT)
+	return (rs*rs + rp*rp) / 2
+}
+
+// iorAt is the ior for light of the given wavelength, spread either side
+// of the plain ior by dispersion
+func (in interior) iorAt(wavelength float64) float64 {
+	if wavelength == 0 || !in.disperses() {
+		return in.ior
+	}
+	t := (redWavelength-wavelength)/(redWavelength-violetWavelength) - 0.5
+	return in.ior * math.Pow(in.dispersion, t)
+}
+
+func (in interior) disperses() bool {
+	return in.dispersion != 1
+}
+
+// fade is the share of light, per channel, left after crossing dist of
+// the interior
+func (in interior) fade(dist float64) fColor {
+	if in.fadeDistance <= 0 || in.fadePower <= 0 {
+		return white
+	}
+	var att [3]float64
+	fadeColor := [3]float64{in.fadeColor.R, in.fadeColor.G, in.fadeColor.B}
+	for i, c := range fadeColor {
+		if in.fadePower >= 1000 {
+			att[i] = math.Exp(-(1 - c) * dist / in.fadeDistance)
+		} else {
+			att[i] = c + (1-c)/(1+math.Pow(dist/in.fadeDistance, in.fadePower))
+		}
+	}
+	return fColor{R: att[0], G: att[1], B: att[2], A: 1}
+}
+
+// disperse splits white light refracting at pt, where the surface faces
+// normal, over the spectrum, each wavelength bent by its own ior and
+// tinted by its color
+func (sc *scene) disperse(ray Ray, obj castable, pt Point3D, normal Vector3D, exiting bool,
+	depth int, skip castable) fColor {
+	in := obj.Interior()
+	wavelengths, tints := spectrum(in.dispersionSamples)
+	sum := fColor{}
+	for i, wavelength := range wavelengths {
+		band := ray
+		band.Wavelength = wavelength
+		n1, n2 := 1.0, in.iorAt(wavelength)
+		if exiting {
+			n1, n2 = n2, n1
+		}
+		if internal, refractRay := calcRefractRay(band, normal, pt, n1, n2); !internal {
+			_, color := sc.castRay(refractRay, depth, skip)
+			sum = sum.Add(color.Tint(tints[i]))
+		}
+	}
+	return sum
+}
+
+// spectrum picks n wavelengths from red to violet, and colors for them
+// that add up to white
+func spectrum(n int) (wavelengths []float64, tints []fColor) {
+	total := fColor{}
+	for i := 0; i < n; i++ {
+		wavelength := redWavelength - (redWavelength-violetWavelength)*float64(i)/float64(n-1)
+		tint := wavelengthColor(wavelength)
+		wavelengths, tints = append(wavelengths, wavelength), append(tints, tint)
+		total.R, total.G, total.B = total.R+tint.R, total.G+tint.G, total.B+tint.B
+	}
+	for i := range tints {
+		tints[i] = fColor{R: tints[i].R / total.R, G: tints[i].G / total.G,
+			B: tints[i].B / total.B, A: 1}
+	}
+	return
+}
+
+// wavelengthColor approximates the color of light of a wavelength in nm
+func wavelengthColor(wavelength float64) fColor {
+	switch {
+	case wavelength < 440:
+		return fColor{R: (440 - wavelength) / 60, B: 1, A: 1}
+	case wavelength < 490:
+		return fColor{G: (wavelength - 440) / 50, B: 1, A: 1}
+	case wavelength < 510:
+		return fColor{G: 1, B: (510 - wavelength) / 20, A: 1}
+	case wavelength < 580:
+		return fColor{R: (wavelength - 510) / 70, G: 1, A: 1}
+	case wavelength < 645:
+		return fColor{R: 1, G: (645 - wavelength) / 65, A: 1}
+	}
+	return fColor{R: 1, A: 1}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFresnel(t *testing.T) {
+	brewster := math.Atan(1.5)
+	tests := []struct {
+		name         string
+		cosI, n1, n2 float64
+		want         float64
+	}{
+		{"head on", 1, 1, 1.5, 0.04},
+		{"head on from inside", 1, 1.5, 1, 0.04},
+		{"same ior", 0.3, 1.33, 1.33, 0},
+		{"grazing", 0, 1, 1.5, 1},
+		{"past the critical angle", 0.5, 1.5, 1, 1},
+		// Only the s-polarized half is reflected at Brewster's angle
+		{"brewster", math.Cos(brewster), 1, 1.5, math.Pow(math.Cos(2*brewster), 2) / 2},
+	}
+	for _, test := range tests {
+		if got := fresnel(test.cosI, test.n1, test.n2); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%s: fresnel(%v, %v, %v) = %v, want %v", test.name, test.cosI, test.n1,
+				test.n2, got, test.want)
+		}
+	}
+}
+
+// Light crossing a surface either way is reflected alike
+func TestFresnelReciprocal(t *testing.T) {
+	n1, n2 := 1.0, 1.5
+	for cosI := 0.05; cosI <= 1; cosI += 0.05 {
+		sinT := n1 / n2 * math.Sqrt(1-cosI*cosI)
+		cosT := math.Sqrt(1 - sinT*sinT)
+		if a, b := fresnel(cosI, n1, n2), fresnel(cosT, n2, n1); math.Abs(a-b) > 1e-9 {
+			t.Errorf("cos %v: %v going in, %v coming out", cosI, a, b)
+		}
+	}
+}
+
+func TestFade(t *testing.T) {
+	in := makeInterior()
+	if got := in.fade(5); got != white {
+		t.Errorf("no fade set: %v, want white", got)
+	}
+	in.fadeDistance, in.fadeColor = 2, fColor{R: 1, G: 0.5, B: 0, A: 1}
+	tests := []struct {
+		power, dist float64
+		want        fColor
+	}{
+		{2, 0, white},
+		// Halfway to the fade color at fadeDistance
+		{2, 2, fColor{R: 1, G: 0.75, B: 0.5, A: 1}},
+		{1, 6, fColor{R: 1, G: 0.5 + 0.5/4, B: 0.25, A: 1}},
+		{1000, 2, fColor{R: 1, G: math.Exp(-0.5), B: math.Exp(-1), A: 1}},
+	}
+	for _, test := range tests {
+		in.fadePower = test.power
+		got := in.fade(test.dist)
+		if math.Abs(got.R-test.want.R) > 1e-9 || math.Abs(got.G-test.want.G) > 1e-9 ||
+			math.Abs(got.B-test.want.B) > 1e-9 {
+			t.Errorf("fade_power %v, %v through: %v, want %v", test.power, test.dist, got, test.want)
+		}
+	}
+}
+
+// Beer's law fades the same over a distance crossed in one go or in parts
+func TestFadeBeer(t *testing.T) {
+	in := makeInterior()
+	in.fadeDistance, in.fadePower, in.fadeColor = 1.5, 1000, fColor{R: 0.2, G: 0.6, B: 0.9, A: 1}
+	whole, parts := in.fade(3), in.fade(1).Tint(in.fade(2))
+	if math.Abs(whole.R-parts.R) > 1e-9 || math.Abs(whole.G-parts.G) > 1e-9 ||
+		math.Abs(whole.B-parts.B) > 1e-9 {
+		t.Errorf("fade(3) = %v, fade(1) * fade(2) = %v", whole, parts)
+	}
+}
+
+// Light past the critical angle is only reflected with fresnel on. Scenes
+// without it lose it, as they always have
+func TestSplitInternal(t *testing.T) {
+	tests := []struct {
+		name, finish     string
+		from             Point3D
+		reflect, refract float64
+	}{
+		{"head on", "reflection 0.2 refraction 0.8", Point3D{0, 0, 0}, 0.2, 0.8},
+		{"internal", "reflection 0.2 refraction 0.8", Point3D{0.9, 0, 0}, 0.2, 0},
+		{"internal with fresnel", "reflection { 0, 1 fresnel } refraction 1", Point3D{0.9, 0, 0}, 1, 0},
+	}
+	for _, test := range tests {
+		sc := loadTestScene(t, "sphere { <0, 0, 0>, 1 finish { "+test.finish+" } interior { ior 1.5 } }")
+		obj := sc.objects[0]
+		ray := Ray{Origin: test.from, Direction: zAxis}
+		_, dist, _ := sc.hitAnything(ray, nil)
+		pt := ray.PointAt(dist)
+		reflect, refract, _, exiting := split(ray, obj, pt, obj.Normal(pt, 0))
+		if !exiting || math.Abs(reflect-test.reflect) > 1e-9 || math.Abs(refract-test.refract) > 1e-9 {
+			t.Errorf("%s: reflects %v and refracts %v leaving the sphere, want %v and %v",
+				test.name, reflect, refract, test.reflect, test.refract)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+)
+
+// Light kinds, which differ in how their light spreads
+const (
+	pointLight    = "point"
+	spotLight     = "spotlight"
+	cylinderLight = "cylinder"
+)
+
+// areaLight spreads a light over a grid of samples across two axes,
+// centered on its location
+type areaLight struct {
+	axis1, axis2 Vector3D
+	size1, size2 int
+	// jitter moves each sample randomly within its cell
+	jitter bool
+	// adaptive is the number of times the grid is halved before sampling
+	// starts, or -1 to sample every point
+	adaptive int
+}
+
+// maxAdaptive caps adaptive, as 2^16 cells to a side already splits any
+// grid into single steps
+const maxAdaptive = 16
+
+// areaSampler tests the grid of an area light from one point, caching
+// each sample so cells sharing a corner don't test it twice
+type areaSampler struct {
+	sc      *scene
+	l       *light
+	pt      Point3D
+	time    float64
+	exclude castable
+	tested  []bool
+	lit     []fColor
+}
+
+func parseAreaLight(scanner *povScanner) (*areaLight, error) {
+	area := &areaLight{adaptive: -1}
+	var err error
+	if area.axis1, err = parseVector(scanner); err != nil {
+		return nil, err
+	}
+	if area.axis2, err = parseVector(scanner); err != nil {
+		return nil, err
+	}
+	if area.size1, err = parseCount(scanner, "area_light"); err != nil {
+		return nil, err
+	}
+	if area.size2, err = parseCount(scanner, "area_light"); err != nil {
+		return nil, err
+	}
+	return area, nil
+}
+
+// parseOption handles a light modifier, returning false if the current
+// token isn't one
+func (l *light) parseOption(scanner *povScanner) (bool, error) {
+	var err error
+	switch scanner.Text() {
+	case "spotlight":
+		l.kind, l.radius, l.falloff = spotLight, 30, 45
+	case "cylinder":
+		l.kind, l.radius, l.falloff = cylinderLight, 0.75, 1
+	case "parallel":
+		l.parallel = true
+	case "point_at":
+		l.pointAt, err = parsePoint(scanner)
+	case "radius":
+		l.radius, err = parseFloat(scanner)
+	case "falloff":
+		l.falloff, err = parseFloat(scanner)
+	case "tightness":
+		l.tightness, err = parseFloat(scanner)
+	case "fade_distance":
+		l.fadeDistance, err = parseFloat(scanner)
+	case "fade_power":
+		l.fadePower, err = parseFloat(scanner)
+	case "jitter":
+		if l.area == nil {
+			return true, errors.New("Expected 'area_light' before 'jitter'")
+		}
+		l.area.jitter = true
+	case "adaptive":
+		if l.area == nil {
+			return true, errors.New("Expected 'area_light' before 'adaptive'")
+		}
+		var level float64
+		level, err = parseFloat(scanner)
+		if err == nil && level < 0 {
+			err = errors.New("adaptive must not be negative")
+		}
+		l.area.adaptive = int(math.Min(level, maxAdaptive))
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+// axis is the direction the light points at time t, for spotlights,
+// cylinder and parallel lights
+func (l *light) axis(t float64) Vector3D {
+	m, _ := l.at(t)
+	return l.pointAt.Transform(m).Sub(l.position(t)).Normalize()
+}
+
+// towards is the point on the light that shines on pt. Parallel and
+// cylinder lights shine straight along their axis from the plane through
+// their location
+func (l *light) towards(pt Point3D, t float64) Point3D {
+	if !l.parallel && l.kind != cylinderLight {
+		return l.position(t)
+	}
+	axis := l.axis(t)
+	return pt.Translate(axis.Scale(l.position(t).Sub(pt).Dot(axis)))
+}
+
+// intensity is how much of the light reaches pt, ignoring shadows, after
+// the spot or cylinder falloff and distance fading
+func (l *light) intensity(pt Point3D, t float64) float64 {
+	intensity := 1.0
+	switch l.kind {
+	case spotLight:
+		cosAngle := pt.Sub(l.position(t)).Normalize().Dot(l.axis(t))
+		cosRadius, cosFalloff := math.Cos(l.radius*degToRad), math.Cos(l.falloff*degToRad)
+		if l.tightness > 0 {
+			intensity = math.Pow(math.Max(cosAngle, 0), l.tightness)
+		}
+		intensity *= smoothStep(cosFalloff, cosRadius, cosAngle)
+	case cylinderLight:
+		axis := l.axis(t)
+		toPt := pt.Sub(l.position(t))
+		along := toPt.Dot(axis)
+		if along < 0 {
+			return 0
+		}
+		dist := toPt.Sub(axis.Scale(along)).Length()
+		intensity = 1 - smoothStep(l.radius, l.falloff, dist)
+	}
+	if l.fadeDistance > 0 && l.fadePower > 0 {
+		dist := pt.Dist(l.towards(pt, t))
+		intensity *= 2 / (1 + math.Pow(dist/l.fadeDistance, l.fadePower))
+	}
+	return intensity
+}
+
+// smoothStep eases from 0 at lo to 1 at hi
+func smoothStep(lo, hi, x float64) float64 {
+	if x <= lo {
+		return 0
+	}
+	if x >= hi {
+		return 1
+	}
+	f := (x - lo) / (hi - lo)
+	return f * f * (3 - 2*f)
+}
+
+// visibility is the share of the light reaching pt, per channel, from
+// black in full shadow to white fully lit
+func (sc *scene) visibility(pt Point3D, time float64, l *light, exclude castable) fColor {
+	if l.area == nil {
+		return sc.shadowFilter(pt, time, l.towards(pt, time), exclude, true)
+	}
+	samples := l.area.size1 * l.area.size2
+	a := &areaSampler{sc: sc, l: l, pt: pt, time: time, exclude: exclude,
+		tested: make([]bool, samples), lit: make([]fColor, samples)}
+	n1, n2 := l.area.size1-1, l.area.size2-1
+	if l.area.adaptive < 0 || (n1 == 0 && n2 == 0) {
+		return a.every()
+	}
+	// Start from cells 2^adaptive to a side, or single steps if the grid
+	// is smaller than that
+	cells := 1 << uint(l.area.adaptive)
+	split1, split2 := minInt(cells, n1), minInt(cells, n2)
+	total := fColor{A: 1}
+	for c1 := 0; c1 < maxInt(split1, 1); c1++ {
+		for c2 := 0; c2 < maxInt(split2, 1); c2++ {
+			i0, i1 := splitAt(c1, split1, n1), splitAt(c1+1, split1, n1)
+			j0, j1 := splitAt(c2, split2, n2), splitAt(c2+1, split2, n2)
+			total = total.Add(a.cell(i0, j0, i1, j1).
+				Scale(weight(i0, i1, n1) * weight(j0, j1, n2)))
+		}
+	}
+	return total
+}
+
+// every tests every sample on the grid
+func (a *areaSampler) every() fColor {
+	lit := fColor{A: 1}
+	for i := 0; i < a.l.area.size1; i++ {
+		for j := 0; j < a.l.area.size2; j++ {
+			lit = lit.Add(a.sample(i, j))
+		}
+	}
+	return lit.Scale(1 / float64(len(a.lit)))
+}
+
+// cell is the share of light through the grid between two corners. Cells
+// whose corners disagree are split until they agree or are a single step
+func (a *areaSampler) cell(i0, j0, i1, j1 int) fColor {
+	c00, c10, c01, c11 := a.sample(i0, j0), a.sample(i1, j0), a.sample(i0, j1), a.sample(i1, j1)
+	if (c00 == c10 && c00 == c01 && c00 == c11) || (i1-i0 <= 1 && j1-j0 <= 1) {
+		return c00.Add(c10).Add(c01).Add(c11).Scale(0.25)
+	}
+	total := fColor{A: 1}
+	for _, is := range halves(i0, i1) {
+		for _, js := range halves(j0, j1) {
+			total = total.Add(a.cell(is[0], js[0], is[1], js[1]).
+				Scale(weight(is[0], is[1], i1-i0) * weight(js[0], js[1], j1-j0)))
+		}
+	}
+	return total
+}
+
+// halves splits lo to hi in two, unless it's already a single step
+func halves(lo, hi int) [][2]int {
+	if hi-lo <= 1 {
+		return [][2]int{{lo, hi}}
+	}
+	mid := (lo + hi) / 2
+	return [][2]int{{lo, mid}, {mid, hi}}
+}
+
+// sample is the share of light from grid point (i, j) reaching the point.
+// Every sample is opaque so they can be summed with Add
+func (a *areaSampler) sample(i, j int) fColor {
+	ndx := i*a.l.area.size2 + j
+	if !a.tested[ndx] {
+		a.lit[ndx] = a.sc.shadowFilter(a.pt, a.time, a.l.samplePoint(i, j, a.time), a.exclude, true)
+		a.tested[ndx] = true
+	}
+	return a.lit[ndx]
+}
+
+// samplePoint is where grid point (i, j) of an area light is at time t
+func (l *light) samplePoint(i, j int, t float64) Point3D {
+	area := l.area
+	s1, s2 := gridOffset(i, area.size1), gridOffset(j, area.size2)
+	if area.jitter {
+		s1 += (rand.Float64() - 0.5) * gridStep(area.size1)
+		s2 += (rand.Float64() - 0.5) * gridStep(area.size2)
+	}
+	m, _ := l.at(t)
+	return l.location.Translate(area.axis1.Scale(s1)).
+		Translate(area.axis2.Scale(s2)).Transform(m)
+}
+
+// gridOffset places sample i of n evenly from -0.5 to 0.5 along an axis
+func gridOffset(i, n int) float64 {
+	if n == 1 {
+		return 0
+	}
+	return float64(i)/float64(n-1) - 0.5
+}
+
+func gridStep(n int) float64 {
+	if n == 1 {
+		return 1
+	}
+	return 1 / float64(n-1)
+}
+
+// splitAt is the grid index where part k of parts along n steps begins
+func splitAt(k, parts, n int) int {
+	if parts == 0 {
+		return 0
+	}
+	return k * n / parts
+}
+
+// weight is the share of span steps that lo to hi covers, or all of it
+// when the span has no length
+func weight(lo, hi, span int) float64 {
+	if span == 0 {
+		return 1
+	}
+	return float64(hi-lo) / float64(span)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// panel is the parallelogram an area light covers at time t, as its center
+// and the two edges across it. An edge is zero along an axis with a single
+// sample, where the light is a line or point
+func (l *light) panel(t float64) (center Point3D, edge1, edge2 Vector3D) {
+	m, _ := l.at(t)
+	if l.area.size1 > 1 {
+		edge1 = l.area.axis1.Transform(m)
+	}
+	if l.area.size2 > 1 {
+		edge2 = l.area.axis2.Transform(m)
+	}
+	return l.location.Transform(m), edge1, edge2
+}
+
+// sampleArea picks a random point on an area light to light pt from, and
+// the pdf of picking it over solid angle at pt. The pdf is 0 for lines and
+// points, which can only be sampled this way
+func (l *light) sampleArea(pt Point3D, t float64) (Point3D, float64) {
+	center, edge1, edge2 := l.panel(t)
+	normal := edge1.Cross(edge2)
+	if normal.Length() == 0 {
+		return l.samplePoint(rand.Intn(l.area.size1), rand.Intn(l.area.size2), t), 0
+	}
+	lightPt := center.Translate(edge1.Scale(rand.Float64() - 0.5)).
+		Translate(edge2.Scale(rand.Float64() - 0.5))
+	toLight := lightPt.Sub(pt)
+	dist := toLight.Length()
+	cosLight := math.Abs(toLight.Scale(1 / dist).Dot(normal.Normalize()))
+	return lightPt, l.panelPdf(dist, cosLight, t)
+}
+
+// hitPanel finds where ray meets an area light's parallelogram, with the
+// cosine of the angle it meets it at
+func (l *light) hitPanel(ray Ray) (dist, cosLight float64, ok bool) {
+	if l.area == nil {
+		return 0, 0, false
+	}
+	center, edge1, edge2 := l.panel(ray.Time)
+	normal := edge1.Cross(edge2)
+	nn := normal.Dot(normal)
+	dDotN := ray.Direction.Dot(normal)
+	if nn == 0 || dDotN == 0 {
+		return 0, 0, false
+	}
+	dist = center.Sub(ray.Origin).Dot(normal) / dDotN
+	if dist <= 0 {
+		return 0, 0, false
+	}
+	w := ray.PointAt(dist).Sub(center)
+	a, b := w.Cross(edge2).Dot(normal)/nn, edge1.Cross(w).Dot(normal)/nn
+	if math.Abs(a) > 0.5 || math.Abs(b) > 0.5 {
+		return 0, 0, false
+	}
+	return dist, math.Abs(dDotN) / math.Sqrt(nn), true
+}
+
+// panelPdf is the pdf over solid angle of picking a point dist away on an
+// area light, seen at an angle with cosine cosLight
+func (l *light) panelPdf(dist, cosLight, t float64) float64 {
+	if cosLight == 0 {
+		return math.Inf(1)
+	}
+	_, edge1, edge2 := l.panel(t)
+	return dist * dist / (edge1.Cross(edge2).Length() * cosLight)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+// parseTestLight reads a light_source body and returns the light it adds
+func parseTestLight(t *testing.T, src string) light {
+	lights = nil
+	scanner := newPOVScanner(strings.NewReader("{ "+src+" }"), "test.pov")
+	defer scanner.Close()
+	if err := parseLight(scanner); err != nil {
+		t.Fatalf("%q: %v", src, err)
+	}
+	l := lights[0]
+	lights = nil
+	return l
+}
+
+// Huge adaptive levels are capped rather than shifted out of range
+func TestAdaptiveClamped(t *testing.T) {
+	l := parseTestLight(t, "<0, 0, 0> rgb 1 area_light x, z, 5, 5 adaptive 1000")
+	if l.area.adaptive != maxAdaptive {
+		t.Errorf("adaptive 1000 kept as %v", l.area.adaptive)
+	}
+	sc := &scene{}
+	if got := sc.visibility(Point3D{0, -1, 0}, 0, &l, nil); got.R != 1 {
+		t.Errorf("unshadowed area light with adaptive 1000 lets through %v", got)
+	}
+}
+
+// A spotlight is full inside radius, dark past falloff and eases between
+func TestSpotFalloff(t *testing.T) {
+	l := parseTestLight(t, "<0, 0, 0> rgb 1 spotlight point_at <0, 0, 1> radius 20 falloff 40")
+	at := func(deg float64) Point3D {
+		a := deg * degToRad
+		return Point3D{X: 2 * math.Sin(a), Z: 2 * math.Cos(a)}
+	}
+	tests := []struct {
+		deg, want float64
+	}{
+		{0, 1},
+		{19, 1},
+		{41, 0},
+		{90, 0},
+		{180, 0},
+	}
+	for _, test := range tests {
+		if got := l.intensity(at(test.deg), 0); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%v degrees off the axis: intensity %v, want %v", test.deg, got, test.want)
+		}
+	}
+	prev := 1.0
+	for deg := 20.0; deg <= 40; deg++ {
+		got := l.intensity(at(deg), 0)
+		if got > prev {
+			t.Errorf("intensity rises from %v to %v at %v degrees", prev, got, deg)
+		}
+		prev = got
+	}
+	// tightness dims the spot away from its axis even inside radius
+	l.tightness = 10
+	if got, want := l.intensity(at(10), 0), math.Pow(math.Cos(10*degToRad), 10); math.Abs(got-want) > 1e-9 {
+		t.Errorf("tightness 10 at 10 degrees: intensity %v, want %v", got, want)
+	}
+}
+
+func TestCylinderFalloff(t *testing.T) {
+	l := parseTestLight(t, "<0, 0, 0> rgb 1 cylinder point_at <0, 0, 1> radius 1 falloff 2")
+	tests := []struct {
+		pt   Point3D
+		want float64
+	}{
+		{Point3D{0.5, 0, 10}, 1},
+		{Point3D{0, 0.9, 100}, 1},
+		{Point3D{2.5, 0, 1}, 0},
+		{Point3D{0, 0, -1}, 0},
+		{Point3D{1.5, 0, 3}, 0.5},
+	}
+	for _, test := range tests {
+		if got := l.intensity(test.pt, 0); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%v: intensity %v, want %v", test.pt, got, test.want)
+		}
+	}
+	// Cylinder lights shine along their axis, not from their location
+	if got := l.towards(Point3D{0.5, 0.5, 7}, 0); got != (Point3D{0.5, 0.5, 0}) {
+		t.Errorf("cylinder light shines from %v", got)
+	}
+}
+
+// Light is full strength at fade_distance and falls off by fade_power
+// beyond it, as 2 / (1 + (d/fade_distance)^fade_power)
+func TestFadePower(t *testing.T) {
+	l := parseTestLight(t, "<0, 0, 0> rgb 1 fade_distance 2 fade_power 2")
+	tests := []struct {
+		dist, want float64
+	}{
+		{0, 2},
+		{2, 1},
+		{4, 2.0 / 5},
+		{20, 2.0 / 101},
+	}
+	for _, test := range tests {
+		if got := l.intensity(Point3D{Y: test.dist}, 0); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%v away: intensity %v, want %v", test.dist, got, test.want)
+		}
+	}
+	l = parseTestLight(t, "<0, 0, 0> rgb 1 fade_distance 2")
+	if got := l.intensity(Point3D{Y: 20}, 0); got != 1 {
+		t.Errorf("no fade_power: intensity %v, want 1", got)
+	}
+}
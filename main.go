@@ -1,11 +1,13 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"image"
 	"image/jpeg"
 	"math"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
@@ -21,73 +23,150 @@ var (
 	imgHeight = 600
 
 	bkgndColor = fColor{R: 0.0, G: 0.0, B: 0.0, A: 1.0}
+	white      = fColor{R: 1.0, G: 1.0, B: 1.0, A: 1.0}
 
 	MAX_DEPTH  = 7
 	numThreads int
+
+	// renderMode is whittedMode, pathMode or aoMode, and samplesPerPixel the
+	// passes a path traced image takes
+	renderMode      = whittedMode
+	samplesPerPixel = 64
+
+	// Ambient light is shaded by occlusion over aoSamples rays, when
+	// set, which look for objects within aoDistance
+	aoSamples  = 0
+	aoDistance = 4.0
 )
 
 type goArgs struct {
-	ray  Ray
+	job *frameJob
+	// rays are averaged into the pixel, one per lens and shutter sample
+	rays []Ray
 	x, y int
+	pass int
+}
+
+// scene is everything parsed for one frame. The parser fills in the
+// objects, lights, eye and settings globals, which are then handed to the
+// workers here so the next frame can be parsed while this one renders
+type scene struct {
+	objects  []castable
+	lights   []light
+	eye      camera
+	settings globalSettings
+	photons  photonMap
+	sky      sky
+	fogs     []fog
+	// emitters are the glowing objects sampled as lights
+	emitters []emitter
 }
 
 func main() {
-	povFile := processCmd()
-	if povFile == nil {
+	povFile, anim := processCmd()
+	if povFile == "" {
 		return
 	}
-	defer povFile.Close()
 	argsChan := make(chan goArgs, 4096)
-	img := image.NewRGBA(image.Rectangle{image.ZP, image.Point{imgWidth, imgHeight}})
 	wg := sync.WaitGroup{}
-	setupThreads(argsChan, &wg, img)
-
-	xTrans := eye.right.Scale(2 / float64(imgWidth))
-	yTrans := eye.up.Scale(2 / float64(imgHeight))
-
-	xStart := eye.location.Translate(eye.right.Scale(-1))
-	yStart := eye.location.Translate(eye.up.Scale(-1))
-	imgPlane := eye.lookAt.Sub(eye.location).Normalize().Scale(2)
-
-	currX := xStart.Translate(xTrans.Scale(0.5))
-	for x := 0; x < imgWidth; x++ {
-		currY := yStart.Translate(yTrans.Scale(0.5))
-		for y := imgHeight - 1; y >= 0; y-- {
-			view := eye.location.Translate(currX.Sub(eye.location)).
-				Translate(currY.Sub(eye.location)).Translate(imgPlane)
-			argsChan <- goArgs{CreateRay(eye.location, view), x, y}
-			currY = currY.Translate(yTrans)
-		}
-		currX = currX.Translate(xTrans)
-	}
+	setupThreads(argsChan, &wg)
+
+	err := anim.render(povFile, argsChan)
 	close(argsChan)
 	wg.Wait()
-
-	writeFile(img)
+	if err != nil {
+		fmt.Println(err)
+	}
 }
 
-func processCmd() *os.File {
-	args := os.Args[1:]
-	if len(args) == 0 {
-		fmt.Println("Usage:", os.Args[0], "<path-to-pov-file>")
-		return nil
+// loadScene parses the scene file with the given identifiers predeclared
+func loadScene(path string, symbols map[string]exprValue) (*scene, error) {
+	objects = make([]castable, 0, 10)
+	lights = make([]light, 0, 1)
+	eye = makeCamera()
+	settings = globalSettings{}
+	backdrop = makeSky()
+	fogs = nil
+
+	povFile, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer povFile.Close()
+	if err = parsePOV(povFile, path, symbols); err != nil {
+		return nil, err
+	}
+	sc := &scene{objects: objects, lights: lights, eye: eye, settings: settings, sky: backdrop,
+		fogs: fogs}
+	sc.buildPhotonMap()
+	if renderMode == pathMode {
+		sc.sky.buildSampler()
 	}
+	sc.findEmitters()
+	return sc, nil
+}
 
-	filename := args[0]
+// pathList collects a repeatable directory flag such as -L
+type pathList []string
 
-	povFile, err := os.Open(filename)
-	defer povFile.Close()
-	if err == nil {
-		err = parsePOV(povFile)
+func (pl *pathList) String() string {
+	return strings.Join(*pl, string(filepath.ListSeparator))
+}
+
+func (pl *pathList) Set(dir string) error {
+	*pl = append(*pl, dir)
+	return nil
+}
+
+func processCmd() (string, animation) {
+	var libPaths pathList
+	var anim animation
+	flag.Var(&libPaths, "L", "add `dir` to the #include search path (repeatable)")
+	flag.IntVar(&anim.initialFrame, "initial_frame", 1, "first frame to render")
+	flag.IntVar(&anim.finalFrame, "final_frame", 1, "last frame to render")
+	flag.Float64Var(&anim.initialClock, "initial_clock", 0, "clock value at the first frame")
+	flag.Float64Var(&anim.finalClock, "final_clock", 1, "clock value at the last frame")
+	flag.BoolVar(&anim.resume, "resume", false, "skip frames that have already been rendered")
+	flag.StringVar(&renderMode, "mode", whittedMode, "renderer to use: whitted, path or ao")
+	flag.IntVar(&samplesPerPixel, "spp", samplesPerPixel, "samples per pixel when path tracing")
+	flag.IntVar(&aoSamples, "ao_samples", aoSamples, "rays shading ambient light by occlusion, 0 for none")
+	flag.Float64Var(&aoDistance, "ao_distance", aoDistance, "how far away objects occlude")
+	flag.IntVar(&emissionSamples, "emission_samples", emissionSamples,
+		"points sampled on each glowing object when lighting by it")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		fmt.Println("Usage:", os.Args[0], "[-L dir]... [-initial_frame n -final_frame n]",
+			"[-initial_clock f -final_clock f] [-resume] [-mode whitted|path|ao] [-spp n]",
+			"[-ao_samples n] [-ao_distance f] [-emission_samples n]",
+			"<path-to-pov-file>")
+		return "", anim
 	}
-	if err != nil {
+	if err := anim.validate(); err != nil {
 		fmt.Println(err)
-		return nil
+		return "", anim
+	}
+	if renderMode != whittedMode && renderMode != pathMode && renderMode != aoMode {
+		fmt.Println("Unknown render mode:", renderMode)
+		return "", anim
 	}
-	return povFile
+	if samplesPerPixel < 1 {
+		fmt.Println("spp must be at least 1")
+		return "", anim
+	}
+	if aoSamples < 0 || aoDistance <= 0 {
+		fmt.Println("ao_samples can't be negative and ao_distance must be positive")
+		return "", anim
+	}
+	if emissionSamples < 1 {
+		fmt.Println("emission_samples must be at least 1")
+		return "", anim
+	}
+
+	includePaths = libPaths
+	return flag.Arg(0), anim
 }
 
-func setupThreads(channel chan goArgs, wg *sync.WaitGroup, img *image.RGBA) {
+func setupThreads(channel chan goArgs, wg *sync.WaitGroup) {
 	maxProcsString := os.Getenv("GOMAXPROCS")
 	if maxProcsString == "" {
 		numThreads = runtime.NumCPU()
@@ -106,23 +185,55 @@ func setupThreads(channel chan goArgs, wg *sync.WaitGroup, img *image.RGBA) {
 		wg.Add(1)
 		go func() {
 			for arg := range channel {
-				_, color := castRay(arg.ray, MAX_DEPTH, -1)
-				img.Set(arg.x, arg.y, color)
+				colors := make([]fColor, len(arg.rays))
+				for i, ray := range arg.rays {
+					switch renderMode {
+					case pathMode:
+						colors[i] = arg.job.scene.tracePath(ray)
+					case aoMode:
+						colors[i] = arg.job.scene.occlusionPass(ray)
+					default:
+						_, colors[i] = arg.job.scene.castRay(ray, MAX_DEPTH, nil)
+					}
+				}
+				arg.job.add(arg.x, arg.y, average(colors))
+				arg.job.passes[arg.pass].Done()
 			}
 			wg.Done()
 		}()
 	}
 }
 
-func writeFile(img *image.RGBA) {
-	splitString := strings.Split(os.Args[1], "/")
+// average blends colors as they would be drawn, so the result is opaque
+func average(colors []fColor) fColor {
+	if len(colors) == 1 {
+		return colors[0]
+	}
+	sum := fColor{}
+	for _, c := range colors {
+		r, g, b, _ := c.rgba()
+		sum.R, sum.G, sum.B = sum.R+r, sum.G+g, sum.B+b
+	}
+	n := float64(len(colors))
+	return fColor{R: sum.R / n, G: sum.G / n, B: sum.B / n, A: 1}
+}
+
+// sceneName is the scene file's name without its directory or .pov
+func sceneName(path string) string {
+	splitString := strings.Split(path, "/")
 	name := splitString[len(splitString)-1]
 	if strings.HasSuffix(name, ".pov") {
 		dotSplit := strings.Split(name, ".")
 		name = strings.Join(dotSplit[:len(dotSplit)-1], ".")
 	}
-	outFile := fileDir + name + ext
-	file, err := os.Create(outFile)
+	return name
+}
+
+// writeFile writes to a temporary file first, so an interrupted render
+// never leaves a partial image that -resume would skip
+func writeFile(img *image.RGBA, outFile string) {
+	tmpFile := outFile + ".tmp"
+	file, err := os.Create(tmpFile)
 
 	if err != nil {
 		panic(err)
@@ -135,62 +246,140 @@ func writeFile(img *image.RGBA) {
 	if err != nil {
 		panic(err)
 	}
+	if err = file.Close(); err != nil {
+		panic(err)
+	}
+	if err = os.Rename(tmpFile, outFile); err != nil {
+		panic(err)
+	}
 }
 
-func castRay(ray Ray, depth, currObj int) (bool, fColor) {
+func (sc *scene) castRay(ray Ray, depth int, currObj castable) (bool, fColor) {
 	depth--
 	if depth < 0 {
-		return false, bkgndColor
+		return false, fColor{}
 	}
 
-	if hit, t, ndx := hitAnything(ray, currObj); hit {
-		obj := objects[ndx]
+	if hit, t, obj := sc.hitAnything(ray, currObj); hit {
 		pxlClr := fColor{}
 		interPt := ray.PointAt(t)
-		for i := range lights {
-			light := lights[i]
-			if !isShadowed(interPt, light, ndx) {
-				pxlClr = pxlClr.Add(calcColor(obj, light, interPt, eye.location))
+		normal := obj.Normal(interPt, ray.Time)
+		ao := sc.ambientOcclusion(ray, obj, interPt, normal)
+		normal = obj.Perturb(interPt, normal, ray)
+		color, fin := obj.Color(interPt, ray), obj.Finish(interPt, ray)
+		for i := range sc.lights {
+			light := sc.lights[i]
+			lit := fColor{}
+			if intensity := light.intensity(interPt, ray.Time); intensity > 0 {
+				lit = sc.visibility(interPt, ray.Time, &light, obj).Scale(intensity)
+			}
+			if !lit.isBlack() {
+				pxlClr = pxlClr.Add(calcColor(fin, color, normal, light, interPt, sc.eye.location, ray.Time, lit, ao))
 			} else {
-				pxlClr = pxlClr.Add(light.color.Mult(obj.Color().
-					Scale(obj.Finish().ambient)))
+				pxlClr = pxlClr.Add(light.color.Mult(color.Scale(fin.ambient * ao)))
 			}
 		}
-		normal := obj.Normal(interPt)
-		if obj.Finish().reflection > 0 {
-			reflection := ray.Direction.Sub(normal.Scale(2 * ray.Direction.Dot(normal)))
-			if reflect, color := castRay(Ray{interPt, reflection.Normalize()}, depth, ndx); reflect {
-				pxlClr = pxlClr.Add(color.Scale(obj.Finish().reflection))
+		if len(sc.emitters) > 0 {
+			pxlClr = pxlClr.Add(sc.emitterLight(obj, fin, color, normal, interPt, sc.eye.location, ray.Time))
+		}
+		// Surfaces glow only on their outer side, the side emitters light from
+		if !fin.emission.isBlack() && ray.Direction.Dot(normal) < 0 {
+			pxlClr = pxlClr.Add(emitted(fin, color))
+		}
+		if fin.diffuse > 0 {
+			pxlClr = pxlClr.Add(sc.caustics(interPt, facingNormal(ray, normal)).
+				Mult(color.Scale(fin.diffuse)))
+		}
+		reflectAmt, refractAmt, refractRay, exiting := split(ray, obj, interPt, normal)
+		if reflectAmt > 0 {
+			reflection := ray.Direction.Sub(normal.Scale(2 * ray.Direction.Dot(normal))).Normalize()
+			reflectRay, skip := ray.spawn(interPt, reflection), obj
+			if exiting {
+				// Reflected back inside, where the object's far side may be hit
+				reflectRay.Origin, skip = interPt.Translate(reflection.Scale(0.01)), nil
 			}
+			_, color := sc.castRay(reflectRay, depth, skip)
+			pxlClr = pxlClr.Add(color.Scale(reflectAmt))
 		}
-		if obj.Finish().refraction > 0 {
-			// Assuming non object material is air w/ ior=1
-			var internal bool
-			var refractRay Ray
-			if ray.Direction.Dot(normal) > 0 { // We are exiting the object
-				internal, refractRay = calcRefractRay(ray, obj, interPt, obj.Finish().ior, 1)
-			} else { // We are entering the object
-				internal, refractRay = calcRefractRay(ray, obj, interPt, 1, obj.Finish().ior)
+		if refractAmt > 0 {
+			// Rays heading inside need to find the object's far side
+			skip := obj
+			if !exiting {
+				skip = nil
 			}
-			if !internal {
-				if refract, color := castRay(refractRay, depth, ndx); refract {
-					pxlClr = pxlClr.Add(color.Scale(obj.Finish().refraction))
-				}
+			if obj.Interior().disperses() && ray.Wavelength == 0 {
+				pxlClr = pxlClr.Add(sc.disperse(ray, obj, interPt, normal, exiting, depth, skip).
+					Scale(refractAmt))
+			} else {
+				_, color := sc.castRay(refractRay, depth, skip)
+				pxlClr = pxlClr.Add(color.Scale(refractAmt))
 			}
 		}
 		if pxlClr.A < 1 {
-			_, nextClr := castRay(ray, depth, ndx)
-			pxlClr = pxlClr.Scale(pxlClr.A).Add(nextClr.Scale(1 - pxlClr.A))
+			_, nextClr := sc.castRay(ray.spawn(interPt, ray.Direction), depth, obj)
+			// What shows through is split between filtered and transmitted
+			// light as the pigment's own transparency is
+			share := white.Scale(1 - pxlClr.A)
+			if color.A < 1 {
+				share = color.through().Scale((1 - pxlClr.A) / (1 - color.A))
+			}
+			pxlClr = pxlClr.Scale(pxlClr.A).Add(nextClr.Tint(share))
+		}
+		if exiting {
+			// Everything seen from inside has crossed the object's interior
+			pxlClr = pxlClr.Tint(obj.Interior().fade(t))
 		}
-		return true, pxlClr
+		return true, fogged(sc.fogs, ray, t, pxlClr)
 	}
-	return false, bkgndColor
+	return false, fogged(sc.fogs, ray, math.Inf(1), sc.sky.at(ray))
 }
 
-func calcRefractRay(initialRay Ray, obj castable, origPt Point3D,
+// split is the share of ray reflected and refracted where it hits obj at
+// pt, and the refracted ray. exiting is true for rays leaving the object
+func split(ray Ray, obj castable, pt Point3D, normal Vector3D) (reflectAmt, refractAmt float64,
+	refractRay Ray, exiting bool) {
+	fin := obj.Finish(pt, ray)
+	reflectAmt, refractAmt = fin.reflection, fin.refraction
+	n1, n2, exiting := iors(ray, obj, normal)
+	var internal bool
+	if refractAmt > 0 {
+		internal, refractRay = calcRefractRay(ray, normal, pt, n1, n2)
+	}
+	if fin.fresnel {
+		share := fresnel(math.Abs(ray.Direction.Dot(normal)), n1, n2)
+		reflectAmt = fin.reflectionMin + (fin.reflection-fin.reflectionMin)*share
+		refractAmt *= 1 - share
+	}
+	// Light that can't get out past the critical angle is reflected with
+	// fresnel on, and lost otherwise, as it always has been
+	if internal {
+		if fin.fresnel {
+			reflectAmt += refractAmt
+		}
+		refractAmt = 0
+	}
+	return
+}
+
+// iors is the index of refraction ray is leaving and the one it's
+// entering as it crosses obj's surface, and whether it's leaving obj
+func iors(ray Ray, obj castable, normal Vector3D) (n1, n2 float64, exiting bool) {
+	// Assuming non object material is air w/ ior=1
+	n1, n2 = 1.0, obj.Interior().iorAt(ray.Wavelength)
+	exiting = ray.Direction.Dot(normal) > 0
+	if exiting {
+		n1, n2 = n2, n1
+	}
+	return
+}
+
+func calcRefractRay(initialRay Ray, normal Vector3D, origPt Point3D,
 	n1, n2 float64) (internalReflection bool, refractRay Ray) {
-	normal := obj.Normal(origPt)
 	dDotN := initialRay.Direction.Dot(normal)
+	// Bend towards the side the ray is heading
+	if dDotN > 0 {
+		normal, dDotN = normal.Scale(-1), -dDotN
+	}
 	sqrtComp := math.Pow(n1, 2) * (1 - math.Pow(dDotN, 2)) / math.Pow(n2, 2)
 	if sqrtComp > 1 {
 		return true, Ray{}
@@ -199,42 +388,77 @@ func calcRefractRay(initialRay Ray, obj castable, origPt Point3D,
 		dDotN)).Scale(n1 / n2).Sub(
 		normal.Scale(math.Sqrt(1 - sqrtComp))).Normalize()
 	// Make ray start w/in object
-	return false, Ray{Origin: origPt.Translate(refract.Scale(0.01)),
-		Direction: refract}
+	return false, initialRay.spawn(origPt.Translate(refract.Scale(0.01)), refract)
 }
 
-func isShadowed(pt Point3D, light light, objNdx int) bool {
-	r := CreateRay(pt, light.location)
-	for ndx := range objects {
-		if ndx != objNdx {
-			if hitObj, _ := objects[ndx].Hit(r); hitObj {
-				return true
+// shadowFilter is the share of light, per channel, that gets from a point
+// on a light to pt through whatever is in between. It's black behind
+// anything opaque. photonLit light also arrives as photons once there's a
+// photon map, so the targets they pass through block it instead
+func (sc *scene) shadowFilter(pt Point3D, time float64, lightPt Point3D, exclude castable,
+	photonLit bool) fColor {
+	r := CreateRay(pt, lightPt)
+	r.Time = time
+	dist := pt.Dist(lightPt)
+	exclude = primitive(exclude)
+	filter := white
+	photonLit = photonLit && len(sc.photons) > 0
+	for ndx := range sc.objects {
+		if sc.objects[ndx] != exclude && !sc.objects[ndx].base().noShadow {
+			if surface, ok := nearestSurface(sc.objects[ndx], r, exclude); ok && surface.t < dist {
+				if opts := sc.objects[ndx].base().photons; photonLit && opts.target && opts.refraction {
+					return fColor{A: 1}
+				}
+				if filter = filter.Tint(transmission(surface.obj, r.PointAt(surface.t), r)); filter.isBlack() {
+					return filter
+				}
 			}
 		}
 	}
-	return false
+	return filter
 }
 
-func hitAnything(r Ray, objNdx int) (hit bool, t float64, hitNdx int) {
+// transmission is the share of light, per channel, passing through obj:
+// what its pigment filters and transmits, plus its refracted share, which
+// castRay adds uncolored, so shadows are as clear as the object looks
+func transmission(obj castable, pt Point3D, r Ray) fColor {
+	clear := obj.Finish(pt, r).refraction
+	c := obj.Color(pt, r)
+	if c.A >= 1 {
+		return fColor{R: clear, G: clear, B: clear, A: 1}
+	}
+	through := c.through()
+	return fColor{R: math.Min(1, through.R+clear), G: math.Min(1, through.G+clear),
+		B: math.Min(1, through.B+clear), A: 1}
+}
+
+// hitAnything finds the nearest primitive along r, skipping the one the ray
+// is leaving. Surfaces seen from inside a CSG come back as invertedSurface
+func (sc *scene) hitAnything(r Ray, exclude castable) (hit bool, t float64, hitObj castable) {
 	t = math.MaxFloat64
-	for ndx := range objects {
-		if ndx != objNdx {
-			if hitObj, hitTime := objects[ndx].Hit(r); hitObj && hitTime < t {
-				hit, t, hitNdx = true, hitTime, ndx
+	exclude = primitive(exclude)
+	for ndx := range sc.objects {
+		if sc.objects[ndx] != exclude {
+			if surface, ok := nearestSurface(sc.objects[ndx], r, exclude); ok && surface.t < t {
+				hit, t, hitObj = true, surface.t, surface.obj
+				if surface.inverted {
+					hitObj = invertedSurface{surface.obj}
+				}
 			}
 		}
 	}
 	return
 }
 
-func calcColor(obj castable, light light, pt, eye Point3D) fColor {
-	normal := obj.Normal(pt)
+// calcColor shades pt, of pigment color and facing normal, with the
+// diffuse and specular light tinted by the share lit that reaches it, plus
+// the ambient left by occlusion ao
+func calcColor(fin finish, color fColor, normal Vector3D, light light, pt, eye Point3D, time float64,
+	lit fColor, ao float64) fColor {
 	view := eye.Sub(pt).Normalize()
-	L := light.location.Sub(pt).Normalize()
-	diffuse := light.color.Mult(obj.Color().Scale(obj.Finish().diffuse)).
-		Scale(math.Min(1.0, math.Max(0.0, normal.Dot(L))))
-	specular := light.color.Mult(obj.Color().Scale(obj.Finish().specular)).
-		Scale(math.Pow(math.Min(1.0, math.Max(0.0, normal.Dot(L.Add(view).Normalize()))), 1/obj.Finish().roughness))
-	ambient := light.color.Mult(obj.Color().Scale(obj.Finish().ambient))
-	return diffuse.Add(specular).Add(ambient)
+	L := light.towards(pt, time).Sub(pt).Normalize()
+	shade := fin.bsdf().shade(color, normal, view, L)
+	shaded := light.color.Mult(fColor{R: shade.R, G: shade.G, B: shade.B, A: color.A})
+	ambient := light.color.Mult(color.Scale(fin.ambient * ao))
+	return shaded.Tint(lit).Add(ambient)
 }
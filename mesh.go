@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// triangle is one face of a mesh, in the mesh's object space. Its normal
+// is (corner2 - corner1) x (corner3 - corner1)
+type triangle struct {
+	corner1, corner2, corner3 Point3D
+	// uv are the corners' places on uv mapped pigments, if hasUV
+	uv    [3]Point3D
+	hasUV bool
+}
+
+// mesh is a surface of triangles. It has no inside of its own, but a
+// closed mesh whose normals all point out refracts and glows like a
+// solid. A lone triangle is a mesh of one face
+type mesh struct {
+	triangles []triangle
+	// areas are running totals of the triangles' areas, for picking one by
+	// its share of the surface
+	areas []float64
+	// lo and hi bound the triangles in object space
+	lo, hi Point3D
+	object
+}
+
+// meshFace is the triangle of a mesh that a ray hit, standing in for the
+// mesh with the face's own normal
+type meshFace struct {
+	*mesh
+	ndx int
+}
+
+func makeMesh() (m mesh) {
+	m.init()
+	return
+}
+
+func parseTriangle(scanner *povScanner) (castable, error) {
+	if !scanner.Scan() || scanner.Text() != "{" {
+		return nil, errors.New("Missing '{' token")
+	}
+	m := makeMesh()
+	tri, err := parseCorners(scanner)
+	if err != nil {
+		return nil, err
+	}
+	m.triangles = append(m.triangles, tri)
+	if err = m.finishObject(scanner); err != nil {
+		return nil, err
+	}
+	// Triangles with no area are left out
+	if m.prepare() == 0 {
+		return nil, nil
+	}
+	return &m, nil
+}
+
+// parseMesh reads a mesh's triangles, given one by one or loaded from an
+// OBJ file, followed by its modifiers
+func parseMesh(scanner *povScanner) (castable, error) {
+	if !scanner.Scan() || scanner.Text() != "{" {
+		return nil, errors.New("Missing '{' token")
+	}
+	m := makeMesh()
+	for scanner.Scan() {
+		var err error
+		switch scanner.Text() {
+		case "}":
+			if m.prepare() == 0 {
+				return nil, errors.New("Mesh needs at least one triangle with an area")
+			}
+			return &m, nil
+		case "triangle":
+			var tri triangle
+			if !scanner.Scan() || scanner.Text() != "{" {
+				return nil, errors.New("Missing '{' token")
+			}
+			if tri, err = parseCorners(scanner); err == nil {
+				if tri, err = parseUVs(scanner, tri); err == nil {
+					m.triangles = append(m.triangles, tri)
+				}
+			}
+		case "obj":
+			var tris []triangle
+			if !scanner.Scan() {
+				return nil, eofErr
+			}
+			name := scanner.Text()
+			if len(name) < 2 || name[0] != '"' || name[len(name)-1] != '"' {
+				return nil, errors.New("Expected an OBJ file name, found: '" + name + "'")
+			}
+			if tris, err = loadOBJ(name[1:len(name)-1], filepath.Dir(scanner.path())); err == nil {
+				m.triangles = append(m.triangles, tris...)
+			}
+		default:
+			err = m.parseModifier(scanner)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, eofErr
+}
+
+func parseCorners(scanner *povScanner) (tri triangle, err error) {
+	for _, corner := range []*Point3D{&tri.corner1, &tri.corner2, &tri.corner3} {
+		if *corner, err = parsePoint(scanner); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// parseUVs reads the uv_vectors that may end a mesh triangle, and the '}'
+// after them
+func parseUVs(scanner *povScanner, tri triangle) (triangle, error) {
+	if !scanner.Scan() {
+		return tri, eofErr
+	}
+	if scanner.Text() == "uv_vectors" {
+		for i := range tri.uv {
+			val, err := parseExpr(scanner)
+			if err == nil && val.size != 2 {
+				err = errors.New("Expected a uv vector of 2 components, found " + strconv.Itoa(val.size))
+			}
+			if err != nil {
+				return tri, err
+			}
+			tri.uv[i] = Point3D{val.v[0], val.v[1], 0}
+		}
+		tri.hasUV = true
+		if !scanner.Scan() {
+			return tri, eofErr
+		}
+	}
+	if scanner.Text() != "}" {
+		return tri, errors.New("Expected '}' after mesh triangle, found: '" + scanner.Text() + "'")
+	}
+	return tri, nil
+}
+
+// prepare drops the triangles with no area and totals the areas of the
+// rest, returning the mesh's area
+func (m *mesh) prepare() float64 {
+	kept := m.triangles[:0]
+	m.areas = nil
+	total := 0.0
+	for _, tri := range m.triangles {
+		if area := tri.area(); area > 0 {
+			kept = append(kept, tri)
+			total += area
+			m.areas = append(m.areas, total)
+		}
+	}
+	m.triangles = kept
+	if len(kept) > 0 {
+		m.lo, m.hi = kept[0].corner1, kept[0].corner1
+	}
+	for _, tri := range m.triangles {
+		for _, c := range [3]Point3D{tri.corner1, tri.corner2, tri.corner3} {
+			m.lo = Point3D{math.Min(m.lo.X, c.X), math.Min(m.lo.Y, c.Y), math.Min(m.lo.Z, c.Z)}
+			m.hi = Point3D{math.Max(m.hi.X, c.X), math.Max(m.hi.Y, c.Y), math.Max(m.hi.Z, c.Z)}
+		}
+	}
+	return total
+}
+
+func (tri *triangle) edges() (Vector3D, Vector3D) {
+	return tri.corner2.Sub(tri.corner1), tri.corner3.Sub(tri.corner1)
+}
+
+func (tri *triangle) area() float64 {
+	e1, e2 := tri.edges()
+	return e1.Cross(e2).Length() / 2
+}
+
+// hit finds where the object space ray crosses the triangle, ahead of or
+// behind its origin, with the crossing's weights towards corner2 and
+// corner3
+func (tri *triangle) hit(r Ray) (ok bool, t, b1, b2 float64) {
+	e1, e2 := tri.edges()
+	p := r.Direction.Cross(e2)
+	det := e1.Dot(p)
+	if det == 0 {
+		return
+	}
+	s := r.Origin.Sub(tri.corner1)
+	if b1 = s.Dot(p) / det; b1 < 0 || b1 > 1 {
+		return
+	}
+	q := s.Cross(e1)
+	if b2 = r.Direction.Dot(q) / det; b2 < 0 || b1+b2 > 1 {
+		return
+	}
+	return true, e2.Dot(q) / det, b1, b2
+}
+
+// crossings are the faces the object space ray crosses, nearest first,
+// once it reaches the mesh's bounds
+func (m *mesh) crossings(r Ray) []surfaceHit {
+	if hit, _, t2 := (&box{corner1: m.lo, corner2: m.hi}).slabs(r); !hit || t2 < 0 {
+		return nil
+	}
+	var hits []surfaceHit
+	for i := range m.triangles {
+		if ok, t, _, _ := m.triangles[i].hit(r); ok {
+			hits = append(hits, surfaceHit{t: t, obj: meshFace{m, i}})
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].t < hits[j].t })
+	return hits
+}
+
+// nearest finds the first face in front of the ray, skipping the face the
+// ray is leaving
+func (m *mesh) nearest(r Ray, exclude castable) (hit surfaceHit, found bool) {
+	for _, h := range m.crossings(m.toObject(r)) {
+		if h.t > 0 && h.obj != exclude {
+			return h, true
+		}
+	}
+	return
+}
+
+func (m *mesh) Hit(r Ray) (bool, float64) {
+	hit, found := m.nearest(r, nil)
+	return found, hit.t
+}
+
+// Intervals gives each face crossed as a span with no length, so a union
+// finds the faces while the insides of other CSG operations ignore them
+func (m *mesh) Intervals(r Ray) []span {
+	var spans []span
+	for _, h := range m.crossings(m.toObject(r)) {
+		spans = append(spans, span{enter: h, exit: h})
+	}
+	return spans
+}
+
+// Normal is only defined for a mesh's faces, which hitAnything reports in
+// its place
+func (m *mesh) Normal(pt Point3D, time float64) Vector3D {
+	return Vector3D{}
+}
+
+func (f meshFace) Normal(pt Point3D, time float64) Vector3D {
+	e1, e2 := f.triangles[f.ndx].edges()
+	return f.toWorldNormal(e1.Cross(e2), time)
+}
+
+func (f meshFace) Color(pt Point3D, ray Ray) fColor {
+	return f.mesh.Color(pt, f.mapped(pt, ray))
+}
+
+func (f meshFace) Finish(pt Point3D, ray Ray) finish {
+	return f.mesh.Finish(pt, f.mapped(pt, ray))
+}
+
+func (f meshFace) Perturb(pt Point3D, normal Vector3D, ray Ray) Vector3D {
+	return f.mesh.Perturb(pt, normal, f.mapped(pt, ray))
+}
+
+// mapped gives ray the uv of pt on a face with uv vectors, with its beam
+// measured in uv units rather than across the face
+func (f meshFace) mapped(pt Point3D, ray Ray) Ray {
+	tri := &f.triangles[f.ndx]
+	if !tri.hasUV {
+		return ray
+	}
+	m, inv := f.at(ray.Time)
+	e1, e2 := tri.edges()
+	normal := e1.Cross(e2)
+	size := normal.Dot(normal)
+	from := pt.Transform(inv).Sub(tri.corner1)
+	b1, b2 := from.Cross(e2).Dot(normal)/size, e1.Cross(from).Dot(normal)/size
+	uv1, uv2 := tri.uv[1].Sub(tri.uv[0]), tri.uv[2].Sub(tri.uv[0])
+	ray.UV = tri.uv[0].Translate(uv1.Scale(b1)).Translate(uv2.Scale(b2))
+	ray.HasUV = true
+	if across := e1.Transform(m).Cross(e2.Transform(m)).Length(); across > 0 {
+		stretch := math.Sqrt(uv1.Cross(uv2).Length() / across)
+		ray.Width, ray.Spread = ray.Width*stretch, ray.Spread*stretch
+	}
+	return ray
+}
+
+// surfacePoint picks a triangle by its share of the area with u, reusing
+// what's left of u to pick a point on it along with v
+func (m *mesh) surfacePoint(u, v float64) (Point3D, Vector3D) {
+	i, u := m.pick(u)
+	tri := &m.triangles[i]
+	e1, e2 := tri.edges()
+	s := math.Sqrt(u)
+	pt := tri.corner1.Translate(e1.Scale(s * (1 - v))).Translate(e2.Scale(s * v))
+	return pt, e1.Cross(e2).Normalize()
+}
+
+// pick is the triangle u, from 0 to 1, lands on when the triangles are
+// laid end to end by area, and how far across it u is
+func (m *mesh) pick(u float64) (int, float64) {
+	at := u * m.surfaceArea()
+	i := sort.SearchFloat64s(m.areas, at)
+	if i == len(m.areas) {
+		i--
+	}
+	start := 0.0
+	if i > 0 {
+		start = m.areas[i-1]
+	}
+	return i, math.Max(0, math.Min(1, (at-start)/(m.areas[i]-start)))
+}
+
+func (m *mesh) surfaceArea() float64 {
+	if len(m.areas) == 0 {
+		return 0
+	}
+	return m.areas[len(m.areas)-1]
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestMeshParse(t *testing.T) {
+	tests := []struct {
+		src   string
+		faces int
+		fails bool
+	}{
+		{"triangle { <0,0,0>, <1,0,0>, <0,1,0> }", 1, false},
+		{"triangle { <0,0,0>, <1,0,0>, <0,1,0> translate <0,0,1> }", 1, false},
+		// Triangles with no area are left out
+		{"triangle { <0,0,0>, <1,0,0>, <2,0,0> }", 0, false},
+		{"mesh " + tetrahedron, 4, false},
+		{"mesh { triangle { <0,0,0>, <1,0,0>, <0,1,0> } triangle { <0,0,0>, <0,0,0>, <0,1,0> } }", 1, false},
+		{"mesh { triangle { <0,0,0>, <1,0,0>, <2,0,0> } }", 0, true},
+		{"mesh { triangle { <0,0,0>, <1,0,0>, <0,1,0> pigment { rgb 1 } } }", 0, true},
+		{"triangle { <0,0,0>, <1,0,0> }", 0, true},
+	}
+	for _, test := range tests {
+		scanner := newPOVScanner(strings.NewReader(test.src), "test.pov")
+		scanner.Scan()
+		obj, _, err := parseObject(scanner)
+		scanner.Close()
+		if (err != nil) != test.fails {
+			t.Errorf("%s: error %v", test.src, err)
+			continue
+		}
+		if test.fails {
+			continue
+		}
+		if m, ok := obj.(*mesh); (ok && len(m.triangles) != test.faces) || (!ok && test.faces > 0) {
+			t.Errorf("%s: got %v, want %d faces", test.src, obj, test.faces)
+		}
+	}
+}
+
+// Rays find the nearest face of a tetrahedron, facing out, and rays
+// leaving a face from inside find the face across from it
+func TestMeshHit(t *testing.T) {
+	m := parseTestMesh(t, tetrahedron)
+	placed(&m.object, transformOp{kind: "translate", vec: Vector3D{0, 0, 5}})
+	sc := &scene{objects: []castable{m}}
+	r := Ray{Origin: Point3D{0.2, 0.2, 0}, Direction: zAxis}
+	hit, dist, obj := sc.hitAnything(r, nil)
+	if !hit || math.Abs(dist-5) > 1e-9 {
+		t.Fatalf("hit %v at %v, want the base at 5", hit, dist)
+	}
+	pt := r.PointAt(dist)
+	if normal := obj.Normal(pt, 0); normal.Sub(zAxis.Scale(-1)).Length() > 1e-9 {
+		t.Errorf("base normal %v, want -z", normal)
+	}
+	hit, dist, obj = sc.hitAnything(r.spawn(pt, r.Direction), obj)
+	if !hit || math.Abs(dist-0.6) > 1e-9 {
+		t.Fatalf("hit %v at %v, want the slanted face 0.6 further", hit, dist)
+	}
+	if normal := obj.Normal(pt, 0); normal.Sub(Vector3D{1, 1, 1}.Normalize()).Length() > 1e-9 {
+		t.Errorf("slanted face normal %v", normal)
+	}
+	if hit, _, _ = sc.hitAnything(Ray{Origin: Point3D{0.7, 0.7, 0}, Direction: zAxis}, nil); hit {
+		t.Errorf("ray past the slanted face hit the mesh")
+	}
+}
+
+// A glowing square found by sampling it and by scattering lights a point
+// below it as its form factor says
+func TestMeshEmitter(t *testing.T) {
+	rand.Seed(11)
+	sc := loadTestScene(t, `mesh {
+		triangle { <-1, 1, -1>, <1, 1, -1>, <1, 1, 1> }
+		triangle { <-1, 1, -1>, <1, 1, 1>, <-1, 1, 1> }
+		pigment { rgb 1 } finish { emission rgb 1 }
+	}`)
+	if len(sc.emitters) != 1 {
+		t.Fatalf("%d emitters, want the mesh", len(sc.emitters))
+	}
+	fin := defaultFinish()
+	fin.diffuse = 1
+	model, c := fin.bsdf(), white
+	pt, normal := Point3D{}, yAxis
+	const n = 200000
+	alone, mis := 0.0, 0.0
+	for i := 0; i < n; i++ {
+		alone += sc.directLight(nil, c, fin, pt, normal, normal, 0, 0).R
+		mis += sc.directLight(nil, c, fin, pt, normal, normal, 0, 1).R
+		dir, pdf := model.sample(c, normal, normal)
+		r := Ray{Origin: pt, Direction: dir}
+		if hit, dist, obj := sc.hitAnything(r, nil); hit {
+			e := sc.emitterFor(obj)
+			if e == nil {
+				t.Fatalf("no emitter for the face hit")
+			}
+			at := r.PointAt(dist)
+			weight := powerHeuristic(pdf, e.pdf(pt, at, obj.Normal(at, 0), 0))
+			shade := model.eval(c, normal, normal, dir)
+			mis += weight * shade.R / (math.Pi * pdf)
+		}
+	}
+	// Each quarter of the square is a unit rectangle one above pt
+	quarter := 2 * (math.Atan(1/math.Sqrt2) / math.Sqrt2) / (2 * math.Pi)
+	want := 4 * quarter
+	if got := alone / n; math.Abs(got-want) > 0.01*want {
+		t.Errorf("sampling the mesh gathers %v, want %v", got, want)
+	}
+	if got := mis / n; math.Abs(got-want) > 0.01*want {
+		t.Errorf("MIS gathers %v, want %v", got, want)
+	}
+}
+
+// uv mapped pigments follow the uv vectors across a face however the mesh
+// is placed, and beams are measured in uv units
+func TestMeshUV(t *testing.T) {
+	scanner := newPOVScanner(strings.NewReader(`mesh {
+		triangle { <0,0,0>, <1,0,0>, <0,1,0> uv_vectors <0.2,0.1>, <0.6,0.1>, <0.2,0.9> }
+		pigment { uv_mapping gradient x }
+		scale 2 translate <0, 0, 5>
+	}`), "test.pov")
+	defer scanner.Close()
+	scanner.Scan()
+	obj, _, err := parseObject(scanner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := &scene{objects: []castable{obj}}
+	for _, at := range []struct{ x, y, u, v float64 }{
+		{0.5, 0.5, 0.3, 0.3}, {1, 0.4, 0.4, 0.26}, {0.1, 1.6, 0.22, 0.74},
+	} {
+		r := Ray{Origin: Point3D{at.x, at.y, 0}, Direction: zAxis, Width: 0.1}
+		hit, dist, face := sc.hitAnything(r, nil)
+		if !hit {
+			t.Fatalf("missed the face at %v, %v", at.x, at.y)
+		}
+		pt := r.PointAt(dist)
+		mapped := face.(meshFace).mapped(pt, r)
+		if !mapped.HasUV || mapped.UV.Sub(Point3D{at.u, at.v, 0}).Length() > 1e-9 {
+			t.Errorf("uv at %v, %v is %v, want %v, %v", at.x, at.y, mapped.UV, at.u, at.v)
+		}
+		// The face is 2 across and its uv 0.4 and 0.8
+		if want := 0.1 * math.Sqrt(0.4*0.8/4); math.Abs(mapped.Width-want) > 1e-9 {
+			t.Errorf("beam %v wide in uv, want %v", mapped.Width, want)
+		}
+		if c := face.Color(pt, r); math.Abs(c.R-at.u) > 1e-9 {
+			t.Errorf("gradient at %v, %v is %v, want %v", at.x, at.y, c.R, at.u)
+		}
+	}
+	if _, err := parseTestMeshErr("{ triangle { <0,0,0>, <1,0,0>, <0,1,0> uv_vectors <0,0>, <1,0,0>, <0,1> } }"); err == nil {
+		t.Errorf("3 component uv vector accepted")
+	}
+}
+
+func parseTestMeshErr(src string) (castable, error) {
+	scanner := newPOVScanner(strings.NewReader(src), "test.pov")
+	defer scanner.Close()
+	return parseMesh(scanner)
+}
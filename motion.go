@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"github.com/go-gl/mathgl/mgl64"
+)
+
+// placement positions something in the world: fixed transforms, then any
+// number of motions, each followed by more fixed transforms
+type placement struct {
+	transforms mgl64.Mat4
+	inverse    mgl64.Mat4
+	moves      []move
+}
+
+type move struct {
+	motion *motion
+	after  mgl64.Mat4
+}
+
+// motion moves something between keyed transforms over time. Every key
+// lists the same transforms, whose values are interpolated between keys
+type motion struct {
+	times []float64
+	keys  [][]transformOp
+}
+
+// transformOp is a single translate, rotate or scale
+type transformOp struct {
+	kind string
+	vec  Vector3D
+}
+
+func makePlacement() placement {
+	return placement{transforms: mgl64.Ident4(), inverse: mgl64.Ident4()}
+}
+
+// parseTransform handles a transform or motion block, returning false if
+// the current token isn't one
+func (p *placement) parseTransform(scanner *povScanner) (bool, error) {
+	switch kind := scanner.Text(); kind {
+	case "translate", "rotate", "scale":
+		op, err := parseTransformOp(scanner, kind)
+		p.transform(op.matrix())
+		return true, err
+	case "motion":
+		mo, err := parseMotion(scanner)
+		if err != nil {
+			return true, err
+		}
+		if len(mo.times) == 1 {
+			// A single key never moves, so it's kept with the fixed
+			// transforms and their inverse
+			p.transform(mo.at(mo.times[0]))
+			return true, nil
+		}
+		p.moves = append(p.moves, move{motion: mo, after: mgl64.Ident4()})
+		return true, nil
+	}
+	return false, nil
+}
+
+// transform applies m after any transforms already there
+func (p *placement) transform(m mgl64.Mat4) {
+	if n := len(p.moves); n > 0 {
+		p.moves[n-1].after = m.Mul4(p.moves[n-1].after)
+		return
+	}
+	p.transforms = m.Mul4(p.transforms)
+	p.inverse = p.transforms.Inv()
+}
+
+// place applies all of other's transforms and motions after p's own
+func (p *placement) place(other *placement) {
+	p.transform(other.transforms)
+	for _, mv := range other.moves {
+		p.moves = append(p.moves, move{motion: mv.motion, after: mgl64.Ident4()})
+		p.transform(mv.after)
+	}
+}
+
+// at returns the transform and its inverse at time t. Without motions
+// they're the ones kept up to date by transform, so nothing is inverted
+func (p *placement) at(t float64) (m, inv mgl64.Mat4) {
+	if len(p.moves) == 0 {
+		return p.transforms, p.inverse
+	}
+	m = p.transforms
+	for _, mv := range p.moves {
+		m = mv.after.Mul4(mv.motion.at(t)).Mul4(m)
+	}
+	return m, m.Inv()
+}
+
+func parseMotion(scanner *povScanner) (*motion, error) {
+	if !scanner.Scan() || scanner.Text() != "{" {
+		return nil, errors.New("Missing '{' token")
+	}
+	mo := &motion{}
+	for scanner.Scan() {
+		switch token := scanner.Text(); token {
+		case "key":
+			t, err := parseFloat(scanner)
+			if err != nil {
+				return nil, err
+			}
+			if n := len(mo.times); n > 0 && t <= mo.times[n-1] {
+				return nil, errors.New("Motion keys must be in increasing time order")
+			}
+			mo.times = append(mo.times, t)
+			mo.keys = append(mo.keys, nil)
+		case "translate", "rotate", "scale":
+			if len(mo.keys) == 0 {
+				return nil, errors.New("Expected 'key' before '" + token + "' in motion")
+			}
+			op, err := parseTransformOp(scanner, token)
+			if err != nil {
+				return nil, err
+			}
+			last := len(mo.keys) - 1
+			mo.keys[last] = append(mo.keys[last], op)
+		case "}":
+			if len(mo.keys) == 0 {
+				return nil, errors.New("Motion needs at least one key")
+			}
+			for _, key := range mo.keys[1:] {
+				if !sameOps(key, mo.keys[0]) {
+					return nil, errors.New("Motion keys must list the same transforms")
+				}
+			}
+			return mo, nil
+		default:
+			return nil, errors.New("Unexpected token in motion: '" + token + "'")
+		}
+	}
+	return nil, eofErr
+}
+
+func sameOps(a, b []transformOp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].kind != b[i].kind {
+			return false
+		}
+	}
+	return true
+}
+
+// at interpolates between the keys either side of t, holding the first
+// and last keys outside their range
+func (mo *motion) at(t float64) mgl64.Mat4 {
+	i := 0
+	for i < len(mo.times)-1 && t > mo.times[i+1] {
+		i++
+	}
+	ops := mo.keys[i]
+	if i < len(mo.times)-1 && t > mo.times[i] {
+		frac := (t - mo.times[i]) / (mo.times[i+1] - mo.times[i])
+		ops = make([]transformOp, len(mo.keys[i]))
+		for j, op := range mo.keys[i] {
+			next := mo.keys[i+1][j].vec
+			ops[j] = transformOp{kind: op.kind,
+				vec: op.vec.Add(next.Sub(op.vec).Scale(frac))}
+		}
+	}
+	m := mgl64.Ident4()
+	for _, op := range ops {
+		m = op.matrix().Mul4(m)
+	}
+	return m
+}
+
+func parseTransformOp(scanner *povScanner, kind string) (transformOp, error) {
+	vec, err := parseVector(scanner)
+	if err == nil && kind == "scale" && (vec.X == 0 || vec.Y == 0 || vec.Z == 0) {
+		err = errors.New("Can't scale by zero")
+	}
+	return transformOp{kind: kind, vec: vec}, err
+}
+
+func (op transformOp) matrix() mgl64.Mat4 {
+	vec := op.vec
+	switch op.kind {
+	case "translate":
+		return mgl64.Translate3D(vec.X, vec.Y, vec.Z)
+	case "rotate":
+		return mgl64.HomogRotate3DZ(degToRad * vec.Z).Mul4(
+			mgl64.HomogRotate3DY(degToRad * vec.Y)).Mul4(
+			mgl64.HomogRotate3DX(degToRad * vec.X))
+	}
+	return mgl64.Scale3D(vec.X, vec.Y, vec.Z)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+)
+
+// perm is the shuffled lattice Perlin noise hashes with, repeated so
+// lookups can run past the end. Its seed is fixed so patterns stay put
+// from one render to the next
+var perm = func() (p [512]int) {
+	for i, v := range rand.New(rand.NewSource(1)).Perm(256) {
+		p[i], p[i+256] = v, v
+	}
+	return
+}()
+
+// noise is Perlin's improved gradient noise at pt, from -1 to 1, smooth
+// and repeating every 256 units
+func noise(pt Point3D) float64 {
+	fx, fy, fz := math.Floor(pt.X), math.Floor(pt.Y), math.Floor(pt.Z)
+	x, y, z := pt.X-fx, pt.Y-fy, pt.Z-fz
+	X, Y, Z := int(fx)&255, int(fy)&255, int(fz)&255
+	u, v, w := fade(x), fade(y), fade(z)
+
+	a, b := perm[X]+Y, perm[X+1]+Y
+	aa, ab, ba, bb := perm[a]+Z, perm[a+1]+Z, perm[b]+Z, perm[b+1]+Z
+	return lerp(w,
+		lerp(v,
+			lerp(u, grad(perm[aa], x, y, z), grad(perm[ba], x-1, y, z)),
+			lerp(u, grad(perm[ab], x, y-1, z), grad(perm[bb], x-1, y-1, z))),
+		lerp(v,
+			lerp(u, grad(perm[aa+1], x, y, z-1), grad(perm[ba+1], x-1, y, z-1)),
+			lerp(u, grad(perm[ab+1], x, y-1, z-1), grad(perm[bb+1], x-1, y-1, z-1))))
+}
+
+// noiseVector is a vector of three unrelated noises at pt
+func noiseVector(pt Point3D) Vector3D {
+	return Vector3D{X: noise(pt),
+		Y: noise(pt.Translate(Vector3D{31.4, 47.2, 12.9})),
+		Z: noise(pt.Translate(Vector3D{-19.7, 83.1, 57.3}))}
+}
+
+// fade eases t so the noise is smooth across lattice cells
+func fade(t float64) float64 {
+	return t * t * t * (t*(t*6-15) + 10)
+}
+
+func lerp(t, a, b float64) float64 {
+	return a + t*(b-a)
+}
+
+// grad picks one of twelve edge directions by hash and dots it with the
+// offset (x, y, z)
+func grad(hash int, x, y, z float64) float64 {
+	h := hash & 15
+	u, v := y, z
+	if h < 8 {
+		u = x
+	}
+	if h < 4 {
+		v = y
+	} else if h == 12 || h == 14 {
+		v = x
+	}
+	if h&1 != 0 {
+		u = -u
+	}
+	if h&2 != 0 {
+		v = -v
+	}
+	return u + v
+}
+
+// turbulence sums octaves of vector noise, each scaled by omega and with
+// its frequency multiplied by lambda from the one before
+func turbulence(pt Point3D, octaves int, omega, lambda float64) Vector3D {
+	sum := Vector3D{}
+	amp, freq := 1.0, 1.0
+	for i := 0; i < octaves; i++ {
+		p := Point3D{pt.X * freq, pt.Y * freq, pt.Z * freq}
+		sum = sum.Add(noiseVector(p).Scale(amp))
+		amp, freq = amp*omega, freq*lambda
+	}
+	return sum
+}
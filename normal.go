@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"github.com/go-gl/mathgl/mgl64"
+	"math"
+	"math/rand"
+)
+
+// normalPattern tilts a surface's normal by the slope of a height pattern,
+// so the surface shades, reflects and refracts as if it were bumpy
+type normalPattern struct {
+	pattern string
+	// amount scales how far the pattern tilts the normal
+	amount float64
+	// frequency and phase set the wavelength and offset of waves and ripples
+	frequency, phase float64
+	// accuracy is how far apart the pattern is sampled to find its slope
+	accuracy float64
+	// image is the height field of a bump_map or, for a normal_map, tangent
+	// space normals stored as colors
+	image *imageMap
+	placement
+}
+
+// waveSources are the centers waves and ripples spread out from. They're
+// fixed so the surface stays put from one render to the next
+var waveSources = func() (centers [10]Point3D) {
+	r := rand.New(rand.NewSource(2))
+	for i := range centers {
+		centers[i] = Point3D{r.Float64()*2 - 1, r.Float64()*2 - 1, r.Float64()*2 - 1}
+	}
+	return
+}()
+
+func makeNormalPattern() normalPattern {
+	return normalPattern{amount: 0.5, frequency: 1, accuracy: 0.02, placement: makePlacement()}
+}
+
+func parseNormal(scanner *povScanner) (normalPattern, error) {
+	if !scanner.Scan() || scanner.Text() != "{" {
+		return normalPattern{}, errors.New("Invalid normal structure")
+	}
+	np := makeNormalPattern()
+	var err error
+	for scanner.Scan() {
+		if isTransform, err := np.parseTransform(scanner); isTransform {
+			if err != nil {
+				return normalPattern{}, err
+			}
+			continue
+		}
+		token := scanner.Text()
+		switch token {
+		case "}":
+			return np, nil
+		case "normal":
+			// A #declare'd normal used as the starting point
+			np, err = parseNormal(scanner)
+		case "bumps", "dents", "wrinkles", "waves", "ripples":
+			np.pattern = token
+			err = np.parseAmount(scanner)
+		case "bump_map", "normal_map":
+			np.pattern, np.amount = token, 1
+			np.image, err = parseImageMap(scanner, nil)
+		case "frequency":
+			np.frequency, err = parseFloat(scanner)
+		case "phase":
+			np.phase, err = parseFloat(scanner)
+		case "accuracy":
+			if np.accuracy, err = parseFloat(scanner); err == nil && np.accuracy <= 0 {
+				err = errors.New("Normal accuracy must be positive")
+			}
+		default:
+			return normalPattern{}, errors.New("Unexpected token in normal: '" + token + "'")
+		}
+		if err != nil {
+			return normalPattern{}, err
+		}
+	}
+	return normalPattern{}, eofErr
+}
+
+// parseAmount reads the amount that can follow a pattern's name
+func (np *normalPattern) parseAmount(scanner *povScanner) error {
+	if !scanner.Scan() {
+		return eofErr
+	}
+	switch scanner.Text() {
+	case "}", "frequency", "phase", "accuracy", "normal", "translate", "rotate", "scale", "motion":
+		scanner.Unscan()
+		return nil
+	}
+	scanner.Unscan()
+	var err error
+	np.amount, err = parseFloat(scanner)
+	return err
+}
+
+// perturb tilts normal, the geometric normal where ray hits pt
+func (np *normalPattern) perturb(pt Point3D, normal Vector3D, ray Ray) Vector3D {
+	if np.pattern == "" || np.amount == 0 {
+		return normal
+	}
+	_, inv := np.placement.at(ray.Time)
+	p := pt.Transform(inv)
+	// Back to world space without the scaling, which would otherwise
+	// steepen patterns that are scaled down
+	toWorld := inv.Transpose()
+	unscale := 1 / math.Cbrt(math.Abs(inv.Det()))
+	footprint := ray.footprint(pt) / unscale
+	if np.pattern == "normal_map" {
+		return np.tangentNormal(p, normal, toWorld, unscale, footprint)
+	}
+	slope := np.slope(p, footprint).Transform(toWorld).Scale(unscale)
+	// Only the part of the slope along the surface tilts it
+	slope = slope.Sub(normal.Scale(slope.Dot(normal)))
+	return normal.Sub(slope.Scale(np.amount)).Normalize()
+}
+
+// slope is the gradient of the height pattern at p, differenced accuracy
+// apart. Image heights are differenced a pixel apart and give the rise per
+// pixel
+func (np *normalPattern) slope(p Point3D, footprint float64) Vector3D {
+	step, scale := np.accuracy, 1.0
+	if np.image != nil {
+		_, _, rate := np.image.project(p)
+		full := np.image.levels[0]
+		step = 1 / (rate * math.Max(float64(full.width), float64(full.height)))
+		scale = step * np.image.bumpSize
+	}
+	diff := func(axis Vector3D) float64 {
+		return (np.height(p.Translate(axis.Scale(step)), footprint) -
+			np.height(p.Translate(axis.Scale(-step)), footprint)) / (2 * step) * scale
+	}
+	return Vector3D{diff(xAxis), diff(yAxis), diff(zAxis)}
+}
+
+// height is the pattern's height at p, in the pattern's own space
+func (np *normalPattern) height(p Point3D, footprint float64) float64 {
+	switch np.pattern {
+	case "bumps":
+		return noise(p)
+	case "dents":
+		// Smooth ground with sharp pits where the noise is low
+		v := (noise(p) + 1) / 2
+		return v * v * v
+	case "wrinkles":
+		sum, freq := 0.0, 1.0
+		for i := 0; i < 10; i++ {
+			sum += math.Abs(noise(Point3D{p.X * freq, p.Y * freq, p.Z * freq})) / freq
+			freq *= 2
+		}
+		return sum
+	case "ripples", "waves":
+		// Ripples from every source share a wavelength. Waves get longer
+		// from one source to the next, more like a swell
+		sum := 0.0
+		for i, center := range waveSources {
+			freq := np.frequency
+			if np.pattern == "waves" {
+				freq /= 1 + float64(i)/float64(len(waveSources))
+			}
+			k := 2 * math.Pi * freq
+			sum += math.Sin(k*p.Dist(center)+2*math.Pi*np.phase) / k
+		}
+		return sum / float64(len(waveSources))
+	case "bump_map":
+		c := np.image.at(p, footprint)
+		return 0.299*c.R + 0.587*c.G + 0.114*c.B
+	}
+	return 0
+}
+
+// tangentNormal reads a normal map, whose red and green run along the
+// directions the image's u and v increase in and whose blue is along the
+// normal. amount scales the tilt
+func (np *normalPattern) tangentNormal(p Point3D, normal Vector3D, toWorld mgl64.Mat4, unscale,
+	footprint float64) Vector3D {
+	u, v, rate := np.image.project(p)
+	step := 1e-3 / rate
+	gradient := func(axis Vector3D) (du, dv float64) {
+		u1, v1, _ := np.image.project(p.Translate(axis.Scale(step)))
+		// Across the seam u jumps by a whole turn
+		return u1 - u - math.Floor(u1-u+0.5), v1 - v
+	}
+	ux, vx := gradient(xAxis)
+	uy, vy := gradient(yAxis)
+	uz, vz := gradient(zAxis)
+	along := func(g Vector3D) Vector3D {
+		g = g.Transform(toWorld).Scale(unscale)
+		g = g.Sub(normal.Scale(g.Dot(normal)))
+		if g.Length() < exprEpsilon {
+			return Vector3D{}
+		}
+		return g.Normalize()
+	}
+	tangent, bitangent := along(Vector3D{ux, uy, uz}), along(Vector3D{vx, vy, vz})
+	c := np.image.at(p, footprint)
+	tilted := tangent.Scale((2*c.R - 1) * np.amount).Add(bitangent.Scale((2*c.G - 1) * np.amount)).
+		Add(normal.Scale(2*c.B - 1))
+	if tilted.Length() < exprEpsilon {
+		return normal
+	}
+	return tilted.Normalize()
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Render modes, picked with -mode
+const (
+	whittedMode = "whitted"
+	pathMode    = "path"
+)
+
+// Paths may end by Russian roulette once they've bounced rouletteDepth
+// times, and always end after pathMaxDepth
+const (
+	rouletteDepth = 3
+	pathMaxDepth  = 64
+)
+
+// bounce is where a path last scattered diffusely, and how likely the
+// direction it left in was, so lights it finds by chance can be weighed
+// against those found by sampling them
+type bounce struct {
+	pt  Point3D
+	pdf float64
+}
+
+// tracePath follows ray on a random walk through the scene, gathering the
+// light that reaches the eye along it. Each surface scatters the path one
+// way, picked at random by the share of light it sends that way, and
+// lights are sampled directly wherever it scatters diffusely
+func (sc *scene) tracePath(ray Ray) fColor {
+	radiance, throughput := fColor{A: 1}, white
+	var skip castable
+	var from *bounce
+	for depth := 0; depth < pathMaxDepth; depth++ {
+		hit, t, obj := sc.hitAnything(ray, skip)
+		if from != nil {
+			radiance = radiance.Add(sc.lightsHit(ray, from, hit, t).Tint(throughput))
+		}
+		if len(sc.fogs) > 0 {
+			// Fog lays its color over what lies beyond it along the way
+			dist := math.Inf(1)
+			if hit {
+				dist = t
+			}
+			through, glow := fogAlong(sc.fogs, ray, dist)
+			radiance = radiance.Add(glow.Tint(throughput))
+			throughput = throughput.Scale(through)
+		}
+		if !hit {
+			// Sky found by scattering is weighed against sampling it
+			light := sc.sky.at(ray)
+			if sampler := sc.sky.sampler; sampler != nil && from != nil {
+				light = light.Scale(powerHeuristic(from.pdf, sampler.pdf(ray.Direction)))
+			}
+			return radiance.Add(light.Tint(throughput))
+		}
+		pt := ray.PointAt(t)
+		normal := obj.Perturb(pt, obj.Normal(pt, ray.Time), ray)
+		fin := obj.Finish(pt, ray)
+		if in := obj.Interior(); in.disperses() && ray.Wavelength == 0 && fin.refraction > 0 {
+			// Carry on with a single wavelength, tinted by its color
+			wavelengths, tints := spectrum(in.dispersionSamples)
+			band := rand.Intn(len(wavelengths))
+			ray.Wavelength = wavelengths[band]
+			throughput = throughput.Tint(tints[band]).Scale(float64(len(tints)))
+		}
+		reflectAmt, refractAmt, refractRay, exiting := split(ray, obj, pt, normal)
+		if exiting {
+			throughput = throughput.Tint(obj.Interior().fade(t))
+		}
+		c := obj.Color(pt, ray)
+		if !exiting && !fin.emission.isBlack() {
+			// Emitters found by scattering are weighed against sampling them
+			glow := emitted(fin, c)
+			if e := sc.emitterFor(obj); e != nil && from != nil {
+				lightPdf := e.pdf(from.pt, pt, obj.Normal(pt, ray.Time), ray.Time)
+				glow = glow.Scale(powerHeuristic(from.pdf, lightPdf))
+			}
+			radiance = radiance.Add(glow.Tint(throughput))
+		}
+		from = nil
+		// Transmitted light passes straight through the pigment, and
+		// filtered light is refracted and takes on its color
+		if pick := rand.Float64(); pick < c.T {
+			ray, skip = ray.spawn(pt, ray.Direction), obj
+			continue
+		} else if pick < 1-c.A {
+			throughput = throughput.Tint(c)
+			n1, n2, _ := iors(ray, obj, normal)
+			if internal, refracted := calcRefractRay(ray, normal, pt, n1, n2); internal {
+				ray, skip = reflectOff(ray, obj, pt, normal, exiting)
+			} else if ray, skip = refracted, obj; !exiting {
+				skip = nil
+			}
+			continue
+		}
+
+		facing := normal
+		if exiting {
+			facing = normal.Scale(-1)
+		}
+		view := ray.Direction.Scale(-1)
+		model := fin.bsdf()
+		local := model.albedo(c)
+		total := local + reflectAmt + refractAmt
+		if total <= 0 {
+			return radiance
+		}
+		pLocal := local / total
+		if local > 0 {
+			radiance = radiance.Add(sc.directLight(obj, c, fin, pt, facing, view, ray.Time, pLocal).
+				Tint(throughput))
+			// Lights seen through mirrors and lenses only arrive as photons
+			caustic := sc.caustics(pt, facing).Scale(fin.diffuse)
+			radiance = radiance.Add(caustic.Tint(c).Tint(throughput))
+		}
+
+		switch pick := rand.Float64() * total; {
+		case pick < local:
+			dir, pdf := model.sample(c, facing, view)
+			shade := model.eval(c, facing, view, dir)
+			if pdf <= 0 || shade.isBlack() {
+				return radiance
+			}
+			throughput = throughput.Tint(shade).Scale(1 / (math.Pi * pLocal * pdf))
+			from = &bounce{pt: pt, pdf: pLocal * pdf}
+			ray, skip = ray.spawn(pt, dir), obj
+		case pick < local+reflectAmt:
+			ray, skip = reflectOff(ray, obj, pt, normal, exiting)
+			throughput = throughput.Scale(total)
+		default:
+			ray, skip = refractRay, obj
+			// Rays heading inside need to find the object's far side
+			if !exiting {
+				skip = nil
+			}
+			throughput = throughput.Scale(total)
+		}
+
+		if depth >= rouletteDepth {
+			survive := math.Min(0.95, math.Max(throughput.R, math.Max(throughput.G, throughput.B)))
+			if rand.Float64() >= survive {
+				return radiance
+			}
+			throughput = throughput.Scale(1 / survive)
+		}
+	}
+	return radiance
+}
+
+// reflectOff is ray reflected where it hits obj at pt, and the object it
+// must skip
+func reflectOff(ray Ray, obj castable, pt Point3D, normal Vector3D, exiting bool) (Ray, castable) {
+	reflection := ray.Direction.Sub(normal.Scale(2 * ray.Direction.Dot(normal))).Normalize()
+	if exiting {
+		// Reflected back inside, where the object's far side may be hit
+		r := ray.spawn(pt, reflection)
+		r.Origin = pt.Translate(reflection.Scale(0.01))
+		return r, nil
+	}
+	return ray.spawn(pt, reflection), obj
+}
+
+// directLight is the light reaching pt straight from every light, emitter
+// and the sky, sent towards view by a surface of color c and finish fin.
+// Area lights, emitters and the sky are sampled at random, weighed against
+// the chance of the path finding the same direction by scattering, pLocal
+// times the BSDF's pdf
+func (sc *scene) directLight(obj castable, c fColor, fin finish, pt Point3D, normal, view Vector3D,
+	time, pLocal float64) fColor {
+	sum := fColor{A: 1}
+	model := fin.bsdf()
+	for i := range sc.lights {
+		l := &sc.lights[i]
+		intensity := l.intensity(pt, time)
+		if intensity <= 0 {
+			continue
+		}
+		lightPt, lightPdf := l.towards(pt, time), 0.0
+		if l.area != nil {
+			lightPt, lightPdf = l.sampleArea(pt, time)
+		}
+		L := lightPt.Sub(pt).Normalize()
+		shade := model.eval(c, normal, view, L)
+		if shade.isBlack() {
+			continue
+		}
+		lit := sc.shadowFilter(pt, time, lightPt, obj, true)
+		if lit.isBlack() {
+			continue
+		}
+		// Only light with a clear path could also have been found by
+		// scattering
+		weight := 1.0
+		if lightPdf > 0 && lit == white {
+			weight = powerHeuristic(lightPdf, pLocal*model.pdf(c, normal, view, L))
+		}
+		sum = sum.Add(l.color.Tint(lit).Tint(shade).Scale(intensity * weight))
+	}
+	for i := range sc.emitters {
+		e := &sc.emitters[i]
+		if e.is(obj) {
+			continue
+		}
+		L, light, lightPdf, lit := sc.sampleEmitter(e, pt, rand.Float64(), rand.Float64(), time, obj)
+		if lightPdf <= 0 || lit.isBlack() {
+			continue
+		}
+		shade := model.eval(c, normal, view, L)
+		weight := 1.0
+		if lit == white {
+			weight = powerHeuristic(lightPdf, pLocal*model.pdf(c, normal, view, L))
+		}
+		sum = sum.Add(light.Tint(lit).Tint(shade).Scale(weight / (math.Pi * lightPdf)))
+	}
+	if sampler := sc.sky.sampler; sampler != nil {
+		L, skyPdf := sampler.sample()
+		if shade := model.eval(c, normal, view, L); skyPdf > 0 && !shade.isBlack() {
+			lit := sc.shadowFilter(pt, time, pt.Translate(L.Scale(skyDistance)), obj, false)
+			weight := 1.0
+			if lit == white {
+				weight = powerHeuristic(skyPdf, pLocal*model.pdf(c, normal, view, L))
+			}
+			light := sc.sky.at(Ray{Origin: pt, Direction: L, Time: time})
+			sum = sum.Add(light.Tint(lit).Tint(shade).Scale(weight / (math.Pi * skyPdf)))
+		}
+	}
+	return sum
+}
+
+// lightsHit is the light from any area light that ray, scattered from
+// the bounce, reaches before the nearest object at t
+func (sc *scene) lightsHit(ray Ray, from *bounce, hit bool, t float64) fColor {
+	sum := fColor{A: 1}
+	for i := range sc.lights {
+		l := &sc.lights[i]
+		dist, cosLight, ok := l.hitPanel(ray)
+		if !ok || (hit && dist >= t) {
+			continue
+		}
+		intensity := l.intensity(from.pt, ray.Time)
+		if intensity <= 0 {
+			continue
+		}
+		lightPdf := l.panelPdf(dist, cosLight, ray.Time)
+		weight := powerHeuristic(from.pdf, lightPdf)
+		sum = sum.Add(l.color.Scale(math.Pi * intensity * weight * lightPdf))
+	}
+	return sum
+}
+
+// cosineSample picks a direction about normal, more likely the nearer it
+// is to the normal, with pdf cos / pi
+func cosineSample(normal Vector3D) Vector3D {
+	r, phi := math.Sqrt(rand.Float64()), 2*math.Pi*rand.Float64()
+	u, v := orthoBasis(normal)
+	return u.Scale(r * math.Cos(phi)).Add(v.Scale(r * math.Sin(phi))).
+		Add(normal.Scale(math.Sqrt(math.Max(0, 1-r*r)))).Normalize()
+}
+
+// orthoBasis is a pair of unit vectors at right angles to n and each other
+func orthoBasis(n Vector3D) (u, v Vector3D) {
+	other := xAxis
+	if math.Abs(n.X) > 0.9 {
+		other = yAxis
+	}
+	u = n.Cross(other).Normalize()
+	return u, n.Cross(u)
+}
+
+// powerHeuristic weighs a sample from the strategy with pdf a against the
+// other with pdf b
+func powerHeuristic(a, b float64) float64 {
+	if math.IsInf(a, 1) {
+		return 1
+	}
+	if a+b == 0 {
+		return 0
+	}
+	return a * a / (a*a + b*b)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// loadTestScene parses src as a scene file for the path tracer
+func loadTestScene(t *testing.T, src string) *scene {
+	path := filepath.Join(t.TempDir(), "test.pov")
+	if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mode := renderMode
+	renderMode = pathMode
+	defer func() { renderMode = mode }()
+	sc, err := loadScene(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sc
+}
+
+func TestPowerHeuristic(t *testing.T) {
+	for _, pdfs := range [][2]float64{{1, 1}, {0.1, 3}, {5, 0}, {1e-6, 1e6}} {
+		a, b := pdfs[0], pdfs[1]
+		if sum := powerHeuristic(a, b) + powerHeuristic(b, a); math.Abs(sum-1) > 1e-12 {
+			t.Errorf("weights for %v and %v sum to %v", a, b, sum)
+		}
+	}
+	if got := powerHeuristic(math.Inf(1), 2); got != 1 {
+		t.Errorf("a delta sample is weighed %v", got)
+	}
+	if got := powerHeuristic(0, 0); got != 0 {
+		t.Errorf("two impossible samples are weighed %v", got)
+	}
+}
+
+// A direction towards an area light has the same pdf whether it was found
+// by sampling the light or by hitting it, so the two weights make 1
+func TestAreaLightWeights(t *testing.T) {
+	rand.Seed(8)
+	sc := loadTestScene(t, "light_source { <0, 2, 0> rgb 1 area_light <2, 0, 0>, <0, 0, 1>, 4, 4 rotate x*20 }")
+	l := &sc.lights[0]
+	fin := defaultFinish()
+	model, c := fin.bsdf(), white
+	pt := Point3D{0.3, 0, -0.2}
+	for i := 0; i < 1000; i++ {
+		lightPt, lightPdf := l.sampleArea(pt, 0)
+		L := lightPt.Sub(pt).Normalize()
+		dist, cosLight, ok := l.hitPanel(Ray{Origin: pt, Direction: L})
+		if !ok {
+			t.Fatalf("the ray to %v misses the light", lightPt)
+		}
+		if hitPdf := l.panelPdf(dist, cosLight, 0); math.Abs(hitPdf-lightPdf) > 1e-9*lightPdf {
+			t.Fatalf("pdf %v sampling the light, %v hitting it", lightPdf, hitPdf)
+		}
+		bsdfPdf := model.pdf(c, yAxis, yAxis, L)
+		if sum := powerHeuristic(lightPdf, bsdfPdf) + powerHeuristic(bsdfPdf, lightPdf); math.Abs(sum-1) > 1e-12 {
+			t.Fatalf("weights sum to %v", sum)
+		}
+	}
+}
+
+// directLight and lightsHit share an area light's light between them: the
+// light sampled with MIS plus the light found by scattering add up to all
+// of it sampled alone
+func TestAreaLightMIS(t *testing.T) {
+	rand.Seed(9)
+	sc := loadTestScene(t, "light_source { <0, 2, 0> rgb 1 area_light <2, 0, 0>, <0, 0, 2>, 4, 4 }")
+	fin := defaultFinish()
+	fin.diffuse = 1
+	model, c := fin.bsdf(), white
+	pt, normal := Point3D{1, 0, 0}, yAxis
+	const n = 400000
+	alone, mis := 0.0, 0.0
+	for i := 0; i < n; i++ {
+		alone += sc.directLight(nil, c, fin, pt, normal, normal, 0, 0).R
+		mis += sc.directLight(nil, c, fin, pt, normal, normal, 0, 1).R
+		dir, pdf := model.sample(c, normal, normal)
+		shade := model.eval(c, normal, normal, dir)
+		from := &bounce{pt: pt, pdf: pdf}
+		hit := sc.lightsHit(Ray{Origin: pt, Direction: dir}, from, false, 0)
+		mis += hit.R * shade.R / (math.Pi * pdf)
+	}
+	alone, mis = alone/n, mis/n
+	if math.Abs(mis-alone) > 0.02*alone {
+		t.Errorf("MIS gathers %v, sampling the light alone %v", mis, alone)
+	}
+}
+
+// A white furnace: a diffuse sphere under an even white sky sends back
+// its diffuse share of the light, whether sky or bounce found it
+func TestPathFurnace(t *testing.T) {
+	rand.Seed(10)
+	sc := loadTestScene(t, `background { color rgb 1 }
+		sphere { <0, 0, 0>, 1 pigment { color rgb 1 } finish { ambient 0 diffuse 0.5 } }`)
+	const n = 20000
+	sum := 0.0
+	for i := 0; i < n; i++ {
+		x := rand.Float64()*1.6 - 0.8
+		sum += sc.tracePath(Ray{Origin: Point3D{x, 0, -5}, Direction: zAxis}).R
+	}
+	if got := sum / n; math.Abs(got-0.5) > 0.01 {
+		t.Errorf("furnace sphere sends back %v, want 0.5", got)
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// photonSettings come from global_settings { photons { ... } }. count
+// photons are shot in all, and each is gathered within radius of a point
+type photonSettings struct {
+	count  int
+	radius float64
+}
+
+// photonOptions are an object's photons { ... } block. Photons are aimed
+// at targets, and only bounce off and pass through surfaces that allow
+// it. Surfaces that don't collect keep no photons
+type photonOptions struct {
+	target                          bool
+	reflection, refraction, collect bool
+}
+
+// photon is light that reached pos along dir after reflection or
+// refraction. axis is how its kd-tree node splits space
+type photon struct {
+	pos   Point3D
+	dir   Vector3D
+	power fColor
+	axis  int
+}
+
+// photonMap is a kd-tree of photons kept in a single slice. Each range of
+// it is split at its middle photon, with those before it lower along its
+// axis and those after higher
+type photonMap []photon
+
+func makePhotonOptions() photonOptions {
+	return photonOptions{reflection: true, refraction: true, collect: true}
+}
+
+func parsePhotonSettings(scanner *povScanner) (*photonSettings, error) {
+	if !scanner.Scan() || scanner.Text() != "{" {
+		return nil, errors.New("Missing '{' token")
+	}
+	ps := &photonSettings{count: 20000, radius: 0.25}
+	var err error
+	for scanner.Scan() {
+		token := scanner.Text()
+		switch token {
+		case "}":
+			return ps, nil
+		case "count":
+			ps.count, err = parseCount(scanner, token)
+		case "radius":
+			ps.radius, err = parseFloat(scanner)
+			if err == nil && ps.radius <= 0 {
+				err = errors.New("Photon radius must be positive")
+			}
+		default:
+			return nil, errors.New("Unexpected token in photons: '" + token + "'")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, eofErr
+}
+
+func (obj *object) parsePhotons(scanner *povScanner) error {
+	if !scanner.Scan() || scanner.Text() != "{" {
+		return errors.New("Missing '{' token")
+	}
+	var err error
+	for scanner.Scan() {
+		token := scanner.Text()
+		switch token {
+		case "}":
+			return nil
+		case "target":
+			obj.photons.target = true
+		case "reflection":
+			obj.photons.reflection, err = parseToggle(scanner)
+		case "refraction":
+			obj.photons.refraction, err = parseToggle(scanner)
+		case "collect":
+			obj.photons.collect, err = parseToggle(scanner)
+		default:
+			return errors.New("Unexpected token in photons: '" + token + "'")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return eofErr
+}
+
+// buildPhotonMap shoots photons from every light at every target, sharing
+// the count out evenly, and keeps those that land on diffuse surfaces
+// after being reflected or refracted
+func (sc *scene) buildPhotonMap() {
+	ps := sc.settings.photons
+	if ps == nil || len(sc.lights) == 0 {
+		return
+	}
+	var targets []castable
+	for _, obj := range sc.objects {
+		if obj.base().photons.target {
+			targets = append(targets, obj)
+		}
+	}
+	if len(targets) == 0 {
+		return
+	}
+	time := sc.eye.shutterOpen
+	n := maxInt(1, ps.count/(len(sc.lights)*len(targets)))
+	var photons photonMap
+	for i := range sc.lights {
+		for _, target := range targets {
+			if lo, hi, ok := worldBounds(target, time); ok {
+				center := lo.Translate(hi.Sub(lo).Scale(0.5))
+				photons = sc.shootPhotons(photons, &sc.lights[i], center, hi.Dist(lo)/2, n, time)
+			}
+		}
+	}
+	photons.build(0, len(photons))
+	sc.photons = photons
+}
+
+// shootPhotons sends n photons from l at the sphere around center. Each
+// carries the share of the light falling on that sphere, which like the
+// light itself doesn't weaken with distance
+func (sc *scene) shootPhotons(photons photonMap, l *light, center Point3D, radius float64,
+	n int, time float64) photonMap {
+	for i := 0; i < n; i++ {
+		var ray Ray
+		var spread float64
+		if l.parallel || l.kind == cylinderLight {
+			// Shine along the axis through a disk across the sphere
+			axis := l.axis(time)
+			u, v := orthoBasis(axis)
+			r, phi := radius*math.Sqrt(rand.Float64()), 2*math.Pi*rand.Float64()
+			across := center.Translate(u.Scale(r * math.Cos(phi))).Translate(v.Scale(r * math.Sin(phi)))
+			ray = Ray{Origin: l.towards(across, time), Direction: axis}
+			spread = math.Pi * radius * radius
+		} else {
+			origin := l.position(time)
+			if l.area != nil {
+				origin, _ = l.sampleArea(center, time)
+			}
+			var solidAngle float64
+			ray.Origin = origin
+			ray.Direction, solidAngle = coneSample(center.Sub(origin), radius)
+			spread = solidAngle
+		}
+		ray.Time = time
+		hit, t, obj := sc.hitAnything(ray, nil)
+		if !hit {
+			continue
+		}
+		if !l.parallel && l.kind != cylinderLight {
+			spread *= t * t
+		}
+		intensity := l.intensity(ray.PointAt(t), time)
+		if intensity <= 0 {
+			continue
+		}
+		photons = sc.tracePhoton(photons, ray, l.color.Scale(intensity*spread/float64(n)), hit, t, obj)
+	}
+	return photons
+}
+
+// coneSample picks a direction evenly within the cone from the tip of
+// toCenter that just holds a sphere of radius at its end, and the solid
+// angle of the cone. From inside the sphere, any direction will do
+func coneSample(toCenter Vector3D, radius float64) (Vector3D, float64) {
+	dist := toCenter.Length()
+	cosMax := -1.0
+	if dist > radius {
+		cosMax = math.Sqrt(1 - (radius/dist)*(radius/dist))
+	}
+	cos := 1 - rand.Float64()*(1-cosMax)
+	sin, phi := math.Sqrt(math.Max(0, 1-cos*cos)), 2*math.Pi*rand.Float64()
+	axis := zAxis
+	if dist > 0 {
+		axis = toCenter.Scale(1 / dist)
+	}
+	u, v := orthoBasis(axis)
+	dir := u.Scale(sin * math.Cos(phi)).Add(v.Scale(sin * math.Sin(phi))).Add(axis.Scale(cos))
+	return dir.Normalize(), 2 * math.Pi * (1 - cosMax)
+}
+
+// tracePhoton follows a photon that first hits obj at t. It's dropped
+// unless it's reflected or refracted there, then stored on each diffuse
+// surface it reaches while it keeps bouncing. Russian roulette decides
+// whether it carries on, and which way
+func (sc *scene) tracePhoton(photons photonMap, ray Ray, power fColor, hit bool, t float64,
+	obj castable) photonMap {
+	for depth := 0; hit && depth < MAX_DEPTH; depth++ {
+		pt := ray.PointAt(t)
+		opts, fin := obj.base().photons, obj.Finish(pt, ray)
+		if depth > 0 && opts.collect && fin.diffuse > 0 {
+			photons = append(photons, photon{pos: pt, dir: ray.Direction, power: power})
+		}
+		normal := obj.Perturb(pt, obj.Normal(pt, ray.Time), ray)
+		if in := obj.Interior(); in.disperses() && ray.Wavelength == 0 && fin.refraction > 0 {
+			wavelengths, tints := spectrum(in.dispersionSamples)
+			band := rand.Intn(len(wavelengths))
+			ray.Wavelength = wavelengths[band]
+			power = power.Tint(tints[band]).Scale(float64(len(tints)))
+		}
+		reflectAmt, refractAmt, refractRay, exiting := split(ray, obj, pt, normal)
+		if exiting {
+			power = power.Tint(obj.Interior().fade(t))
+		}
+		if !opts.reflection {
+			reflectAmt = 0
+		}
+		if !opts.refraction {
+			refractAmt = 0
+		}
+		total := reflectAmt + refractAmt
+		survive := math.Min(1, total)
+		if total <= 0 || rand.Float64() >= survive {
+			break
+		}
+		power = power.Scale(total / survive)
+		var skip castable = obj
+		if rand.Float64()*total < reflectAmt {
+			reflection := ray.Direction.Sub(normal.Scale(2 * ray.Direction.Dot(normal))).Normalize()
+			ray = ray.spawn(pt, reflection)
+			if exiting {
+				ray.Origin, skip = pt.Translate(reflection.Scale(0.01)), nil
+			}
+		} else {
+			ray = refractRay
+			if !exiting {
+				skip = nil
+			}
+		}
+		hit, t, obj = sc.hitAnything(ray, skip)
+	}
+	return photons
+}
+
+// build makes photons[lo:hi] into a kd-tree, split at each level along
+// the axis the photons spread furthest on
+func (pm photonMap) build(lo, hi int) {
+	if hi-lo < 2 {
+		return
+	}
+	min, max := pm[lo].pos, pm[lo].pos
+	for _, p := range pm[lo+1 : hi] {
+		min = Point3D{math.Min(min.X, p.pos.X), math.Min(min.Y, p.pos.Y), math.Min(min.Z, p.pos.Z)}
+		max = Point3D{math.Max(max.X, p.pos.X), math.Max(max.Y, p.pos.Y), math.Max(max.Z, p.pos.Z)}
+	}
+	extent := max.Sub(min)
+	axis := 0
+	if extent.Y > extent.X {
+		axis = 1
+	}
+	if extent.Z > coord(extent, axis) {
+		axis = 2
+	}
+	part := pm[lo:hi]
+	sort.Slice(part, func(i, j int) bool {
+		return coord(part[i].pos.AsVector(), axis) < coord(part[j].pos.AsVector(), axis)
+	})
+	mid := (lo + hi) / 2
+	pm[mid].axis = axis
+	pm.build(lo, mid)
+	pm.build(mid+1, hi)
+}
+
+// gather calls visit for every photon within radius of pt
+func (pm photonMap) gather(pt Point3D, radius float64, visit func(p *photon)) {
+	pm.search(0, len(pm), pt, radius*radius, visit)
+}
+
+func (pm photonMap) search(lo, hi int, pt Point3D, radius2 float64, visit func(p *photon)) {
+	if lo >= hi {
+		return
+	}
+	mid := (lo + hi) / 2
+	p := &pm[mid]
+	d := coord(pt.AsVector(), p.axis) - coord(p.pos.AsVector(), p.axis)
+	near, far := [2]int{lo, mid}, [2]int{mid + 1, hi}
+	if d > 0 {
+		near, far = far, near
+	}
+	pm.search(near[0], near[1], pt, radius2, visit)
+	if d*d < radius2 {
+		pm.search(far[0], far[1], pt, radius2, visit)
+	}
+	if diff := pt.Sub(p.pos); diff.Dot(diff) < radius2 {
+		visit(p)
+	}
+}
+
+func coord(vec Vector3D, axis int) float64 {
+	switch axis {
+	case 0:
+		return vec.X
+	case 1:
+		return vec.Y
+	}
+	return vec.Z
+}
+
+// caustics is the light reflected and refracted onto the side of pt that
+// normal faces, from the photons around it, as the light a lamp facing the
+// surface would give
+func (sc *scene) caustics(pt Point3D, normal Vector3D) fColor {
+	sum := fColor{A: 1}
+	if len(sc.photons) == 0 {
+		return sum
+	}
+	radius := sc.settings.photons.radius
+	sc.photons.gather(pt, radius, func(p *photon) {
+		if p.dir.Dot(normal) < 0 {
+			sum = sum.Add(p.power)
+		}
+	})
+	return sum.Scale(1 / (math.Pi * radius * radius))
+}
+
+// worldBounds is the box holding obj as placed at time t, if it's bounded
+func worldBounds(obj castable, t float64) (lo, hi Point3D, ok bool) {
+	var min, max Point3D
+	switch o := obj.(type) {
+	case *sphere:
+		r := Vector3D{o.radius, o.radius, o.radius}
+		min, max = o.center.Translate(r.Scale(-1)), o.center.Translate(r)
+	case *box:
+		min, max = o.corner1, o.corner2
+	case *mesh:
+		min, max = o.lo, o.hi
+	case *csg:
+		return o.bounds(t)
+	default:
+		return lo, hi, false
+	}
+	m, _ := obj.base().at(t)
+	for i := 0; i < 8; i++ {
+		corner := min
+		if i&1 != 0 {
+			corner.X = max.X
+		}
+		if i&2 != 0 {
+			corner.Y = max.Y
+		}
+		if i&4 != 0 {
+			corner.Z = max.Z
+		}
+		corner = corner.Transform(m)
+		if i == 0 {
+			lo, hi = corner, corner
+		}
+		lo = Point3D{math.Min(lo.X, corner.X), math.Min(lo.Y, corner.Y), math.Min(lo.Z, corner.Z)}
+		hi = Point3D{math.Max(hi.X, corner.X), math.Max(hi.Y, corner.Y), math.Max(hi.Z, corner.Z)}
+	}
+	return lo, hi, true
+}
+
+// bounds holds every child of a union or merge, the overlap of bounded
+// children of an intersection, and the first child of a difference
+func (c *csg) bounds(t float64) (lo, hi Point3D, ok bool) {
+	if c.op == "difference" {
+		return worldBounds(c.children[0], t)
+	}
+	for _, child := range c.children {
+		clo, chi, cok := worldBounds(child, t)
+		switch {
+		case !cok && c.op == "intersection":
+			continue
+		case !cok:
+			return lo, hi, false
+		case !ok:
+			lo, hi, ok = clo, chi, true
+		case c.op == "intersection":
+			lo = Point3D{math.Max(lo.X, clo.X), math.Max(lo.Y, clo.Y), math.Max(lo.Z, clo.Z)}
+			hi = Point3D{math.Min(hi.X, chi.X), math.Min(hi.Y, chi.Y), math.Min(hi.Z, chi.Z)}
+		default:
+			lo = Point3D{math.Min(lo.X, clo.X), math.Min(lo.Y, clo.Y), math.Min(lo.Z, clo.Z)}
+			hi = Point3D{math.Max(hi.X, chi.X), math.Max(hi.Y, chi.Y), math.Max(hi.Z, chi.Z)}
+		}
+	}
+	return
+}
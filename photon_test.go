@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// gather finds the same photons as checking every one of them, including
+// photons sharing a position or lying on a splitting plane
+func TestPhotonGather(t *testing.T) {
+	rand.Seed(11)
+	var pm photonMap
+	for i := 0; i < 3000; i++ {
+		pos := Point3D{rand.Float64() * 4, rand.Float64(), rand.Float64() * 2}
+		if i%5 == 0 {
+			// Clumped onto a coarse grid
+			pos = Point3D{math.Floor(pos.X), math.Floor(pos.Y * 4), math.Floor(pos.Z)}
+		}
+		pm = append(pm, photon{pos: pos, power: fColor{R: float64(i), A: 1}})
+	}
+	pm.build(0, len(pm))
+	for i := 0; i < 200; i++ {
+		pt := Point3D{rand.Float64()*5 - 0.5, rand.Float64()*4 - 0.5, rand.Float64()*3 - 0.5}
+		if i%4 == 0 {
+			pt = pm[rand.Intn(len(pm))].pos
+		}
+		radius := 0.05 + rand.Float64()*0.6
+		var found, want []float64
+		pm.gather(pt, radius, func(p *photon) { found = append(found, p.power.R) })
+		for _, p := range pm {
+			if p.pos.Dist(pt) < radius {
+				want = append(want, p.power.R)
+			}
+		}
+		sort.Float64s(found)
+		sort.Float64s(want)
+		if len(found) != len(want) {
+			t.Fatalf("%v within %v: gathered %v photons, want %v", pt, radius, len(found), len(want))
+		}
+		for j := range found {
+			if found[j] != want[j] {
+				t.Fatalf("%v within %v: gathered photon %v, want %v", pt, radius, found[j], want[j])
+			}
+		}
+	}
+}
+
+// Photons spread evenly over a floor light it as their power per area,
+// from the side they arrive on only
+func TestCaustics(t *testing.T) {
+	rand.Seed(12)
+	sc := &scene{settings: globalSettings{photons: &photonSettings{radius: 0.5}}}
+	const n, side = 200000, 10.0
+	for i := 0; i < n; i++ {
+		pos := Point3D{rand.Float64() * side, 0, rand.Float64() * side}
+		sc.photons = append(sc.photons, photon{pos: pos, dir: Vector3D{0, -1, 0},
+			power: fColor{R: 1, G: 0.5, B: 0.25, A: 1}})
+	}
+	sc.photons.build(0, n)
+	want := n / (side * side)
+	got := sc.caustics(Point3D{5, 0, 5}, yAxis)
+	if math.Abs(got.R-want) > 0.05*want || math.Abs(got.G-want/2) > 0.05*want/2 {
+		t.Errorf("caustics %v, want %v red", got, want)
+	}
+	if under := sc.caustics(Point3D{5, 0, 5}, yAxis.Scale(-1)); !under.isBlack() {
+		t.Errorf("caustics %v on the unlit side", under)
+	}
+}
+
+// Once photons carry the light through a glass target, shadow rays don't
+// carry it as well. Emitters and the sky shoot no photons, so theirs gets through
+func TestPhotonTargetShadow(t *testing.T) {
+	rand.Seed(13)
+	sc := loadTestScene(t, `global_settings { photons { count 2000 } }
+		light_source { <0, 10, 0> rgb 1 }
+		sphere { <0, 2, 0>, 1 pigment { color rgbf <1, 1, 1, 1> } finish { refraction 1 }
+			interior { ior 1.5 } photons { target } }
+		plane { y, 0 pigment { color rgb 1 } }`)
+	if len(sc.photons) == 0 {
+		t.Fatal("no photons landed")
+	}
+	pt, lightPt := Point3D{0, 0, 0}, sc.lights[0].location
+	if lit := sc.shadowFilter(pt, 0, lightPt, nil, true); !lit.isBlack() {
+		t.Errorf("light through the target %v, want none", lit)
+	}
+	if lit := sc.shadowFilter(pt, 0, lightPt, nil, false); lit != white {
+		t.Errorf("light through the target from the sky %v, want all", lit)
+	}
+}
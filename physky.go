@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"math"
+)
+
+// physicalSky is Preetham's daylight sky, a fit to how clear and hazy
+// skies scatter sunlight. Directions have y up, x east and z north.
+// Radiance is scaled so the noon sun shines about white
+type physicalSky struct {
+	turbidity float64
+	// sun points towards the sun
+	sun          Vector3D
+	groundAlbedo float64
+	// sunLight adds a parallel light_source shining from the sun
+	sunLight bool
+	// perez holds the distribution coefficients, and zenith the values
+	// straight up, for luminance and the x and y chromaticities
+	perez  [3][5]float64
+	zenith [3]float64
+	// sunColor is the light from the sun after crossing the air, and
+	// ground the color seen below the horizon
+	sunColor, ground fColor
+}
+
+// skyScale takes luminances in kcd/m^2 to scene brightness, so a clear
+// noon sun is a light of about white
+const skyScale = math.Pi / 100
+
+// Sun lights are placed this far off, towards the sun
+const sunDistance = 1e5
+
+// parsePhysicalSky reads a physical_sky block. The sun is placed either by
+// its elevation and azimuth in degrees, clockwise from north, or by
+// latitude and longitude in degrees north and east, a date <month, day>
+// and the clock time in hours in time_zone hours east of UTC
+func parsePhysicalSky(scanner *povScanner) (*physicalSky, error) {
+	if !scanner.Scan() || scanner.Text() != "{" {
+		return nil, errors.New("Missing '{' token")
+	}
+	ps := &physicalSky{turbidity: 3, groundAlbedo: 0.2, sunLight: true}
+	elevation, azimuth := 45.0, 180.0
+	latitude, longitude, month, day, hour := 0.0, 0.0, 6.0, 21.0, 12.0
+	var timeZone *float64
+	located := false
+	var err error
+	for scanner.Scan() {
+		switch token := scanner.Text(); token {
+		case "}":
+			if ps.turbidity < 1.7 || ps.turbidity > 10 {
+				return nil, errors.New("Turbidity must be between 1.7 and 10")
+			}
+			if ps.groundAlbedo < 0 || ps.groundAlbedo > 1 {
+				return nil, errors.New("Ground albedo must be between 0 and 1")
+			}
+			if located {
+				zone := math.Round(longitude / 15)
+				if timeZone != nil {
+					zone = *timeZone
+				}
+				ps.sun = sunPosition(latitude, longitude, dayOfYear(int(month), int(day)), hour, zone)
+			} else {
+				el, az := elevation*degToRad, azimuth*degToRad
+				ps.sun = Vector3D{math.Sin(az) * math.Cos(el), math.Sin(el), math.Cos(az) * math.Cos(el)}
+			}
+			ps.prepare()
+			return ps, nil
+		case "turbidity":
+			ps.turbidity, err = parseFloat(scanner)
+		case "sun_elevation":
+			elevation, err = parseFloat(scanner)
+		case "sun_azimuth":
+			azimuth, err = parseFloat(scanner)
+		case "ground_albedo":
+			ps.groundAlbedo, err = parseFloat(scanner)
+		case "sun_light":
+			ps.sunLight, err = parseToggle(scanner)
+		case "latitude":
+			latitude, err = parseFloat(scanner)
+			located = true
+		case "longitude":
+			longitude, err = parseFloat(scanner)
+			located = true
+		case "date":
+			var date exprValue
+			if date, err = parseExpr(scanner); err == nil {
+				month, day = date.v[0], date.v[1]
+				if date.size != 2 || month < 1 || month > 12 || day < 1 || day > 31 {
+					err = errors.New("Date must be <month, day>")
+				}
+			}
+			located = true
+		case "time":
+			hour, err = parseFloat(scanner)
+			located = true
+		case "time_zone":
+			var zone float64
+			zone, err = parseFloat(scanner)
+			timeZone, located = &zone, true
+		default:
+			return nil, errors.New("Unexpected token in physical sky: '" + token + "'")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, eofErr
+}
+
+// dayOfYear counts from 1 on January 1st, in a year that isn't a leap year
+func dayOfYear(month, day int) int {
+	before := [12]int{0, 31, 59, 90, 120, 151, 181, 212, 243, 273, 304, 334}
+	return before[month-1] + day
+}
+
+// sunPosition is the direction to the sun at latitude and longitude, in
+// degrees, on day of the year at the clock time hour in timeZone, using
+// the approximations in Preetham's paper
+func sunPosition(latitude, longitude float64, day int, hour, timeZone float64) Vector3D {
+	j := float64(day)
+	solarTime := hour + 0.170*math.Sin(4*math.Pi*(j-80)/373) - 0.129*math.Sin(2*math.Pi*(j-8)/355) +
+		(longitude-15*timeZone)/15
+	declination := 0.4093 * math.Sin(2*math.Pi*(j-81)/368)
+	hourAngle := math.Pi * (solarTime - 12) / 12
+	lat := latitude * degToRad
+	return Vector3D{
+		X: -math.Cos(declination) * math.Sin(hourAngle),
+		Y: math.Sin(declination)*math.Sin(lat) + math.Cos(declination)*math.Cos(lat)*math.Cos(hourAngle),
+		Z: math.Sin(declination)*math.Cos(lat) - math.Cos(declination)*math.Sin(lat)*math.Cos(hourAngle),
+	}.Normalize()
+}
+
+// prepare works out the coefficients for the turbidity and sun, the
+// sun's color and the ground's
+func (ps *physicalSky) prepare() {
+	t := ps.turbidity
+	ps.perez = [3][5]float64{
+		{0.1787*t - 1.4630, -0.3554*t + 0.4275, -0.0227*t + 5.3251, 0.1206*t - 2.5771, -0.0670*t + 0.3703},
+		{-0.0193*t - 0.2592, -0.0665*t + 0.0008, -0.0004*t + 0.2125, -0.0641*t - 0.8989, -0.0033*t + 0.0452},
+		{-0.0167*t - 0.2608, -0.0950*t + 0.0092, -0.0079*t + 0.2102, -0.0441*t - 1.6537, -0.0109*t + 0.0529},
+	}
+	// The fit only holds with the sun up, so lower suns are kept just
+	// above the horizon
+	thetaS := math.Min(math.Acos(math.Max(-1, math.Min(1, ps.sun.Y))), math.Pi/2-0.01)
+	chi := (4.0/9 - t/120) * (math.Pi - 2*thetaS)
+	ps.zenith[0] = (4.0453*t-4.9710)*math.Tan(chi) - 0.2155*t + 2.4192
+	chroma := func(m [3][4]float64) float64 {
+		th := [4]float64{thetaS * thetaS * thetaS, thetaS * thetaS, thetaS, 1}
+		sum := 0.0
+		for i, tt := range [3]float64{t * t, t, 1} {
+			for k := range th {
+				sum += tt * m[i][k] * th[k]
+			}
+		}
+		return sum
+	}
+	ps.zenith[1] = chroma([3][4]float64{{0.00166, -0.00375, 0.00209, 0},
+		{-0.02903, 0.06377, -0.03202, 0.00394}, {0.11693, -0.21196, 0.06052, 0.25886}})
+	ps.zenith[2] = chroma([3][4]float64{{0.00275, -0.00610, 0.00317, 0},
+		{-0.04214, 0.08970, -0.04153, 0.00516}, {0.15346, -0.26756, 0.06670, 0.26688}})
+
+	ps.sunColor = ps.sunTransmittance()
+	// The ground reflects the sky and sun that fall on it evenly
+	sky := fColor{}
+	const rows, cols = 32, 64
+	for i := 0; i < rows; i++ {
+		y := (float64(i) + 0.5) / rows
+		for k := 0; k < cols; k++ {
+			phi := 2 * math.Pi * (float64(k) + 0.5) / cols
+			r := math.Sqrt(1 - y*y)
+			c := ps.radiance(Vector3D{r * math.Cos(phi), y, r * math.Sin(phi)})
+			// Cosine weighted over equal solid angles
+			w := y * 2 * math.Pi / (rows * cols)
+			sky.R, sky.G, sky.B = sky.R+c.R*w, sky.G+c.G*w, sky.B+c.B*w
+		}
+	}
+	sun := ps.sunColor.Scale(math.Max(0, ps.sun.Y) * math.Pi)
+	ps.ground = fColor{R: ps.groundAlbedo * (sky.R + sun.R) / math.Pi,
+		G: ps.groundAlbedo * (sky.G + sun.G) / math.Pi, B: ps.groundAlbedo * (sky.B + sun.B) / math.Pi, A: 1}
+}
+
+// sunTransmittance is the sun's color as a light, dimmed and reddened by
+// Rayleigh scattering and haze along its path through the air, sampled at
+// red, green and blue wavelengths
+func (ps *physicalSky) sunTransmittance() fColor {
+	if ps.sun.Y <= 0 {
+		return fColor{A: 1}
+	}
+	zenithDeg := math.Acos(ps.sun.Y) / degToRad
+	airMass := 1 / (ps.sun.Y + 0.15*math.Pow(93.885-zenithDeg, -1.253))
+	beta := 0.04608*ps.turbidity - 0.04586
+	// Outside the air the sun lights about 127 klux
+	through := func(micrometers float64) float64 {
+		rayleigh := math.Exp(-0.008735 * math.Pow(micrometers, -4.08) * airMass)
+		haze := math.Exp(-beta * math.Pow(micrometers, -1.3) * airMass)
+		return 127 * skyScale / math.Pi * rayleigh * haze
+	}
+	return fColor{R: through(0.65), G: through(0.55), B: through(0.45), A: 1}
+}
+
+// radiance is the sky's brightness looking along dir, a unit vector. Below
+// the horizon it's the ground's
+func (ps *physicalSky) radiance(dir Vector3D) fColor {
+	if dir.Y <= 0 {
+		return ps.ground
+	}
+	thetaS := math.Min(math.Acos(math.Max(-1, math.Min(1, ps.sun.Y))), math.Pi/2-0.01)
+	gamma := math.Acos(math.Max(-1, math.Min(1, dir.Dot(ps.sun))))
+	perez := func(c [5]float64, cosTheta, gamma float64) float64 {
+		cosGamma := math.Cos(gamma)
+		return (1 + c[0]*math.Exp(c[1]/cosTheta)) * (1 + c[2]*math.Exp(c[3]*gamma) + c[4]*cosGamma*cosGamma)
+	}
+	var v [3]float64
+	for i := range v {
+		v[i] = ps.zenith[i] * perez(ps.perez[i], math.Max(dir.Y, 1e-3), gamma) /
+			perez(ps.perez[i], 1, thetaS)
+	}
+	// xyY to XYZ, then to linear sRGB
+	lum, x, y := v[0]*skyScale, v[1], v[2]
+	X, Z := x/y*lum, (1-x-y)/y*lum
+	return fColor{R: math.Max(0, 3.2406*X-1.5372*lum-0.4986*Z),
+		G: math.Max(0, -0.9689*X+1.8758*lum+0.0415*Z),
+		B: math.Max(0, 0.0557*X-0.2040*lum+1.0570*Z), A: 1}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"github.com/go-gl/mathgl/mgl64"
+	"math"
+)
+
+// pigment colors a surface, either with a single color or by a pattern
+// whose value at each point is looked up in its color map
+type pigment struct {
+	color   fColor
+	pattern string
+	// gradient is the direction a gradient pattern ramps along
+	gradient Vector3D
+	// checker holds the two colors a checker pattern alternates between
+	checker  [2]fColor
+	colorMap []mapEntry
+	// The pattern is warped by turbulence, made of octaves of noise, each
+	// scaled by omega and with its frequency multiplied by lambda
+	turbulence    Vector3D
+	octaves       int
+	omega, lambda float64
+	// image is wrapped around the pigment by an image_map pattern
+	image *imageMap
+	// uvMapping lays the pattern out by the uv of the mesh faces it's on,
+	// as the point (u, v, 0), instead of by where they are
+	uvMapping bool
+	placement
+}
+
+// mapEntry is the color a color map gives at value
+type mapEntry struct {
+	value float64
+	color fColor
+}
+
+var pigmentPatterns = map[string]bool{"checker": true, "gradient": true, "bozo": true,
+	"marble": true, "wood": true, "granite": true, "image_map": true}
+
+func makePigment() pigment {
+	return pigment{color: fColor{A: 1}, octaves: 6, omega: 0.5, lambda: 2,
+		placement: makePlacement()}
+}
+
+func parsePigment(scanner *povScanner) (pigment, error) {
+	if !scanner.Scan() || scanner.Text() != "{" {
+		return pigment{}, errors.New("Invalid pigment structure")
+	}
+	pg := makePigment()
+	var err error
+	for scanner.Scan() {
+		if isTransform, err := pg.parseTransform(scanner); isTransform {
+			if err != nil {
+				return pigment{}, err
+			}
+			continue
+		}
+		if isPattern, err := pg.parsePattern(scanner); isPattern {
+			if err != nil {
+				return pigment{}, err
+			}
+			continue
+		}
+		token := scanner.Text()
+		switch token {
+		case "}":
+			return pg, nil
+		case "pigment":
+			// A #declare'd pigment used as the starting point
+			pg, err = parsePigment(scanner)
+		case "checker":
+			pg.pattern = token
+			pg.checker = [2]fColor{{B: 1, A: 1}, {G: 1, A: 1}}
+			for i := range pg.checker {
+				if !scanner.Scan() {
+					return pigment{}, eofErr
+				}
+				next := scanner.Text()
+				scanner.Unscan()
+				if !startsColor(next) {
+					break
+				}
+				if pg.checker[i], err = parseColor(scanner); err != nil {
+					return pigment{}, err
+				}
+			}
+		case "image_map":
+			pg.pattern = token
+			pg.image, err = parseImageMap(scanner, nil)
+		case "uv_mapping":
+			pg.uvMapping = true
+		case "color_map", "colour_map":
+			pg.colorMap, err = parseColorMap(scanner)
+		default:
+			// color rgb <...>, or an identifier holding a color
+			scanner.Unscan()
+			pg.color, err = parseColor(scanner)
+		}
+		if err != nil {
+			return pigment{}, err
+		}
+	}
+	return pigment{}, eofErr
+}
+
+// parsePattern handles the current token if it picks a pattern or sets
+// how it's warped, which textures share with pigments
+func (pg *pigment) parsePattern(scanner *povScanner) (bool, error) {
+	var err error
+	switch token := scanner.Text(); token {
+	case "gradient":
+		pg.pattern = token
+		pg.gradient, err = parseVector(scanner)
+	case "bozo", "marble", "wood", "granite":
+		pg.pattern = token
+	case "turbulence":
+		pg.turbulence, err = parseVector(scanner)
+	case "octaves":
+		pg.octaves, err = parseCount(scanner, token)
+	case "omega":
+		pg.omega, err = parseFloat(scanner)
+	case "lambda":
+		pg.lambda, err = parseFloat(scanner)
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+// startsColor is false for the tokens that can follow a pattern's colors
+func startsColor(token string) bool {
+	switch token {
+	case "}", "color_map", "colour_map", "turbulence", "octaves", "omega", "lambda",
+		"translate", "rotate", "scale", "motion", "uv_mapping":
+		return false
+	}
+	return !pigmentPatterns[token]
+}
+
+// parseColorMap reads entries of the form [value color], which must come
+// in increasing order
+func parseColorMap(scanner *povScanner) ([]mapEntry, error) {
+	if !scanner.Scan() || scanner.Text() != "{" {
+		return nil, errors.New("Missing '{' token")
+	}
+	var entries []mapEntry
+	for scanner.Scan() {
+		switch token := scanner.Text(); token {
+		case "}":
+			if len(entries) == 0 {
+				return nil, errors.New("Color map needs at least one entry")
+			}
+			return entries, nil
+		case "[":
+			value, err := parseFloat(scanner)
+			if err != nil {
+				return nil, err
+			}
+			if n := len(entries); n > 0 && value < entries[n-1].value {
+				return nil, errors.New("Color map entries must be in increasing order")
+			}
+			color, err := parseColor(scanner)
+			if err != nil {
+				return nil, err
+			}
+			if !scanner.Scan() || scanner.Text() != "]" {
+				return nil, errors.New("Missing ']' in color map")
+			}
+			entries = append(entries, mapEntry{value: value, color: color})
+		default:
+			return nil, errors.New("Unexpected token in color map: '" + token + "'")
+		}
+	}
+	return nil, eofErr
+}
+
+// at is the pigment's color where ray hits pt, for the pigment placed as
+// at the ray's time
+func (pg *pigment) at(pt Point3D, ray Ray) fColor {
+	if pg.pattern == "" {
+		return pg.color
+	}
+	p, inv := pg.local(pt, ray)
+	switch pg.pattern {
+	case "image_map":
+		// The beam's width scaled into the pigment's space
+		footprint := ray.footprint(pt) * math.Cbrt(math.Abs(inv.Det()))
+		return pg.image.at(p, footprint)
+	case "checker":
+		return pg.checker[int(pg.value(p))]
+	}
+	return pg.lookup(pg.value(p))
+}
+
+// local maps pt, or its uv for uv mapped pigments on faces that have
+// one, into the pattern's own space, placed as at the ray's time and
+// warped by any turbulence, along with the inverse placement
+func (pg *pigment) local(pt Point3D, ray Ray) (Point3D, mgl64.Mat4) {
+	_, inv := pg.placement.at(ray.Time)
+	if pg.uvMapping && ray.HasUV {
+		pt = ray.UV
+	}
+	p := pt.Transform(inv)
+	if pg.turbulence != (Vector3D{}) {
+		warp := turbulence(p, pg.octaves, pg.omega, pg.lambda)
+		p = p.Translate(Vector3D{warp.X * pg.turbulence.X, warp.Y * pg.turbulence.Y,
+			warp.Z * pg.turbulence.Z})
+	}
+	return p, inv
+}
+
+// place moves the pigment with what it's on, except uv mapped pigments,
+// which stay put on the uv of the faces
+func (pg *pigment) place(other *placement) {
+	if !pg.uvMapping {
+		pg.placement.place(other)
+	}
+}
+
+// value is the pattern from 0 to 1 at p, in the pattern's own space.
+// Checkers are either 0 or 1
+func (pg *pigment) value(p Point3D) float64 {
+	switch pg.pattern {
+	case "checker":
+		// Nudged so surfaces lying on a cell boundary, like a plane at y = 0,
+		// don't flicker between cells
+		const tolerance = 1e-6
+		sum := int(math.Floor(p.X+tolerance)) + int(math.Floor(p.Y+tolerance)) +
+			int(math.Floor(p.Z+tolerance))
+		return float64(sum & 1)
+	case "gradient":
+		return frac(p.AsVector().Dot(pg.gradient))
+	case "bozo":
+		return math.Min(1, math.Max(0, (noise(p)+1)/2))
+	case "marble":
+		return triangleWave(p.X)
+	case "wood":
+		return triangleWave(math.Sqrt(p.X*p.X + p.Y*p.Y))
+	case "granite":
+		sum, freq := 0.0, 1.0
+		for i := 0; i < 6; i++ {
+			sum += math.Abs(noise(Point3D{p.X * 4 * freq, p.Y * 4 * freq, p.Z * 4 * freq})) / 2 / freq
+			freq *= 2
+		}
+		return math.Min(1, sum)
+	}
+	return 0
+}
+
+// lookup interpolates the color map at value, holding the end colors
+// beyond its ends. Without a map, the pattern runs from black to white
+func (pg *pigment) lookup(value float64) fColor {
+	entries := pg.colorMap
+	if len(entries) == 0 {
+		entries = []mapEntry{{0, fColor{A: 1}}, {1, white}}
+	}
+	lo, hi, f := between(value, len(entries), func(i int) float64 { return entries[i].value })
+	return mixColor(f, entries[lo].color, entries[hi].color)
+}
+
+// between finds the entries of a map, n long with the values given by at,
+// on either side of value, and how far value is from the lower to the
+// higher. Beyond the ends both are the end entry
+func between(value float64, n int, at func(i int) float64) (lo, hi int, f float64) {
+	if value <= at(0) {
+		return 0, 0, 0
+	}
+	for i := 1; i < n; i++ {
+		if value <= at(i) {
+			if at(i) == at(i-1) {
+				return i, i, 0
+			}
+			return i - 1, i, (value - at(i-1)) / (at(i) - at(i-1))
+		}
+	}
+	return n - 1, n - 1, 0
+}
+
+// mixColor blends from a to b by f, channel by channel including A and T
+func mixColor(f float64, a, b fColor) fColor {
+	return fColor{R: lerp(f, a.R, b.R), G: lerp(f, a.G, b.G), B: lerp(f, a.B, b.B),
+		A: lerp(f, a.A, b.A), T: lerp(f, a.T, b.T)}
+}
+
+func frac(x float64) float64 {
+	return x - math.Floor(x)
+}
+
+// triangleWave rises from 0 to 1 and back over each unit of x
+func triangleWave(x float64) float64 {
+	f := frac(x)
+	if f < 0.5 {
+		return 2 * f
+	}
+	return 2 - 2*f
+}
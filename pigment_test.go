@@ -0,0 +1,101 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+// parseTestPigment reads a pigment block
+func parseTestPigment(t *testing.T, src string) pigment {
+	scanner := newPOVScanner(strings.NewReader(src), "test.pov")
+	defer scanner.Close()
+	pg, err := parsePigment(scanner)
+	if err != nil {
+		t.Fatalf("%q: %v", src, err)
+	}
+	return pg
+}
+
+func TestChecker(t *testing.T) {
+	pg := parseTestPigment(t, "{ checker color rgb <1, 0, 0> color rgb <0, 0, 1> }")
+	red, blue := fColor{R: 1, A: 1}, fColor{B: 1, A: 1}
+	tests := []struct {
+		pt   Point3D
+		want fColor
+	}{
+		{Point3D{0.5, 0.5, 0.5}, red},
+		{Point3D{1.5, 0.5, 0.5}, blue},
+		{Point3D{1.5, 1.5, 0.5}, red},
+		{Point3D{-0.5, 0.5, 0.5}, blue},
+		{Point3D{-0.5, -0.5, -0.5}, blue},
+		// Points on a boundary, or a rounding error either side of it, all
+		// fall in the cell above it
+		{Point3D{0.5, 0, 0.5}, red},
+		{Point3D{0.5, -1e-12, 0.5}, red},
+		{Point3D{0.5, 1e-12, 0.5}, red},
+		{Point3D{0.5, -1, 0.5}, blue},
+		{Point3D{0.5, -1 - 1e-12, 0.5}, blue},
+		{Point3D{2, 0, 0.5}, red},
+	}
+	for _, test := range tests {
+		if got := pg.at(test.pt, Ray{}); got != test.want {
+			t.Errorf("checker at %v: %v, want %v", test.pt, got, test.want)
+		}
+	}
+	// A plane lying on a boundary, at y = 0, shows whole cells
+	for x := -3.0; x < 3; x += 0.37 {
+		for z := -3.0; z < 3; z += 0.41 {
+			a := pg.at(Point3D{x, 0, z}, Ray{})
+			b := pg.at(Point3D{x, -1e-10, z}, Ray{})
+			if a != b {
+				t.Fatalf("checker on the plane y = 0 at %v, %v flickers", x, z)
+			}
+		}
+	}
+}
+
+func TestColorMap(t *testing.T) {
+	pg := parseTestPigment(t, `{ gradient x color_map { [0 color rgb <0, 0, 0>] [0.5 color rgb <1, 0, 0>]
+		[0.5 color rgb <0, 1, 0>] [1 color rgb <0, 0, 1>] } }`)
+	tests := []struct {
+		x    float64
+		want fColor
+	}{
+		{0, fColor{A: 1}},
+		{0.25, fColor{R: 0.5, A: 1}},
+		// Two entries at one value change color sharply
+		{0.5, fColor{R: 1, A: 1}},
+		{0.5 + 1e-9, fColor{G: 1, A: 1}},
+		{0.75, fColor{G: 0.5, B: 0.5, A: 1}},
+		// Gradients repeat every unit
+		{1.25, fColor{R: 0.5, A: 1}},
+		{-0.75, fColor{R: 0.5, A: 1}},
+	}
+	for _, test := range tests {
+		got := pg.at(Point3D{X: test.x}, Ray{})
+		if math.Abs(got.R-test.want.R) > 1e-6 || math.Abs(got.G-test.want.G) > 1e-6 ||
+			math.Abs(got.B-test.want.B) > 1e-6 {
+			t.Errorf("gradient x at %v: %v, want %v", test.x, got, test.want)
+		}
+	}
+}
+
+// Every pattern stays within 0 to 1, and transforms move it with the pigment
+func TestPatterns(t *testing.T) {
+	for _, pattern := range []string{"bozo", "marble", "wood", "granite", "gradient y"} {
+		pg := parseTestPigment(t, "{ "+pattern+" turbulence 0.5 }")
+		moved := parseTestPigment(t, "{ "+pattern+" turbulence 0.5 translate <3, 1, -2> scale 2 }")
+		for i := 0; i < 500; i++ {
+			p := Point3D{float64(i%10) * 0.37, float64(i/10%10) * 0.53, float64(i/100) * 0.71}
+			v := pg.value(p)
+			if v < 0 || v > 1 {
+				t.Fatalf("%s at %v: %v", pattern, p, v)
+			}
+			there := Point3D{(p.X + 3) * 2, (p.Y + 1) * 2, (p.Z - 2) * 2}
+			if a, b := pg.at(p, Ray{}), moved.at(there, Ray{}); math.Abs(a.R-b.R) > 1e-9 {
+				t.Fatalf("%s at %v: %v, moved to %v: %v", pattern, p, a, there, b)
+			}
+		}
+	}
+}
@@ -1,23 +1,26 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
 	"errors"
-	"github.com/go-gl/mathgl/mgl64"
 	"io"
 	"math"
 	"strconv"
+	"strings"
 	"unicode"
 )
 
 var (
-	eye = camera{location: Point3D{X: 0, Y: 0, Z: 0},
-		up:     Vector3D{X: 0, Y: 1, Z: 0},
-		right:  Vector3D{X: 1.333, Y: 0, Z: 0},
-		lookAt: Point3D{X: 0, Y: 0, Z: -1}}
+	eye = makeCamera()
 
-	objects = make([]castable, 0, 10)
-	lights  = make([]light, 0, 1)
+	objects  = make([]castable, 0, 10)
+	lights   = make([]light, 0, 1)
+	settings = globalSettings{}
+	backdrop = makeSky()
+	fogs     []fog
+
+	// Extra directories searched by #include, from -L flags
+	includePaths []string
 
 	eofErr = errors.New("Unexpected EOF")
 )
@@ -28,35 +31,84 @@ const (
 
 type castable interface {
 	Hit(r Ray) (bool, float64)
-	Color() fColor
-	Normal(pt Point3D) Vector3D
-	Finish() finish
+	// Intervals returns the spans of r inside the object, sorted by entry
+	Intervals(r Ray) []span
+	// Color is the pigment where ray hits pt, with the object placed as it
+	// is at the ray's time
+	Color(pt Point3D, ray Ray) fColor
+	// Normal is the surface normal at pt, with the object placed as it is
+	// at time
+	Normal(pt Point3D, time float64) Vector3D
+	// Perturb tilts normal, found by Normal where ray hits pt, by the
+	// object's normal pattern
+	Perturb(pt Point3D, normal Vector3D, ray Ray) Vector3D
+	// Finish is the finish where ray hits pt
+	Finish(pt Point3D, ray Ray) finish
+	Interior() interior
+	base() *object
 }
 
 type object struct {
-	transforms mgl64.Mat4
-	pigment    fColor
-	finish     finish
-}
-
+	placement
+	// textures are layered from the bottom up, each covering those below
+	// where its pigment is opaque. There's always at least one
+	textures []texture
+	interior interior
+	photons  photonOptions
+	// Set once given explicitly, so CSG children keep their own
+	hasTexture, hasInterior, hasPhotons bool
+	// noShadow objects don't block light
+	noShadow bool
+}
+
+// fColor is a color with A its opacity. Of the transparency 1 - A, T is
+// the part transmitted unchanged; the rest is filtered by the color
 type fColor struct {
 	R, G, B, A float64
+	T          float64
 }
 
 type finish struct {
 	ambient, diffuse, specular, roughness float64
-	reflection, refraction, ior           float64
-}
-
-type camera struct {
-	location  Point3D
-	up, right Vector3D
-	lookAt    Point3D
+	reflection, refraction                float64
+	// With fresnel, reflection rises from reflectionMin facing the viewer
+	// to reflection at grazing angles, and refraction takes what's left
+	reflectionMin float64
+	fresnel       bool
+	// brilliance narrows the diffuse falloff, and phong adds a highlight
+	// about the mirror direction whose tightness is phongSize
+	brilliance, phong, phongSize float64
+	// metallic, from 0 to 1, tints highlights by the pigment
+	metallic float64
+	// anisotropy stretches microfacet highlights along the surface's up
+	// direction, or across it when negative
+	anisotropy float64
+	// brdf names the model in bsdfModels shading the surface
+	brdf string
+	// emission is the light the surface gives off, tinted by the pigment
+	emission fColor
 }
 
 type light struct {
 	location Point3D
 	color    fColor
+	kind     string
+	parallel bool
+	pointAt  Point3D
+	// radius and falloff are the edges of a spotlight's beam in degrees,
+	// or of a cylinder light's in units. tightness narrows a spotlight
+	radius, falloff, tightness float64
+	// Light fades with distance once fadeDistance and fadePower are set
+	fadeDistance, fadePower float64
+	// area is nil for lights from a single point
+	area *areaLight
+	placement
+}
+
+// globalSettings holds the global_settings block. photons is nil unless
+// photon mapping is on
+type globalSettings struct {
+	photons *photonSettings
 }
 
 type box struct {
@@ -82,20 +134,6 @@ type plane struct {
 	object
 }
 
-type triangle struct {
-	corner1, corner2, corner3 Point3D
-	object
-}
-
-type errScanner struct {
-	scanner *bufio.Scanner
-	err     error
-}
-
-type errFloatConv struct {
-	err error
-}
-
 func (c fColor) RGBA() (r, g, b, a uint32) {
 	return uint32(math.Min(c.R*c.A*math.MaxUint16, math.MaxUint16)),
 		uint32(math.Min(c.G*c.A*math.MaxUint16, math.MaxUint16)),
@@ -125,6 +163,18 @@ func (c fColor) Mult(clr fColor) fColor {
 		A: math.Min(1.0, fa*a)}
 }
 
+// Tint scales each channel by the matching one of f, keeping c's opacity
+func (c fColor) Tint(f fColor) fColor {
+	return fColor{R: c.R * f.R,
+		G: c.G * f.G,
+		B: c.B * f.B,
+		A: c.A}
+}
+
+func (c fColor) isBlack() bool {
+	return c.R == 0 && c.G == 0 && c.B == 0
+}
+
 func (c fColor) Scale(factor float64) fColor {
 	return fColor{R: c.R * factor,
 		G: c.G * factor,
@@ -132,36 +182,20 @@ func (c fColor) Scale(factor float64) fColor {
 		A: c.A}
 }
 
-func (es *errScanner) Text() string {
-	if es.err != nil {
-		return ""
-	}
-	if !es.scanner.Scan() {
-		es.err = eofErr
-		return ""
-	}
-	text := es.scanner.Text()
-	return text
-}
-
-func (efc *errFloatConv) convert(s string) float64 {
-	if efc.err != nil {
-		return 0
-	}
-	var ret float64
-	ret, efc.err = strconv.ParseFloat(s, 64)
-	return ret
+// through is the share of light, per channel, passing through a pigment
+// of color c. Filtered light takes on its color and transmitted light
+// passes unchanged
+func (c fColor) through() fColor {
+	filter := 1 - c.A - c.T
+	return fColor{R: math.Min(1, c.R*filter+c.T), G: math.Min(1, c.G*filter+c.T),
+		B: math.Min(1, c.B*filter+c.T), A: 1}
 }
 
 func (obj *object) init() {
-	obj.transforms = mgl64.Ident4()
-	obj.finish.ambient = 0.1
-	obj.finish.diffuse = 0.6
-	obj.finish.specular = 0.0
-	obj.finish.roughness = 0.05
-	obj.finish.reflection = 0.0
-	obj.finish.refraction = 0.0
-	obj.finish.ior = 1.0
+	obj.placement = makePlacement()
+	obj.textures = []texture{defaultTexture()}
+	obj.interior = makeInterior()
+	obj.photons = makePhotonOptions()
 }
 
 func makeBox() (b box) {
@@ -184,47 +218,71 @@ func makePlane() (p plane) {
 	return
 }
 
-func makeTriangle() (t triangle) {
-	t.init()
-	return
-}
-
-func parsePOV(reader io.Reader) (err error) {
-	scanner := bufio.NewScanner(reader)
-	scanner.Split(scanPOV)
+// parsePOV reads a scene, with symbols declared as global identifiers
+func parsePOV(reader io.Reader, path string, symbols map[string]exprValue) (err error) {
+	scanner := newPOVScanner(reader, path)
+	defer scanner.Close()
+	for name, value := range symbols {
+		scanner.declare(name, symbol{value: value}, false)
+	}
 	for scanner.Scan() {
 		switch scanner.Text() {
 		case "camera":
 			err = parseCamera(scanner)
 		case "light_source":
 			err = parseLight(scanner)
-		case "box":
-			err = parseBox(scanner)
-		case "sphere":
-			err = parseSphere(scanner)
-		case "cone":
-			err = parseCone(scanner)
-		case "plane":
-			err = parsePlane(scanner)
-		case "triangle":
-			err = parseTriangle(scanner)
+		case "global_settings":
+			err = parseGlobalSettings(scanner)
+		case "background":
+			err = parseBackground(scanner)
+		case "sky_sphere":
+			err = parseSkySphere(scanner)
+		case "fog":
+			err = parseFog(scanner)
 		default:
-			token := scanner.Text()
-			if len(token) > 1 && token[:2] == "//" {
-				scanner.Split(bufio.ScanLines)
-				scanner.Scan()
-				scanner.Split(scanPOV)
+			var obj castable
+			obj, _, err = parseObject(scanner)
+			if obj != nil {
+				objects = append(objects, obj)
 			}
 			// Ignore Unexpected
 		}
 		if err != nil {
-			return
+			break
 		}
 	}
+	// A failed include surfaces as an early EOF in the block parsers, so
+	// prefer the scanner's own error when it has one
+	if scanErr := scanner.Err(); scanErr != nil {
+		err = scanErr
+	}
 	return
 }
 
-func skipBlock(scanner *bufio.Scanner) error {
+// parseGlobalSettings reads the global settings it knows, skipping any
+// others
+func parseGlobalSettings(scanner *povScanner) error {
+	if !scanner.Scan() || scanner.Text() != "{" {
+		return errors.New("Missing '{' token")
+	}
+	var err error
+	for scanner.Scan() {
+		switch scanner.Text() {
+		case "}":
+			return nil
+		case "photons":
+			settings.photons, err = parsePhotonSettings(scanner)
+		case "{":
+			err = skipBlock(scanner)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return eofErr
+}
+
+func skipBlock(scanner *povScanner) error {
 	for scanner.Scan() {
 		switch scanner.Text() {
 		case "}":
@@ -236,7 +294,7 @@ func skipBlock(scanner *bufio.Scanner) error {
 	return eofErr
 }
 
-func parseCamera(scanner *bufio.Scanner) error {
+func parseCamera(scanner *povScanner) error {
 	if !scanner.Scan() || scanner.Text() != "{" {
 		return errors.New("Missing '{' token")
 	}
@@ -245,278 +303,333 @@ func parseCamera(scanner *bufio.Scanner) error {
 	for scanner.Scan() {
 		token := scanner.Text()
 		switch token {
+		case "perspective", "orthographic", "fisheye", "panoramic", "spherical":
+			eye.projection = token
+		case "cylinder":
+			eye.projection = token
+			var cylType float64
+			cylType, err = parseFloat(scanner)
+			eye.cylinderType = int(cylType)
+			if err == nil && (cylType < 1 || cylType > 4 || cylType != math.Floor(cylType)) {
+				err = errors.New("Cylinder camera type must be 1, 2, 3 or 4")
+			}
 		case "location":
 			eye.location, err = parsePoint(scanner)
-			if err != nil {
-				return err
-			}
+		case "direction":
+			eye.direction, err = parseVector(scanner)
 		case "up":
 			eye.up, err = parseVector(scanner)
-			if err != nil {
-				return err
-			}
 		case "right":
 			eye.right, err = parseVector(scanner)
-			if err != nil {
-				return err
-			}
+		case "sky":
+			eye.sky, err = parseVector(scanner)
 		case "look_at":
 			eye.lookAt, err = parsePoint(scanner)
-			if err != nil {
-				return err
+			eye.hasLookAt = true
+		case "angle":
+			eye.angle, err = parseFloat(scanner)
+			// Spherical cameras take an optional vertical angle
+			if err == nil && eye.projection == "spherical" && scanner.Scan() {
+				next := scanner.Text()
+				scanner.Unscan()
+				if next != "}" && !cameraKeywords[next] {
+					eye.vAngle, err = parseFloat(scanner)
+				}
+			}
+		case "aperture":
+			eye.aperture, err = parseFloat(scanner)
+			if err == nil && eye.aperture < 0 {
+				err = errors.New("Camera aperture must not be negative")
 			}
+		case "focal_point":
+			eye.focalPoint, err = parsePoint(scanner)
+		case "blur_samples":
+			eye.blurSamples, err = parseCount(scanner, "blur_samples")
+		case "aperture_blades":
+			eye.blades, err = parseCount(scanner, "aperture_blades")
+		case "shutter_open":
+			eye.shutterOpen, err = parseFloat(scanner)
+		case "shutter_close":
+			eye.shutterClose, err = parseFloat(scanner)
 		case "}":
-			return nil
+			if eye.shutterClose < eye.shutterOpen {
+				return errors.New("Camera shutter_close is before shutter_open")
+			}
+			return eye.orient()
 		default:
-			return errors.New("Unexpected token: '" + token + "'")
+			var isTransform bool
+			if isTransform, err = eye.parseTransform(scanner); !isTransform {
+				return errors.New("Unexpected token: '" + token + "'")
+			}
+		}
+		if err != nil {
+			return err
 		}
 	}
 	return eofErr
 }
 
-func parseLight(scanner *bufio.Scanner) error {
+func parseLight(scanner *povScanner) error {
 	if !scanner.Scan() || scanner.Text() != "{" {
 		return errors.New("Missing '{' token")
 	}
 
-	l := light{}
+	l := light{kind: pointLight, placement: makePlacement()}
 	var err error
 	l.location, err = parsePoint(scanner)
 	if err != nil {
 		return err
 	}
-	// check for 'color rgb' between vectors
-	if !scanner.Scan() || scanner.Text() != "color" ||
-		!scanner.Scan() || scanner.Text() != "rgb" {
-		return errors.New("error parsing light")
-	}
-	temp, err := parseVector(scanner)
-	if err != nil {
+	if l.color, err = parseColor(scanner); err != nil {
 		return err
 	}
-	l.color = fColor{R: temp.X, G: temp.Y, B: temp.Z, A: 1.0}
+	l.color.A = 1.0
 
-	lights = append(lights, l)
-
-	return nil
+	for scanner.Scan() {
+		switch scanner.Text() {
+		case "}":
+			lights = append(lights, l)
+			return nil
+		case "area_light":
+			l.area, err = parseAreaLight(scanner)
+		default:
+			var isTransform bool
+			if isTransform, err = l.parseTransform(scanner); !isTransform {
+				_, err = l.parseOption(scanner)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return eofErr
 }
 
-func parseBox(scanner *bufio.Scanner) error {
+// position is where the light is at time t
+func (l *light) position(t float64) Point3D {
+	m, _ := l.at(t)
+	return l.location.Transform(m)
+}
+
+// parseObject parses the object named by the current token. isObject is
+// false if the token doesn't start an object; obj is nil for objects that
+// aren't supported yet
+func parseObject(scanner *povScanner) (obj castable, isObject bool, err error) {
+	switch scanner.Text() {
+	case "box":
+		obj, err = parseBox(scanner)
+	case "sphere":
+		obj, err = parseSphere(scanner)
+	case "cone":
+		obj, err = parseCone(scanner)
+	case "plane":
+		obj, err = parsePlane(scanner)
+	case "triangle":
+		obj, err = parseTriangle(scanner)
+	case "mesh":
+		obj, err = parseMesh(scanner)
+	case "union", "intersection", "difference", "merge":
+		obj, err = parseCSG(scanner, scanner.Text())
+	default:
+		return nil, false, nil
+	}
+	return obj, true, err
+}
+
+func parseBox(scanner *povScanner) (castable, error) {
 	if !scanner.Scan() || scanner.Text() != "{" {
-		return errors.New("Missing '{' token")
+		return nil, errors.New("Missing '{' token")
 	}
-	return skipBlock(scanner)
+	b := makeBox()
+	c1, err := parsePoint(scanner)
+	if err != nil {
+		return nil, err
+	}
+	c2, err := parsePoint(scanner)
+	if err != nil {
+		return nil, err
+	}
+	b.corner1 = Point3D{X: math.Min(c1.X, c2.X), Y: math.Min(c1.Y, c2.Y), Z: math.Min(c1.Z, c2.Z)}
+	b.corner2 = Point3D{X: math.Max(c1.X, c2.X), Y: math.Max(c1.Y, c2.Y), Z: math.Max(c1.Z, c2.Z)}
+	if err = b.finishObject(scanner); err != nil {
+		return nil, err
+	}
+	return &b, nil
 }
 
-func parseSphere(scanner *bufio.Scanner) error {
+func parseSphere(scanner *povScanner) (castable, error) {
 	if !scanner.Scan() || scanner.Text() != "{" {
-		return errors.New("Missing '{' token")
+		return nil, errors.New("Missing '{' token")
 	}
 	s := makeSphere()
 	var err error
 	s.center, err = parsePoint(scanner)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if !scanner.Scan() {
-		return eofErr
+	s.radius, err = parseFloat(scanner)
+	if err != nil {
+		return nil, err
 	}
-	s.radius, err = strconv.ParseFloat(scanner.Text(), 64)
-	err = s.finishObject(scanner)
-	if err == nil {
-		objects = append(objects, s)
+	if err = s.finishObject(scanner); err != nil {
+		return nil, err
 	}
-
-	return err
+	return &s, nil
 }
 
-func parseCone(scanner *bufio.Scanner) error {
+func parseCone(scanner *povScanner) (castable, error) {
 	if !scanner.Scan() || scanner.Text() != "{" {
-		return errors.New("Missing '{' token")
+		return nil, errors.New("Missing '{' token")
 	}
-	return skipBlock(scanner)
+	return nil, skipBlock(scanner)
 }
 
-func parsePlane(scanner *bufio.Scanner) error {
+func parsePlane(scanner *povScanner) (castable, error) {
 	if !scanner.Scan() || scanner.Text() != "{" {
-		return errors.New("Missing '{' token")
+		return nil, errors.New("Missing '{' token")
 	}
 	p := makePlane()
 	var err error
 	p.normal, err = parseVector(scanner)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if !scanner.Scan() {
-		return eofErr
+	p.distance, err = parseFloat(scanner)
+	if err != nil {
+		return nil, err
 	}
-	p.distance, err = strconv.ParseFloat(scanner.Text(), 64)
-	err = p.finishObject(scanner)
-	if err == nil {
-		objects = append(objects, p)
+	if err = p.finishObject(scanner); err != nil {
+		return nil, err
 	}
-
-	return err
+	return &p, nil
 }
 
-func parseTriangle(scanner *bufio.Scanner) error {
+func parseFinish(scanner *povScanner) error {
 	if !scanner.Scan() || scanner.Text() != "{" {
 		return errors.New("Missing '{' token")
 	}
 	return skipBlock(scanner)
 }
 
-func parseFinish(scanner *bufio.Scanner) error {
-	if !scanner.Scan() || scanner.Text() != "{" {
-		return errors.New("Missing '{' token")
-	}
-	return skipBlock(scanner)
-}
-
-func parsePoint(scanner *bufio.Scanner) (Point3D, error) {
-	pt := Point3D{}
-	es := errScanner{scanner: scanner, err: nil}
-	text := es.Text()
-	if text != "<" {
-		return pt, errors.New("Expected vector, found: '" + text + "'")
-	}
-
-	efc := errFloatConv{}
-
-	pt.X = efc.convert(es.Text())
-	pt.Y = efc.convert(es.Text())
-	pt.Z = efc.convert(es.Text())
-
-	if efc.err != nil {
-		return pt, efc.err
+// parseCount parses a whole number of at least one
+func parseCount(scanner *povScanner, name string) (int, error) {
+	f, err := parseFloat(scanner)
+	if err == nil && (f < 1 || f != math.Floor(f)) {
+		err = errors.New("Expected a positive whole number for " + name)
 	}
-
-	if es.Text() != ">" {
-		return pt, errors.New("Unterminated Point")
-	}
-
-	if es.err != nil {
-		return pt, es.err
-	}
-
-	return pt, nil
+	return int(f), err
 }
 
-func parseVector(scanner *bufio.Scanner) (Vector3D, error) {
-	pt, err := parsePoint(scanner)
-	return pt.AsVector(), err
+func parsePoint(scanner *povScanner) (Point3D, error) {
+	vec, err := parseVector(scanner)
+	return Point3D{X: vec.X, Y: vec.Y, Z: vec.Z}, err
 }
 
-func parseScale(scanner *bufio.Scanner) (error, Vector3D) {
-	vec := Vector3D{}
-	es := errScanner{scanner: scanner, err: nil}
-	efc := errFloatConv{}
-	text := es.Text()
-	if text != "<" {
-		scale := efc.convert(text)
-		if efc.err != nil {
-			return efc.err, vec
-		}
-		return nil, Vector3D{X: scale, Y: scale, Z: scale}
+// parseVector evaluates a vector expression, promoting a float to a vector
+// with every component equal. Other sizes are errors, so a vector missing a
+// comma before a minus sign doesn't quietly lose a component
+func parseVector(scanner *povScanner) (Vector3D, error) {
+	val, err := parseExpr(scanner)
+	if err == nil && val.size != 1 && val.size != 3 {
+		err = errors.New("Expected a vector of 3 components, found " + strconv.Itoa(val.size))
 	}
-
-	vec.X = efc.convert(es.Text())
-	vec.Y = efc.convert(es.Text())
-	vec.Z = efc.convert(es.Text())
-
-	if efc.err != nil {
-		return efc.err, vec
-	}
-	if es.Text() != ">" {
-		return errors.New("Unterminated Vector"), vec
-	}
-	if es.err != nil {
-		return es.err, vec
-	}
-
-	return nil, vec
+	return val.vector(), err
 }
 
-func parsePigment(scanner *bufio.Scanner) (fColor, error) {
-	// check and skip for { color rgb[f]
-	if !scanner.Scan() || scanner.Text() != "{" ||
-		!scanner.Scan() || scanner.Text() != "color" ||
-		!scanner.Scan() || (scanner.Text() != "rgb" && scanner.Text() != "rgbf") {
-		return fColor{}, errors.New("Invalid pigment structure")
-	}
-	c, err := parseColor(scanner)
-	if err == nil && (!scanner.Scan() || scanner.Text() != "}") {
-		err = errors.New("Invalid pigment structure")
-	}
-	return c, err
+func parseScale(scanner *povScanner) (error, Vector3D) {
+	vec, err := parseVector(scanner)
+	return err, vec
 }
 
-func parseColor(scanner *bufio.Scanner) (fColor, error) {
-	c := fColor{}
-	es := errScanner{scanner: scanner, err: nil}
-	text := es.Text()
-
-	if text != "<" {
-		return c, errors.New("Expected color, found: '" + text + "'")
-	}
-
-	efc := errFloatConv{}
-
-	c.R = efc.convert(es.Text())
-	c.G = efc.convert(es.Text())
-	c.B = efc.convert(es.Text())
-	c.A = 1.0
-
-	nextTok := es.Text()
-	if nextTok != ">" {
-		c.A = 1 - efc.convert(nextTok)
-		nextTok = es.Text()
-	}
-
-	if efc.err != nil {
-		return c, efc.err
-	}
-
-	if nextTok != ">" {
-		return c, errors.New("Unterminated Color")
+func parseColor(scanner *povScanner) (fColor, error) {
+	val, err := parseExpr(scanner)
+	if err != nil {
+		return fColor{}, err
 	}
-
-	if es.err != nil {
-		return c, es.err
+	if val.size == 2 {
+		return fColor{}, errors.New("Expected a color of 3 to 5 components, found 2")
 	}
-
-	return c, nil
+	val = val.promote(3)
+	return fColor{R: val.v[0], G: val.v[1], B: val.v[2], A: 1 - val.v[3] - val.v[4],
+		T: val.v[4]}, nil
 }
 
 // Scanner split function to parse pov vector, calling scan will scan a single
-// '>', '<', or a whole word up until whitespace or a comma
+// punctuation or operator character, a quoted string, or a whole word up
+// until whitespace or punctuation. Line and block comments are skipped.
 func scanPOV(data []byte, atEOF bool) (advance int, token []byte, err error) {
 	// Copied & Modified from bufio.ScanWords
 	start := 0
-	// Skip leading space, ','
+	// Skip leading space
 	shouldSkip := func(c byte) bool {
-		return unicode.IsSpace(rune(c)) || c == ','
+		return unicode.IsSpace(rune(c))
 	}
 
 	isToken := func(c byte) bool {
-		return shouldSkip(c) || c == '>' || c == '<' || c == '{' || c == '}'
+		return shouldSkip(c) || strings.IndexByte("<>{}()[],;=+-*/!?:&|", c) >= 0
+	}
+
+	// Exponents such as 1e-5 keep their sign inside the number
+	inExponent := func(i int) bool {
+		c := data[i]
+		return (c == '-' || c == '+') && i > start+1 &&
+			(data[i-1] == 'e' || data[i-1] == 'E') &&
+			(data[start] == '.' || unicode.IsDigit(rune(data[start])))
 	}
 
-	for ; start < len(data); start++ {
+	for start < len(data) {
 		c := data[start]
-		if !shouldSkip(c) {
+		if shouldSkip(c) {
+			start++
+			continue
+		}
+		if c != '/' {
 			break
 		}
+		if start+1 >= len(data) {
+			if atEOF {
+				break
+			}
+			// Can't tell a comment from a word yet, get more
+			return start, nil, nil
+		}
+		if data[start+1] != '/' && data[start+1] != '*' {
+			break
+		}
+		end := -1
+		if data[start+1] == '/' {
+			if i := bytes.IndexByte(data[start:], '\n'); i >= 0 {
+				end = start + i + 1
+			}
+		} else if i := bytes.Index(data[start+2:], []byte("*/")); i >= 0 {
+			end = start + 2 + i + 2
+		}
+		if end < 0 {
+			if atEOF {
+				return len(data), nil, nil
+			}
+			return start, nil, nil
+		}
+		start = end
 	}
 
 	if start < len(data) && isToken(data[start]) {
 		return start + 1, data[start : start+1], nil
 	}
 
+	if start < len(data) && data[start] == '"' {
+		if i := bytes.IndexByte(data[start+1:], '"'); i >= 0 {
+			return start + i + 2, data[start : start+i+2], nil
+		}
+		if !atEOF {
+			return start, nil, nil
+		}
+	}
+
 	// Scan until token
 	for i := start; i < len(data); i++ {
 		c := data[i]
-		if isToken(c) || c == '>' || c == '<' {
+		if (isToken(c) || c == '>' || c == '<') && !inExponent(i) {
 			return i, data[start:i], nil
 		}
 	}
@@ -530,39 +643,69 @@ func scanPOV(data []byte, atEOF bool) (advance int, token []byte, err error) {
 	return start, nil, nil
 }
 
-func (obj *object) finishObject(scanner *bufio.Scanner) error {
-	var err error
-	// Ignore transformations for now
-	//	var vec Vector3D
+func (obj *object) finishObject(scanner *povScanner) error {
 	for scanner.Scan() {
-		switch scanner.Text() {
-		case "translate":
-			_, err = parseVector(scanner)
-			//			obj.transforms = mgl64.Translate3D(vec.X, vec.Y, vec.Z).Mul4(obj.transforms)
-		case "rotate":
-			_, err = parseVector(scanner)
-			//			obj.transforms = mgl64.HomogRotate3DZ(degToRad * vec.Z).Mul4(
-			//				mgl64.HomogRotate3DY(degToRad * vec.Y)).Mul4(
-			//				mgl64.HomogRotate3DX(degToRad * vec.X)).Mul4(
-			//				obj.transforms)
-		case "scale":
-			_, err = parseVector(scanner)
-			//			obj.transforms = mgl64.Scale3D(vec.X, vec.Y, vec.Z).Mul4(obj.transforms)
-		case "pigment":
-			obj.pigment, err = parsePigment(scanner)
-		case "finish":
-			err = obj.parseFinish(scanner)
-		case "}":
+		if scanner.Text() == "}" {
 			return nil
 		}
-		if err != nil {
+		if err := obj.parseModifier(scanner); err != nil {
 			return err
 		}
 	}
 	return eofErr
 }
 
-func (obj *object) parseFinish(scanner *bufio.Scanner) error {
+// parseModifier handles a transform, motion, texture, material, pigment,
+// normal, finish, interior or photons block following an object's own
+// parameters. A bare pigment, normal or finish changes the top texture.
+// Unknown tokens are ignored
+func (obj *object) parseModifier(scanner *povScanner) error {
+	// Transforms move the textures given so far along with the object
+	moved := makePlacement()
+	if isTransform, err := moved.parseTransform(scanner); isTransform {
+		obj.place(&moved)
+		for i := range obj.textures {
+			obj.textures[i].place(&moved)
+		}
+		return err
+	}
+	top := &obj.textures[len(obj.textures)-1]
+	var err error
+	switch scanner.Text() {
+	case "texture":
+		err = obj.addTexture(scanner)
+	case "material":
+		err = obj.parseMaterial(scanner)
+	case "pigment":
+		top.pigment, err = parsePigment(scanner)
+		top.hasPigment = true
+	case "normal":
+		top.normalPattern, err = parseNormal(scanner)
+		top.hasNormal = true
+	case "finish":
+		err = obj.parseFinish(scanner, &top.finish)
+		top.hasFinish = true
+	case "interior":
+		err = obj.parseInterior(scanner)
+		obj.hasInterior = true
+	case "photons":
+		err = obj.parsePhotons(scanner)
+		obj.hasPhotons = true
+	case "no_shadow":
+		obj.noShadow = true
+	}
+	return err
+}
+
+// finishKeywords are the tokens that can start an item in a finish block
+var finishKeywords = map[string]bool{"finish": true, "ambient": true, "diffuse": true,
+	"specular": true, "roughness": true, "reflection": true, "refraction": true, "ior": true,
+	"brilliance": true, "phong": true, "phong_size": true, "metallic": true, "anisotropy": true,
+	"brdf": true, "emission": true}
+
+// parseFinish reads a finish block into fin. An ior given there sets the
+// object's interior
+func (obj *object) parseFinish(scanner *povScanner, fin *finish) error {
 	if !scanner.Scan() || scanner.Text() != "{" {
 		return errors.New("Missing '{' token")
 	}
@@ -570,27 +713,54 @@ func (obj *object) parseFinish(scanner *bufio.Scanner) error {
 	var err error
 	for scanner.Scan() {
 		token := scanner.Text()
-		if token == "}" {
-			return nil
-		}
-		if !scanner.Scan() {
-			return eofErr
-		}
 		switch token {
+		case "}":
+			return nil
+		case "finish":
+			// A #declare'd finish used as the starting point
+			err = obj.parseFinish(scanner, fin)
 		case "ambient":
-			obj.finish.ambient, err = strconv.ParseFloat(scanner.Text(), 64)
+			fin.ambient, err = parseFloat(scanner)
 		case "diffuse":
-			obj.finish.diffuse, err = strconv.ParseFloat(scanner.Text(), 64)
+			fin.diffuse, err = parseFloat(scanner)
 		case "specular":
-			obj.finish.specular, err = strconv.ParseFloat(scanner.Text(), 64)
+			fin.specular, err = parseFloat(scanner)
 		case "roughness":
-			obj.finish.roughness, err = strconv.ParseFloat(scanner.Text(), 64)
+			fin.roughness, err = parseFloat(scanner)
 		case "reflection":
-			obj.finish.reflection, err = strconv.ParseFloat(scanner.Text(), 64)
+			err = fin.parseReflection(scanner)
 		case "refraction":
-			obj.finish.refraction, err = strconv.ParseFloat(scanner.Text(), 64)
+			fin.refraction, err = parseFloat(scanner)
+		case "brilliance":
+			fin.brilliance, err = parseFloat(scanner)
+		case "phong":
+			fin.phong, err = parseFloat(scanner)
+		case "phong_size":
+			fin.phongSize, err = parseFloat(scanner)
+		case "metallic":
+			// The amount is optional, and all the way when left out
+			fin.metallic = 1
+			if !scanner.Scan() {
+				return eofErr
+			}
+			next := scanner.Text()
+			scanner.Unscan()
+			if next != "}" && !finishKeywords[next] {
+				fin.metallic, err = parseFloat(scanner)
+			}
+		case "anisotropy":
+			if fin.anisotropy, err = parseFloat(scanner); err == nil && math.Abs(fin.anisotropy) > 1 {
+				err = errors.New("Anisotropy must be between -1 and 1")
+			}
+		case "brdf":
+			fin.brdf, err = parseBRDF(scanner)
+		case "emission":
+			fin.emission, err = parseColor(scanner)
+			fin.emission.A = 1
 		case "ior":
-			obj.finish.ior, err = strconv.ParseFloat(scanner.Text(), 64)
+			// Older scenes give ior in the finish rather than the interior
+			obj.interior.ior, err = parseFloat(scanner)
+			obj.hasInterior = true
 		default:
 			return errors.New("Unexpected token: '" + token + "'")
 		}
@@ -601,49 +771,118 @@ func (obj *object) parseFinish(scanner *bufio.Scanner) error {
 	return eofErr
 }
 
-func (obj object) transform(pt Point3D) Point3D {
-	return pt.Transform(obj.transforms)
+// parseReflection reads either a single reflection amount or a block of
+// the minimum and maximum amounts and whether fresnel varies between them
+func (fin *finish) parseReflection(scanner *povScanner) error {
+	var err error
+	if !scanner.Scan() || scanner.Text() != "{" {
+		scanner.Unscan()
+		fin.reflection, err = parseFloat(scanner)
+		fin.reflectionMin = fin.reflection
+		return err
+	}
+
+	if fin.reflection, err = parseFloat(scanner); err != nil {
+		return err
+	}
+	fin.reflectionMin = fin.reflection
+	for scanner.Scan() {
+		token := scanner.Text()
+		switch token {
+		case "}":
+			return nil
+		case "fresnel":
+			fin.fresnel, err = parseToggle(scanner)
+		default:
+			// A second amount makes the first the minimum
+			scanner.Unscan()
+			fin.reflectionMin = fin.reflection
+			fin.reflection, err = parseFloat(scanner)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return eofErr
+}
+
+// parseToggle reads the optional on/off value after a keyword, which is
+// on when left out
+func parseToggle(scanner *povScanner) (bool, error) {
+	if !scanner.Scan() {
+		return true, nil
+	}
+	_, isConstant := exprConstants[scanner.Text()]
+	_, numErr := strconv.ParseFloat(scanner.Text(), 64)
+	scanner.Unscan()
+	if !isConstant && numErr != nil {
+		return true, nil
+	}
+	val, err := parseFloat(scanner)
+	return math.Abs(val) > exprEpsilon, err
+}
+
+// toObject maps a ray into object space as placed at the ray's time. The
+// direction isn't renormalized so distances along it match those along
+// the world ray
+func (obj *object) toObject(r Ray) Ray {
+	_, inv := obj.at(r.Time)
+	return Ray{Origin: r.Origin.Transform(inv),
+		Direction: r.Direction.Transform(inv), Time: r.Time}
 }
 
-func (s sphere) Hit(r Ray) (hitObj bool, t1 float64) {
-	/* get inverse sphere transform matrix, then apply to ray */
-	invM := s.transforms.Inv()
-	transRay := Ray{Origin: r.Origin.Transform(invM), Direction: r.Direction.Transform(invM).Normalize()}
-	rToS := transRay.Origin.Sub(s.transform(s.center))
-	A := transRay.Direction.Dot(transRay.Direction)
-	B := 2 * rToS.Dot(transRay.Direction)
+// toObjectPoint maps a world point into object space at time t
+func (obj *object) toObjectPoint(pt Point3D, t float64) Point3D {
+	_, inv := obj.at(t)
+	return pt.Transform(inv)
+}
+
+// toWorldNormal maps an object space normal back with the inverse
+// transpose, which keeps it perpendicular under non-uniform scaling
+func (obj *object) toWorldNormal(normal Vector3D, t float64) Vector3D {
+	_, inv := obj.at(t)
+	return normal.Transform(inv.Transpose()).Normalize()
+}
+
+func (obj *object) base() *object {
+	return obj
+}
+
+// roots solves for where the object space ray crosses the sphere
+func (s *sphere) roots(r Ray) (hitObj bool, t1, t2 float64) {
+	rToS := r.Origin.Sub(s.center)
+	A := r.Direction.Dot(r.Direction)
+	B := 2 * rToS.Dot(r.Direction)
 	C := rToS.Dot(rToS) - math.Pow(s.radius, 2)
 	dtmt := math.Pow(B, 2) - 4*A*C
 	if dtmt < 0 {
 		return
 	}
-
+	sqrt := math.Sqrt(dtmt)
 	divisor := 2 * A
+	return true, (-B - sqrt) / divisor, (-B + sqrt) / divisor
+}
 
-	if dtmt != 0 {
-		sqrt := math.Sqrt(dtmt)
-		t1 = (-B + sqrt) / divisor
-		t2 := (-B - sqrt) / divisor
-		if t2 < t1 {
-			t1 = t2
-		}
-		if t1 < 0 {
-			hitObj = false
-		} else {
-			hitObj = true
-		}
-	} else {
-		hitObj = true
-		t1 = -B / divisor
+// Hit finds the first crossing in front of the ray, which is the far side
+// for rays starting inside
+func (s *sphere) Hit(r Ray) (hitObj bool, t1 float64) {
+	hitObj, t1, t2 := s.roots(s.toObject(r))
+	return nearestAhead(hitObj, t1, t2)
+}
+
+func (s *sphere) Intervals(r Ray) []span {
+	if hitObj, t1, t2 := s.roots(s.toObject(r)); hitObj {
+		return []span{{enter: surfaceHit{t: t1, obj: s}, exit: surfaceHit{t: t2, obj: s}}}
 	}
-	return
+	return nil
 }
 
-func (s sphere) Normal(pt Point3D) Vector3D {
-	return pt.Sub(s.transform(s.center)).Normalize()
+func (s *sphere) Normal(pt Point3D, time float64) Vector3D {
+	return s.toWorldNormal(s.toObjectPoint(pt, time).Sub(s.center), time)
 }
 
-func (p plane) Hit(r Ray) (hitObj bool, t1 float64) {
+func (p *plane) Hit(r Ray) (hitObj bool, t1 float64) {
+	r = p.toObject(r)
 	vDotN := r.Direction.Dot(p.normal)
 	if vDotN != 0 {
 		t1 = -(r.Origin.AsVector().Dot(p.normal) - p.distance) / vDotN
@@ -654,14 +893,115 @@ func (p plane) Hit(r Ray) (hitObj bool, t1 float64) {
 	return
 }
 
-func (p plane) Normal(pt Point3D) Vector3D {
-	return p.normal
+// Intervals treats the plane as the half space below it, opposite the
+// normal
+func (p *plane) Intervals(r Ray) []span {
+	r = p.toObject(r)
+	vDotN := r.Direction.Dot(p.normal)
+	height := r.Origin.AsVector().Dot(p.normal) - p.distance
+	below, above := surfaceHit{t: math.Inf(-1)}, surfaceHit{t: math.Inf(1)}
+	if vDotN == 0 {
+		if height < 0 {
+			return []span{{enter: below, exit: above}}
+		}
+		return nil
+	}
+	cross := surfaceHit{t: -height / vDotN, obj: p}
+	if vDotN > 0 {
+		return []span{{enter: below, exit: cross}}
+	}
+	return []span{{enter: cross, exit: above}}
+}
+
+func (p *plane) Normal(pt Point3D, time float64) Vector3D {
+	return p.toWorldNormal(p.normal, time)
+}
+
+// slabs clips the object space ray against each pair of box faces
+func (b *box) slabs(r Ray) (hitObj bool, t1, t2 float64) {
+	t1, t2 = math.Inf(-1), math.Inf(1)
+	origin := [3]float64{r.Origin.X, r.Origin.Y, r.Origin.Z}
+	dir := [3]float64{r.Direction.X, r.Direction.Y, r.Direction.Z}
+	low := [3]float64{b.corner1.X, b.corner1.Y, b.corner1.Z}
+	high := [3]float64{b.corner2.X, b.corner2.Y, b.corner2.Z}
+	for i := range origin {
+		if dir[i] == 0 {
+			if origin[i] < low[i] || origin[i] > high[i] {
+				return false, 0, 0
+			}
+			continue
+		}
+		near, far := (low[i]-origin[i])/dir[i], (high[i]-origin[i])/dir[i]
+		if near > far {
+			near, far = far, near
+		}
+		t1, t2 = math.Max(t1, near), math.Min(t2, far)
+	}
+	return t1 <= t2, t1, t2
+}
+
+func (b *box) Hit(r Ray) (hitObj bool, t1 float64) {
+	hitObj, t1, t2 := b.slabs(b.toObject(r))
+	return nearestAhead(hitObj, t1, t2)
+}
+
+// nearestAhead picks whichever of a solid's entry and exit is the first
+// in front of the ray
+func nearestAhead(hitObj bool, t1, t2 float64) (bool, float64) {
+	if !hitObj || t2 < 0 {
+		return false, t2
+	}
+	if t1 < 0 {
+		return true, t2
+	}
+	return true, t1
+}
+
+func (b *box) Intervals(r Ray) []span {
+	if hitObj, t1, t2 := b.slabs(b.toObject(r)); hitObj {
+		return []span{{enter: surfaceHit{t: t1, obj: b}, exit: surfaceHit{t: t2, obj: b}}}
+	}
+	return nil
+}
+
+// Normal picks the face the point is closest to
+func (b *box) Normal(pt Point3D, time float64) Vector3D {
+	pt = b.toObjectPoint(pt, time)
+	faces := []struct {
+		dist   float64
+		normal Vector3D
+	}{
+		{math.Abs(pt.X - b.corner1.X), xAxis.Scale(-1)},
+		{math.Abs(pt.X - b.corner2.X), xAxis},
+		{math.Abs(pt.Y - b.corner1.Y), yAxis.Scale(-1)},
+		{math.Abs(pt.Y - b.corner2.Y), yAxis},
+		{math.Abs(pt.Z - b.corner1.Z), zAxis.Scale(-1)},
+		{math.Abs(pt.Z - b.corner2.Z), zAxis},
+	}
+	closest := faces[0]
+	for _, face := range faces[1:] {
+		if face.dist < closest.dist {
+			closest = face
+		}
+	}
+	return b.toWorldNormal(closest.normal, time)
+}
+
+func (obj object) Finish(pt Point3D, ray Ray) finish {
+	_, shown := obj.surfaceAt(pt, ray)
+	return blendFinish(shown)
+}
+
+func (obj object) Interior() interior {
+	return obj.interior
 }
 
-func (obj object) Finish() finish {
-	return obj.finish
+func (obj object) Color(pt Point3D, ray Ray) fColor {
+	color, _ := obj.surfaceAt(pt, ray)
+	return color
 }
 
-func (obj object) Color() fColor {
-	return obj.pigment
+func (obj object) Perturb(pt Point3D, normal Vector3D, ray Ray) Vector3D {
+	_, shown := obj.surfaceAt(pt, ray)
+	return blendNormal(shown, pt, normal, ray)
 }
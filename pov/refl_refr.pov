@@ -1,3 +1,5 @@
+global_settings { photons { count 100000 radius 0.15 } }
+
 camera {
     location <0, 0, 14>
     up <0, 1, 0>
@@ -30,6 +32,7 @@ sphere { <0, 0, 20>, 5
 sphere { <0, -0.5, 6.5>, 1.2
   pigment { color rgbf <0.0, 0.0, 0.0 0.9>}
   finish {ambient 0.1 diffuse 0.1 specular 0.3 roughness 0.001 reflection 0.3 refraction 1.0 ior 1.33}
+  photons { target }
 }  
 
 plane { <0,1,0> , -8
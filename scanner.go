@@ -0,0 +1,843 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// povScanner is the scene language front end. It reads tokens from a stack
+// of sources - the file given on the command line, #include'd files, and
+// replayed loop, macro and #declare bodies - running directives and
+// expanding identifiers as it goes, so the block parsers only ever see
+// plain tokens
+type povScanner struct {
+	sources []*tokenSource
+	token   string
+	pushed  []string
+	conds   []condFrame // open #if, #switch and loop blocks, innermost last
+	globals map[string]symbol
+	err     error
+}
+
+type tokenSource struct {
+	path    string         // file the tokens came from, for resolving #include
+	scanner *bufio.Scanner // nil when replaying captured tokens
+	closer  io.Closer
+	tokens  []string
+	next    int
+	// locals holds #local identifiers for files and macro calls; nil for
+	// loop bodies and expanded identifiers, which share their caller's scope
+	locals map[string]symbol
+	// barrier sources end the token stream instead of falling through to
+	// the source below, so captured expressions can't read past their end
+	barrier bool
+}
+
+// condFrame is a block waiting for its #end. Loop bodies are replayed with
+// their #end kept, and again decides whether it starts another pass
+type condFrame struct {
+	kind  string
+	body  *tokenSource
+	again func() bool
+}
+
+// symbol is a #declare'd identifier. Numeric values are evaluated when
+// declared; anything else (objects, pigments, strings) is kept as tokens
+// and spliced back in wherever the identifier is used
+type symbol struct {
+	value  exprValue
+	tokens []string
+	macro  *macro
+}
+
+type macro struct {
+	params []string
+	body   []string
+	path   string
+}
+
+const (
+	condIf     = "#if"
+	condSwitch = "#switch"
+	condLoop   = "#while"
+)
+
+func newPOVScanner(reader io.Reader, path string) *povScanner {
+	ps := &povScanner{globals: make(map[string]symbol)}
+	ps.pushFile(reader, path, nil)
+	return ps
+}
+
+func (ps *povScanner) pushFile(reader io.Reader, path string, closer io.Closer) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Split(scanPOV)
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	ps.push(&tokenSource{path: path, scanner: scanner, closer: closer,
+		locals: make(map[string]symbol)})
+}
+
+func (ps *povScanner) push(src *tokenSource) {
+	// Tokens already pushed back come before anything in the new source
+	if len(ps.pushed) > 0 {
+		pending := make([]string, len(ps.pushed))
+		for i := range ps.pushed {
+			pending[i] = ps.pushed[len(ps.pushed)-1-i]
+		}
+		ps.pushed = ps.pushed[:0]
+		ps.sources = append(ps.sources, &tokenSource{path: ps.path(), tokens: pending})
+	}
+	ps.sources = append(ps.sources, src)
+}
+
+// replay pushes captured tokens to be read next
+func (ps *povScanner) replay(tokens []string) *tokenSource {
+	src := &tokenSource{path: ps.path(), tokens: tokens}
+	ps.push(src)
+	return src
+}
+
+func (ps *povScanner) pop() {
+	top := ps.sources[len(ps.sources)-1]
+	if top.closer != nil {
+		top.closer.Close()
+	}
+	ps.sources = ps.sources[:len(ps.sources)-1]
+}
+
+// path is the file currently being read
+func (ps *povScanner) path() string {
+	if len(ps.sources) == 0 {
+		return ""
+	}
+	return ps.sources[len(ps.sources)-1].path
+}
+
+func (src *tokenSource) nextToken() (string, bool) {
+	if src.scanner != nil {
+		if !src.scanner.Scan() {
+			return "", false
+		}
+		return src.scanner.Text(), true
+	}
+	if src.next >= len(src.tokens) {
+		return "", false
+	}
+	src.next++
+	return src.tokens[src.next-1], true
+}
+
+// ScanRaw advances to the next token without running directives or
+// expanding identifiers. It is used for lookahead, which must not trigger
+// a directive before the tokens in front of it are parsed
+func (ps *povScanner) ScanRaw() bool {
+	if n := len(ps.pushed); n > 0 {
+		ps.token = ps.pushed[n-1]
+		ps.pushed = ps.pushed[:n-1]
+		return true
+	}
+	for ps.err == nil && len(ps.sources) > 0 {
+		src := ps.sources[len(ps.sources)-1]
+		if token, ok := src.nextToken(); ok {
+			ps.token = token
+			return true
+		}
+		if src.scanner != nil && src.scanner.Err() != nil {
+			ps.err = src.scanner.Err()
+			break
+		}
+		if src.barrier {
+			break
+		}
+		ps.pop()
+	}
+	ps.token = ""
+	return false
+}
+
+// Scan advances to the next plain token, running any directives and
+// expanding declared identifiers and macro calls on the way
+func (ps *povScanner) Scan() bool {
+	for ps.ScanRaw() {
+		token := ps.token
+		if token[0] == '#' {
+			ps.err = ps.directive(token)
+			continue
+		}
+		if sym, ok := ps.lookup(token); ok {
+			if sym.macro != nil {
+				ps.err = ps.invoke(token, sym.macro)
+				continue
+			}
+			if sym.tokens != nil {
+				ps.replay(sym.tokens)
+				continue
+			}
+		}
+		return true
+	}
+	if ps.err == nil && len(ps.sources) == 0 && len(ps.conds) > 0 {
+		ps.err = errors.New("Missing #end for " + ps.conds[len(ps.conds)-1].kind)
+	}
+	return false
+}
+
+func (ps *povScanner) Text() string {
+	return ps.token
+}
+
+// Unscan pushes the current token back so the next Scan returns it again
+func (ps *povScanner) Unscan() {
+	ps.pushed = append(ps.pushed, ps.token)
+}
+
+func (ps *povScanner) Err() error {
+	return ps.err
+}
+
+// Close releases any include files still open after a parse error
+func (ps *povScanner) Close() {
+	for len(ps.sources) > 0 {
+		ps.pop()
+	}
+}
+
+// lookup finds an identifier in the innermost file or macro scope that
+// declares it, falling back to the globals
+func (ps *povScanner) lookup(name string) (symbol, bool) {
+	for i := len(ps.sources) - 1; i >= 0; i-- {
+		if sym, ok := ps.sources[i].locals[name]; ok {
+			return sym, true
+		}
+	}
+	sym, ok := ps.globals[name]
+	return sym, ok
+}
+
+// declare binds an identifier globally, or in the innermost file or macro
+// scope for #local
+func (ps *povScanner) declare(name string, sym symbol, local bool) {
+	if local {
+		for i := len(ps.sources) - 1; i >= 0; i-- {
+			if ps.sources[i].locals != nil {
+				ps.sources[i].locals[name] = sym
+				return
+			}
+		}
+	}
+	ps.globals[name] = sym
+}
+
+func (ps *povScanner) undef(name string) {
+	for i := len(ps.sources) - 1; i >= 0; i-- {
+		if _, ok := ps.sources[i].locals[name]; ok {
+			delete(ps.sources[i].locals, name)
+			return
+		}
+	}
+	delete(ps.globals, name)
+}
+
+func (ps *povScanner) expect(token string) error {
+	if !ps.ScanRaw() {
+		return eofErr
+	}
+	if ps.token != token {
+		return errors.New("Expected '" + token + "', found: '" + ps.token + "'")
+	}
+	return nil
+}
+
+func (ps *povScanner) directive(name string) error {
+	switch name {
+	case "#include":
+		return ps.include()
+	case "#declare", "#local":
+		return ps.parseDeclare(name == "#local")
+	case "#undef":
+		if !ps.ScanRaw() {
+			return eofErr
+		}
+		ps.undef(ps.token)
+		return nil
+	case "#version":
+		_, err := parseExpr(ps)
+		ps.skipSemicolon()
+		return err
+	case "#debug", "#warning", "#error":
+		if !ps.ScanRaw() {
+			return eofErr
+		}
+		msg := strings.Trim(ps.token, "\"")
+		if name == "#error" {
+			return errors.New("Parse error: " + msg)
+		}
+		fmt.Print(strings.Replace(msg, "\\n", "\n", -1))
+		return nil
+	case "#if":
+		cond, err := ps.condition()
+		if err != nil {
+			return err
+		}
+		return ps.branch(cond)
+	case "#ifdef", "#ifndef":
+		args, err := ps.captureParens()
+		if err != nil {
+			return err
+		}
+		if len(args) != 1 {
+			return errors.New("Expected identifier in " + name)
+		}
+		_, defined := ps.lookup(args[0])
+		return ps.branch(defined == (name == "#ifdef"))
+	case "#else", "#elseif":
+		if len(ps.conds) == 0 {
+			return errors.New("Unmatched " + name)
+		}
+		if ps.conds[len(ps.conds)-1].kind == condSwitch {
+			// Falling through from the #case above
+			if name == "#elseif" {
+				_, err := ps.captureParens()
+				return err
+			}
+			return nil
+		}
+		// The branch before this one ran, skip the rest
+		ps.conds = ps.conds[:len(ps.conds)-1]
+		_, err := ps.skipTo("#end")
+		return err
+	case "#end":
+		if len(ps.conds) == 0 {
+			return errors.New("Unmatched #end")
+		}
+		top := ps.conds[len(ps.conds)-1]
+		if top.kind == condLoop && top.again() {
+			top.body.next = 0
+			return ps.err
+		}
+		ps.conds = ps.conds[:len(ps.conds)-1]
+		return ps.err
+	case "#while":
+		return ps.parseWhile()
+	case "#for":
+		return ps.parseFor()
+	case "#switch":
+		return ps.parseSwitch()
+	case "#case", "#range":
+		if len(ps.conds) == 0 || ps.conds[len(ps.conds)-1].kind != condSwitch {
+			return errors.New(name + " outside of #switch")
+		}
+		_, err := ps.captureParens()
+		return err
+	case "#break":
+		return ps.parseBreak()
+	case "#macro":
+		return ps.parseMacro()
+	}
+	return errors.New("Unknown directive: '" + name + "'")
+}
+
+func (ps *povScanner) include() error {
+	if !ps.Scan() {
+		return eofErr
+	}
+	name := ps.token
+	if len(name) < 2 || name[0] != '"' || name[len(name)-1] != '"' {
+		return errors.New("Expected file name after #include, found: '" + name + "'")
+	}
+	name = name[1 : len(name)-1]
+
+	path, err := findInclude(name, filepath.Dir(ps.path()))
+	if err != nil {
+		return err
+	}
+	files := make([]string, 0, len(ps.sources))
+	for _, src := range ps.sources {
+		if src.scanner != nil {
+			files = append(files, src.path)
+		}
+	}
+	for i := range files {
+		if files[i] == path {
+			chain := make([]string, 0, len(files)+1)
+			for _, f := range files[i:] {
+				chain = append(chain, filepath.Base(f))
+			}
+			chain = append(chain, filepath.Base(path))
+			return errors.New("Include cycle: " + strings.Join(chain, " -> "))
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	ps.pushFile(file, path, file)
+	return nil
+}
+
+// findInclude resolves an include name against the including file's
+// directory, then each -L library path, then $POV_INCLUDE
+func findInclude(name, dir string) (string, error) {
+	if filepath.IsAbs(name) {
+		// Cleaned like the relative names Abs returns, so cycles are
+		// found however the path is spelled
+		return filepath.Clean(name), nil
+	}
+	dirs := append([]string{dir}, includePaths...)
+	dirs = append(dirs, filepath.SplitList(os.Getenv("POV_INCLUDE"))...)
+	for _, d := range dirs {
+		if d == "" {
+			continue
+		}
+		path := filepath.Join(d, name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			if abs, err := filepath.Abs(path); err == nil {
+				path = abs
+			}
+			return path, nil
+		}
+	}
+	return "", errors.New("Cannot find include file: '" + name + "'")
+}
+
+func (ps *povScanner) skipSemicolon() {
+	if ps.ScanRaw() && ps.token != ";" {
+		ps.Unscan()
+	}
+}
+
+// #declare Name = value [;]
+func (ps *povScanner) parseDeclare(local bool) error {
+	if !ps.ScanRaw() {
+		return eofErr
+	}
+	name := ps.token
+	if err := ps.expect("="); err != nil {
+		return err
+	}
+	sym, err := ps.parseValue()
+	if err != nil {
+		return err
+	}
+	ps.declare(name, sym, local)
+	ps.skipSemicolon()
+	return nil
+}
+
+// parseValue reads the right hand side of a #declare or a macro argument:
+// a string, a keyword followed by a { } block, or a numeric expression
+func (ps *povScanner) parseValue() (symbol, error) {
+	if !ps.Scan() {
+		return symbol{}, eofErr
+	}
+	first := ps.token
+	if first[0] == '"' {
+		ps.skipComma()
+		return symbol{tokens: []string{first}}, nil
+	}
+	if ps.ScanRaw() {
+		isBlock := ps.token == "{"
+		ps.Unscan()
+		if isBlock {
+			tokens, err := ps.captureBlock(first)
+			ps.skipComma()
+			return symbol{tokens: tokens}, err
+		}
+	}
+	ps.token = first
+	ps.Unscan()
+	val, err := parseExpr(ps)
+	return symbol{value: val}, err
+}
+
+func (ps *povScanner) skipComma() {
+	if ps.ScanRaw() && ps.token != "," {
+		ps.Unscan()
+	}
+}
+
+// captureBlock collects a keyword and its { } block for later replay.
+// Directives inside run now, and numeric identifiers are replaced by their
+// current values so the block doesn't change if they are redeclared
+func (ps *povScanner) captureBlock(keyword string) ([]string, error) {
+	tokens := []string{keyword}
+	depth := 0
+	for ps.Scan() {
+		token := ps.token
+		if sym, ok := ps.lookup(token); ok && sym.tokens == nil && sym.macro == nil {
+			tokens = append(tokens, sym.value.tokens()...)
+			continue
+		}
+		tokens = append(tokens, token)
+		switch token {
+		case "{":
+			depth++
+		case "}":
+			depth--
+			if depth == 0 {
+				return tokens, nil
+			}
+		}
+	}
+	if ps.err != nil {
+		return tokens, ps.err
+	}
+	return tokens, eofErr
+}
+
+// captureParens collects the tokens between a ( and its matching )
+func (ps *povScanner) captureParens() ([]string, error) {
+	if err := ps.expect("("); err != nil {
+		return nil, err
+	}
+	tokens := []string{}
+	depth := 1
+	for ps.ScanRaw() {
+		switch ps.token {
+		case "(":
+			depth++
+		case ")":
+			depth--
+			if depth == 0 {
+				return tokens, nil
+			}
+		}
+		tokens = append(tokens, ps.token)
+	}
+	return tokens, eofErr
+}
+
+// captureBody collects the tokens up to and including the #end matching
+// the directive just read
+func (ps *povScanner) captureBody() ([]string, error) {
+	tokens := []string{}
+	depth := 0
+	for ps.ScanRaw() {
+		tokens = append(tokens, ps.token)
+		switch ps.token {
+		case "#if", "#ifdef", "#ifndef", "#while", "#for", "#switch", "#macro":
+			depth++
+		case "#end":
+			if depth == 0 {
+				return tokens, nil
+			}
+			depth--
+		}
+	}
+	return tokens, eofErr
+}
+
+// skipTo discards tokens until one of the given directives at the current
+// nesting level, which it returns
+func (ps *povScanner) skipTo(stops ...string) (string, error) {
+	depth := 0
+	for ps.ScanRaw() {
+		switch ps.token {
+		case "#if", "#ifdef", "#ifndef", "#while", "#for", "#switch", "#macro":
+			depth++
+			continue
+		case "#end":
+			if depth > 0 {
+				depth--
+				continue
+			}
+		}
+		if depth == 0 {
+			for _, stop := range stops {
+				if ps.token == stop {
+					return stop, nil
+				}
+			}
+		}
+	}
+	if ps.err != nil {
+		return "", ps.err
+	}
+	return "", eofErr
+}
+
+// evaluate parses a list of expressions from captured tokens
+func (ps *povScanner) evaluate(tokens []string) ([]exprValue, error) {
+	pushed := ps.pushed
+	ps.pushed = nil
+	depth := len(ps.sources)
+	ps.sources = append(ps.sources, &tokenSource{path: ps.path(), tokens: tokens, barrier: true})
+
+	vals := []exprValue{}
+	var err error
+	for err == nil && ps.ScanRaw() {
+		ps.Unscan()
+		var val exprValue
+		if val, err = parseExpr(ps); err == nil {
+			vals = append(vals, val)
+		}
+	}
+
+	for len(ps.sources) > depth {
+		ps.pop()
+	}
+	ps.pushed = pushed
+	if err == nil {
+		err = ps.err
+	}
+	return vals, err
+}
+
+// condition reads a parenthesized expression and tests it for truth
+func (ps *povScanner) condition() (bool, error) {
+	tokens, err := ps.captureParens()
+	if err != nil {
+		return false, err
+	}
+	return ps.truth(tokens)
+}
+
+func (ps *povScanner) truth(tokens []string) (bool, error) {
+	vals, err := ps.evaluate(tokens)
+	if err != nil {
+		return false, err
+	}
+	if len(vals) != 1 {
+		return false, errors.New("Expected a single condition")
+	}
+	f, err := vals[0].float()
+	return math.Abs(f) > exprEpsilon, err
+}
+
+// branch starts an #if block, skipping ahead to the #else or #elseif
+// branch when the condition is false
+func (ps *povScanner) branch(cond bool) error {
+	for !cond {
+		stop, err := ps.skipTo("#else", "#elseif", "#end")
+		if err != nil || stop == "#end" {
+			return err
+		}
+		if stop == "#else" {
+			break
+		}
+		if cond, err = ps.condition(); err != nil {
+			return err
+		}
+	}
+	ps.conds = append(ps.conds, condFrame{kind: condIf})
+	return nil
+}
+
+// #while (cond) ... #end
+func (ps *povScanner) parseWhile() error {
+	cond, err := ps.captureParens()
+	if err != nil {
+		return err
+	}
+	body, err := ps.captureBody()
+	if err != nil {
+		return err
+	}
+	again := func() bool {
+		ok, err := ps.truth(cond)
+		if err != nil {
+			ps.err = err
+		}
+		return ok
+	}
+	if again() {
+		ps.loop(body, again)
+	}
+	return ps.err
+}
+
+// loop replays a loop body ending in its #end, which calls again to decide
+// whether to go round once more
+func (ps *povScanner) loop(body []string, again func() bool) {
+	src := ps.replay(body)
+	ps.conds = append(ps.conds, condFrame{kind: condLoop, body: src, again: again})
+}
+
+// #for (Identifier, Start, End [, Step]) ... #end
+func (ps *povScanner) parseFor() error {
+	args, err := ps.captureParens()
+	if err != nil {
+		return err
+	}
+	if len(args) < 2 || args[1] != "," {
+		return errors.New("Expected identifier in #for")
+	}
+	name := args[0]
+	vals, err := ps.evaluate(args[2:])
+	if err != nil {
+		return err
+	}
+	if len(vals) == 2 {
+		vals = append(vals, floatValue(1))
+	}
+	if len(vals) != 3 {
+		return errors.New("Expected #for (Identifier, Start, End [, Step])")
+	}
+	var start, end, step float64
+	for i, f := range []*float64{&start, &end, &step} {
+		if *f, err = vals[i].float(); err != nil {
+			return err
+		}
+	}
+	if step == 0 {
+		return errors.New("#for step can't be zero")
+	}
+	body, err := ps.captureBody()
+	if err != nil {
+		return err
+	}
+
+	inRange := func(i float64) bool {
+		return (step > 0 && i <= end) || (step < 0 && i >= end)
+	}
+	if !inRange(start) {
+		return nil
+	}
+	ps.declare(name, symbol{value: floatValue(start)}, true)
+	ps.loop(body, func() bool {
+		sym, _ := ps.lookup(name)
+		i := sym.value.v[0] + step
+		if !inRange(i) {
+			return false
+		}
+		ps.declare(name, symbol{value: floatValue(i)}, true)
+		return true
+	})
+	return nil
+}
+
+// #switch (value) #case (value) ... #range (low, high) ... #else ... #end
+func (ps *povScanner) parseSwitch() error {
+	tokens, err := ps.captureParens()
+	if err != nil {
+		return err
+	}
+	vals, err := ps.evaluate(tokens)
+	if err == nil && len(vals) != 1 {
+		err = errors.New("Expected a single #switch value")
+	}
+	if err != nil {
+		return err
+	}
+	val, err := vals[0].float()
+	if err != nil {
+		return err
+	}
+
+	for {
+		stop, err := ps.skipTo("#case", "#range", "#else", "#end")
+		if err != nil || stop == "#end" {
+			return err
+		}
+		match := stop == "#else"
+		if !match {
+			args, err := ps.captureParens()
+			if err != nil {
+				return err
+			}
+			vals, err := ps.evaluate(args)
+			if err != nil {
+				return err
+			}
+			if stop == "#case" && len(vals) == 1 {
+				match = math.Abs(vals[0].v[0]-val) < exprEpsilon
+			} else if stop == "#range" && len(vals) == 2 {
+				match = vals[0].v[0] <= val && val <= vals[1].v[0]
+			} else {
+				return errors.New("Wrong number of values in " + stop)
+			}
+		}
+		if match {
+			ps.conds = append(ps.conds, condFrame{kind: condSwitch})
+			return nil
+		}
+	}
+}
+
+// #break leaves the innermost #switch or loop, along with any #if blocks
+// inside it
+func (ps *povScanner) parseBreak() error {
+	for i := len(ps.conds) - 1; i >= 0; i-- {
+		if ps.conds[i].kind == condIf {
+			continue
+		}
+		for len(ps.conds) > i {
+			if _, err := ps.skipTo("#end"); err != nil {
+				return err
+			}
+			ps.conds = ps.conds[:len(ps.conds)-1]
+		}
+		return nil
+	}
+	return errors.New("#break outside of #switch or loop")
+}
+
+// #macro Name(Param, ...) ... #end
+func (ps *povScanner) parseMacro() error {
+	if !ps.ScanRaw() {
+		return eofErr
+	}
+	name := ps.token
+	args, err := ps.captureParens()
+	if err != nil {
+		return err
+	}
+	m := &macro{path: ps.path()}
+	for _, arg := range args {
+		if arg != "," {
+			m.params = append(m.params, arg)
+		}
+	}
+	body, err := ps.captureBody()
+	if err != nil {
+		return err
+	}
+	m.body = body[:len(body)-1]
+	ps.globals[name] = symbol{macro: m}
+	return nil
+}
+
+// invoke evaluates a macro call's arguments in the caller's scope, then
+// replays the macro body with the parameters bound as locals
+func (ps *povScanner) invoke(name string, m *macro) error {
+	if err := ps.expect("("); err != nil {
+		return err
+	}
+	locals := make(map[string]symbol)
+	for _, param := range m.params {
+		sym, err := ps.parseValue()
+		if err != nil {
+			return err
+		}
+		locals[param] = sym
+	}
+	if err := ps.expect(")"); err != nil {
+		return errors.New("Wrong number of arguments to macro " + name)
+	}
+	ps.push(&tokenSource{path: m.path, tokens: m.body, locals: locals})
+	return nil
+}
+
+// tokens converts a value back into tokens for replay
+func (val exprValue) tokens() []string {
+	format := func(f float64) string {
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	if val.size == 1 {
+		return []string{format(val.v[0])}
+	}
+	tokens := []string{"<"}
+	for i := 0; i < val.size; i++ {
+		tokens = append(tokens, format(val.v[i]), ",")
+	}
+	return append(tokens, ">")
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// scanAll reads every plain token of the file at path
+func scanAll(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	scanner := newPOVScanner(file, path)
+	defer scanner.Close()
+	var tokens []string
+	for scanner.Scan() {
+		tokens = append(tokens, scanner.Text())
+	}
+	return tokens, scanner.Err()
+}
+
+// writeFiles creates each named file in a new temporary directory
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "scanner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, src := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestFindInclude(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"a.inc": "", "lib/b.inc": ""})
+	defer os.RemoveAll(dir)
+	saved := includePaths
+	includePaths = []string{filepath.Join(dir, "lib")}
+	defer func() { includePaths = saved }()
+
+	tests := []struct {
+		name, want string
+	}{
+		{"a.inc", filepath.Join(dir, "a.inc")},
+		{"b.inc", filepath.Join(dir, "lib", "b.inc")},
+		{"lib/../a.inc", filepath.Join(dir, "a.inc")},
+		{dir + "/./lib/../a.inc", filepath.Join(dir, "a.inc")},
+	}
+	for _, test := range tests {
+		if got, err := findInclude(test.name, dir); err != nil || got != test.want {
+			t.Errorf("findInclude(%q) = %q, %v, want %q", test.name, got, err, test.want)
+		}
+	}
+	if _, err := findInclude("missing.inc", dir); err == nil {
+		t.Error("missing.inc: no error")
+	}
+}
+
+func TestInclude(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"scene.pov": `#include "a.inc" after`,
+		"a.inc":     `one #include "b.inc" three`,
+		"b.inc":     `two`,
+		"loop.pov":  `#include "c.inc"`,
+		"c.inc":     `#include "./d.inc"`,
+	})
+	defer os.RemoveAll(dir)
+	// Back to the first include by an absolute path, spelled differently
+	d := []byte(`#include "` + dir + `/./c.inc"`)
+	if err := ioutil.WriteFile(filepath.Join(dir, "d.inc"), d, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := scanAll(filepath.Join(dir, "scene.pov"))
+	if got := strings.Join(tokens, " "); err != nil || got != "one two three after" {
+		t.Errorf("scene.pov = %q, %v", got, err)
+	}
+	if _, err := scanAll(filepath.Join(dir, "loop.pov")); err == nil ||
+		!strings.HasPrefix(err.Error(), "Include cycle") {
+		t.Errorf("loop.pov: got %v, want an include cycle", err)
+	}
+}
+
+// scanString reads every plain token of src
+func scanString(src string) (string, error) {
+	scanner := newPOVScanner(strings.NewReader(src), "test.pov")
+	defer scanner.Close()
+	var tokens []string
+	for scanner.Scan() {
+		tokens = append(tokens, scanner.Text())
+	}
+	return strings.Join(tokens, " "), scanner.Err()
+}
+
+func TestDirectives(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"#declare A = 2; #if (A > 1) yes #else no #end", "yes"},
+		{"#if (0) a #elseif (1) b #else c #end", "b"},
+		{"#declare A = 1; #ifdef (A) a #end #undef A #ifndef (A) b #end", "a b"},
+		{"#declare N = 0; #while (N < 3) a #declare N = N + 1; #end", "a a a"},
+		{"#for (I, 1, 3) #if (I = 2) two #else x #end #end", "x two x"},
+		{"#for (I, 3, 1, -1) #if (I = 1) one #end #end", "one"},
+		{"#for (I, 1, 0) x #end done", "done"},
+		{"#switch (2) #case (1) one #break #case (2) two #break #else other #end", "two"},
+		{"#switch (5) #case (1) one #break #range (4, 6) mid #break #end", "mid"},
+		{"#switch (9) #case (1) one #break #else other #end", "other"},
+		{"#switch (1) #case (1) one #case (2) two #break #end", "one two"},
+		{"#declare N = 0; #while (1) #if (N = 2) #break #end n #declare N = N + 1; #end", "n n"},
+		{"#declare P = pigment { color rgb 1 } P", "pigment { color rgb 1 }"},
+		{"#declare A = 1; #declare B = box { A } #declare A = 2; B", "box { 1 }"},
+		{"#macro Twice(X) X X #end Twice(box { 1 })", "box { 1 } box { 1 }"},
+		{"#declare X = 1; #macro M() #local X = 2; #end M() #if (X = 1) kept #end", "kept"},
+		{"#version 3.7; a", "a"},
+	}
+	for _, test := range tests {
+		if got, err := scanString(test.src); err != nil || got != test.want {
+			t.Errorf("%q = %q, %v, want %q", test.src, got, err, test.want)
+		}
+	}
+}
+
+func TestDirectiveErrors(t *testing.T) {
+	for _, src := range []string{
+		"#if (1) a",
+		"#end",
+		"#else",
+		"#break",
+		"#case (1)",
+		"#for (I, 1, 3, 0) #end",
+		"#error \"stop\"",
+		"#frobnicate",
+	} {
+		if _, err := scanString(src); err == nil {
+			t.Errorf("%q: no error", src)
+		}
+	}
+}
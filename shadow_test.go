@@ -0,0 +1,34 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// Shadows through the glass sphere in pov/refraction.pov, and variations on
+// it, are as clear as the sphere looks
+func TestShadowFilter(t *testing.T) {
+	tests := []struct {
+		name, sphere string
+		want         fColor
+	}{
+		{"refracting black filter", "pigment { color rgbf <0, 0, 0, 0.9> } finish { refraction 1 ior 1.33 }", white},
+		{"half refracting black filter", "pigment { color rgbf <0, 0, 0, 0.9> } finish { refraction 0.5 }",
+			fColor{R: 0.5, G: 0.5, B: 0.5, A: 1}},
+		{"red filter", "pigment { color rgbf <1, 0, 0, 0.9> }", fColor{R: 0.9, A: 1}},
+		{"transmit", "pigment { color rgbt <1, 0, 0, 0.5> }", fColor{R: 0.5, G: 0.5, B: 0.5, A: 1}},
+		{"opaque", "pigment { color rgb <1, 1, 1> }", fColor{A: 1}},
+		{"opaque refracting", "pigment { color rgb <1, 0, 0> } finish { refraction 0.8 }",
+			fColor{R: 0.8, G: 0.8, B: 0.8, A: 1}},
+		{"no_shadow", "pigment { color rgb <1, 1, 1> } no_shadow", white},
+	}
+	for _, test := range tests {
+		sc := loadTestScene(t, "sphere { <1, 1, 1.5>, 2 "+test.sphere+" }")
+		// The shadow on the plane under the sphere, lit from straight above
+		got := sc.shadowFilter(Point3D{1, -4, 1.5}, 0, Point3D{1, 100, 1.5}, nil, true)
+		if math.Abs(got.R-test.want.R) > 1e-9 || math.Abs(got.G-test.want.G) > 1e-9 ||
+			math.Abs(got.B-test.want.B) > 1e-9 {
+			t.Errorf("%s: light through the sphere %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Shadow rays towards the sky are aimed at a point this far away
+const skyDistance = 1e9
+
+// sky is what rays that miss everything see: the sky_sphere's physical sky
+// and pigments in the ray's direction or, without one, the background
+// color
+type sky struct {
+	background fColor
+	// pigments are layered from the first, or from the physical sky when
+	// there is one, each covering those before where it's opaque, then
+	// scaled by emission
+	physical *physicalSky
+	pigments []pigment
+	emission fColor
+	placement
+	// sampler picks directions by how bright the sky is there, for the
+	// path tracer. It's nil for a black sky
+	sampler *skySampler
+}
+
+// skySampler is a grid over the directions around the scene, by latitude
+// and longitude, with the chance of picking each cell
+type skySampler struct {
+	width, height int
+	// cdf is the running total of the cells' weights, row by row
+	cdf []float64
+}
+
+func makeSky() sky {
+	return sky{background: bkgndColor, emission: white, placement: makePlacement()}
+}
+
+// parseBackground reads background { color }
+func parseBackground(scanner *povScanner) error {
+	if !scanner.Scan() || scanner.Text() != "{" {
+		return errors.New("Missing '{' token")
+	}
+	var err error
+	if backdrop.background, err = parseColor(scanner); err != nil {
+		return err
+	}
+	backdrop.background.A = 1
+	if !scanner.Scan() || scanner.Text() != "}" {
+		return errors.New("Missing '}' token")
+	}
+	return nil
+}
+
+// parseSkySphere reads a sky_sphere block, which replaces any before it
+func parseSkySphere(scanner *povScanner) error {
+	if !scanner.Scan() || scanner.Text() != "{" {
+		return errors.New("Missing '{' token")
+	}
+	sk := makeSky()
+	sk.background = backdrop.background
+	var err error
+	for scanner.Scan() {
+		if isTransform, err := sk.parseTransform(scanner); isTransform {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		var pg pigment
+		switch token := scanner.Text(); token {
+		case "}":
+			if len(sk.pigments) == 0 && sk.physical == nil {
+				return errors.New("Sky sphere needs a pigment or physical sky")
+			}
+			backdrop = sk
+			if ps := sk.physical; ps != nil && ps.sunLight && !ps.sunColor.isBlack() {
+				// Placed with the sky, so turning the sky turns the sun too
+				lights = append(lights, light{kind: pointLight, parallel: true,
+					location: Point3D{}.Translate(ps.sun.Scale(sunDistance)), color: ps.sunColor,
+					placement: sk.placement})
+			}
+			return nil
+		case "physical_sky":
+			sk.physical, err = parsePhysicalSky(scanner)
+		case "pigment":
+			pg, err = parsePigment(scanner)
+			sk.pigments = append(sk.pigments, pg)
+		case "emission":
+			sk.emission, err = parseColor(scanner)
+			sk.emission.A = 1
+		default:
+			return errors.New("Unexpected token in sky sphere: '" + token + "'")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return eofErr
+}
+
+// at is the color seen by ray once it has missed everything
+func (sk *sky) at(ray Ray) fColor {
+	if len(sk.pigments) == 0 && sk.physical == nil {
+		return sk.background
+	}
+	_, inv := sk.placement.at(ray.Time)
+	dir := ray.Direction.Normalize()
+	// The pigments lie on a unit sphere about the origin, seen as sharply
+	// as the beam spreads
+	pt := Point3D{dir.X, dir.Y, dir.Z}.Transform(inv)
+	local := Ray{Direction: dir, Time: ray.Time, Spread: ray.Spread}
+	pigments := sk.pigments
+	var c fColor
+	if sk.physical != nil {
+		c = sk.physical.radiance(pt.AsVector().Normalize())
+	} else {
+		c, pigments = sk.pigments[0].at(pt, local), pigments[1:]
+	}
+	for i := range pigments {
+		top := pigments[i].at(pt, local)
+		c = mixColor(top.A, c, top)
+	}
+	return fColor{R: c.R * sk.emission.R, G: c.G * sk.emission.G, B: c.B * sk.emission.B, A: 1}
+}
+
+// buildSampler grids the sky at the resolution of its largest image, or
+// coarser for skies made of patterns, for sampling it by brightness. Each
+// cell is weighed by the brightest of its center and corners, so those
+// only partly covering a bright spot like the sun aren't undersampled
+func (sk *sky) buildSampler() {
+	width := 128
+	for i := range sk.pigments {
+		if img := sk.pigments[i].image; img != nil {
+			width = maxInt(width, minInt(img.levels[0].width, 2048))
+		}
+	}
+	s := &skySampler{width: width, height: (width + 1) / 2}
+	brightness := func(col, row int, u, v float64) float64 {
+		c := sk.at(Ray{Direction: s.direction(col, row, u, v)})
+		return 0.299*c.R + 0.587*c.G + 0.114*c.B
+	}
+	// Corners are shared by the cells around them, wrapping around y
+	corners := make([]float64, s.width*(s.height+1))
+	for row := 0; row <= s.height; row++ {
+		for col := 0; col < s.width; col++ {
+			corners[row*s.width+col] = brightness(col, row, 0, 0)
+		}
+	}
+	s.cdf = make([]float64, s.width*s.height)
+	total := 0.0
+	for row := 0; row < s.height; row++ {
+		for col := 0; col < s.width; col++ {
+			next := (col + 1) % s.width
+			most := math.Max(brightness(col, row, 0.5, 0.5),
+				math.Max(math.Max(corners[row*s.width+col], corners[row*s.width+next]),
+					math.Max(corners[(row+1)*s.width+col], corners[(row+1)*s.width+next])))
+			total += most * s.solidAngle(row)
+			s.cdf[row*s.width+col] = total
+		}
+	}
+	if total > 0 {
+		sk.sampler = s
+	}
+}
+
+// direction is the way to the point (u, v) across cell (col, row), each
+// from 0 to 1. Rows run from straight up to straight down, and columns
+// around the y axis
+func (s *skySampler) direction(col, row int, u, v float64) Vector3D {
+	cos0, cos1 := s.bounds(row)
+	y := cos0 + (cos1-cos0)*v
+	r, phi := math.Sqrt(math.Max(0, 1-y*y)), 2*math.Pi*(float64(col)+u)/float64(s.width)
+	return Vector3D{r * math.Cos(phi), y, r * math.Sin(phi)}
+}
+
+// bounds is the cosine of the angle from straight up at the top and
+// bottom of row
+func (s *skySampler) bounds(row int) (float64, float64) {
+	return math.Cos(math.Pi * float64(row) / float64(s.height)),
+		math.Cos(math.Pi * float64(row+1) / float64(s.height))
+}
+
+func (s *skySampler) solidAngle(row int) float64 {
+	cos0, cos1 := s.bounds(row)
+	return 2 * math.Pi / float64(s.width) * (cos0 - cos1)
+}
+
+// sample picks a direction, more likely where the sky is brighter, with
+// its pdf over solid angle. Directions are even within each cell
+func (s *skySampler) sample() (Vector3D, float64) {
+	total := s.cdf[len(s.cdf)-1]
+	ndx := sort.SearchFloat64s(s.cdf, rand.Float64()*total)
+	if ndx >= len(s.cdf) {
+		ndx = len(s.cdf) - 1
+	}
+	col, row := ndx%s.width, ndx/s.width
+	return s.direction(col, row, rand.Float64(), rand.Float64()), s.cellPdf(ndx)
+}
+
+// pdf is the pdf over solid angle of sample picking dir
+func (s *skySampler) pdf(dir Vector3D) float64 {
+	dir = dir.Normalize()
+	polar := math.Acos(math.Max(-1, math.Min(1, dir.Y)))
+	row := clampIndex(int(polar/math.Pi*float64(s.height)), s.height)
+	col := clampIndex(int(frac(math.Atan2(dir.Z, dir.X)/(2*math.Pi))*float64(s.width)), s.width)
+	return s.cellPdf(row*s.width + col)
+}
+
+func (s *skySampler) cellPdf(ndx int) float64 {
+	weight := s.cdf[ndx]
+	if ndx > 0 {
+		weight -= s.cdf[ndx-1]
+	}
+	return weight / s.cdf[len(s.cdf)-1] / s.solidAngle(ndx/s.width)
+}
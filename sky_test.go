@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// testSkies are an even sky and a physical one with a bright sun
+func testSkies(t *testing.T) map[string]*sky {
+	even := makeSky()
+	even.background = fColor{R: 0.5, G: 0.5, B: 0.5, A: 1}
+	scanner := newPOVScanner(strings.NewReader("{ sun_elevation 30 }"), "test.pov")
+	defer scanner.Close()
+	ps, err := parsePhysicalSky(scanner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	physical := makeSky()
+	physical.physical = ps
+	skies := map[string]*sky{"even": &even, "physical": &physical}
+	for name, sk := range skies {
+		if sk.buildSampler(); sk.sampler == nil {
+			t.Fatalf("%s: no sampler", name)
+		}
+	}
+	return skies
+}
+
+func TestSkySamplerCells(t *testing.T) {
+	for name, sk := range testSkies(t) {
+		s := sk.sampler
+		total, area := 0.0, 0.0
+		for ndx := range s.cdf {
+			solid := s.solidAngle(ndx / s.width)
+			total += s.cellPdf(ndx) * solid
+			area += solid
+		}
+		if math.Abs(total-1) > 1e-9 {
+			t.Errorf("%s: cell pdfs sum to %v over the sphere", name, total)
+		}
+		if math.Abs(area-4*math.Pi) > 1e-9 {
+			t.Errorf("%s: cells cover %v, want 4 pi", name, area)
+		}
+	}
+}
+
+func TestSkySamplerPdf(t *testing.T) {
+	rand.Seed(7)
+	for name, sk := range testSkies(t) {
+		s := sk.sampler
+		for i := 0; i < 10000; i++ {
+			dir, pdf := s.sample()
+			if math.Abs(dir.Length()-1) > 1e-9 {
+				t.Fatalf("%s: direction %v isn't a unit vector", name, dir)
+			}
+			if again := s.pdf(dir); math.Abs(again-pdf) > 1e-9*pdf {
+				t.Fatalf("%s: sample gave pdf %v for %v, pdf gives %v", name, pdf, dir, again)
+			}
+		}
+	}
+}
+
+func TestSkySamplerEven(t *testing.T) {
+	s := testSkies(t)["even"].sampler
+	for _, dir := range []Vector3D{xAxis, yAxis, zAxis.Scale(-1), {1, -1, 1}} {
+		if got := s.pdf(dir); math.Abs(got-1/(4*math.Pi)) > 1e-9 {
+			t.Errorf("pdf towards %v is %v, want 1/4pi", dir, got)
+		}
+	}
+}
+
+// The sun is the brightest part of the physical sky, so it's sampled most
+func TestSkySamplerSun(t *testing.T) {
+	sk := testSkies(t)["physical"]
+	sun, away := sk.physical.sun, sk.physical.sun.Scale(-1)
+	away.Y = -away.Y
+	if s := sk.sampler; s.pdf(sun) <= s.pdf(away) {
+		t.Errorf("pdf towards the sun %v, away from it %v", s.pdf(sun), s.pdf(away))
+	}
+}
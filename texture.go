@@ -0,0 +1,372 @@
+package main
+
+import (
+	"errors"
+	"math"
+)
+
+// texture is how a surface looks: its pigment, normal and finish. A
+// texture can instead pick between other textures by a pattern, held in
+// its pigment, through a texture_map, or by the pixels of an image through
+// a material_map
+type texture struct {
+	pigment       pigment
+	normalPattern normalPattern
+	finish        finish
+	// Set once given explicitly, so CSG children keep their own
+	hasPigment, hasNormal, hasFinish bool
+	textureMap                       []textureEntry
+	// materialMap picks materials[i] where its image has color index i
+	materialMap *imageMap
+	materials   []texture
+}
+
+// textureEntry is the texture a texture map gives at value
+type textureEntry struct {
+	value   float64
+	texture texture
+}
+
+// shownTexture is a plain texture and how much of the surface it makes
+// up at a point
+type shownTexture struct {
+	tx     *texture
+	weight float64
+}
+
+func defaultFinish() finish {
+	return finish{ambient: 0.1, diffuse: 0.6, roughness: 0.05, brilliance: 1, phongSize: 40}
+}
+
+func defaultTexture() texture {
+	// Objects given no pigment have always been left the zero color
+	pg := makePigment()
+	pg.color = fColor{}
+	return texture{pigment: pg, normalPattern: makeNormalPattern(), finish: defaultFinish()}
+}
+
+// given is true once any part of tx has been set
+func (tx *texture) given() bool {
+	return tx.hasPigment || tx.hasNormal || tx.hasFinish || tx.textureMap != nil ||
+		tx.materials != nil
+}
+
+// parseTexture reads a texture block, starting from tx. A finish giving
+// an ior sets obj's interior
+func (obj *object) parseTexture(scanner *povScanner, tx texture) (texture, error) {
+	if !scanner.Scan() || scanner.Text() != "{" {
+		return texture{}, errors.New("Invalid texture structure")
+	}
+	var err error
+	for scanner.Scan() {
+		moved := makePlacement()
+		if isTransform, err := moved.parseTransform(scanner); isTransform {
+			if err != nil {
+				return texture{}, err
+			}
+			tx.place(&moved)
+			continue
+		}
+		if isPattern, err := tx.pigment.parsePattern(scanner); isPattern {
+			if err != nil {
+				return texture{}, err
+			}
+			continue
+		}
+		token := scanner.Text()
+		switch token {
+		case "}":
+			return tx, nil
+		case "texture":
+			// A #declare'd texture used as the starting point
+			tx, err = obj.parseTexture(scanner, tx)
+		case "pigment":
+			tx.pigment, err = parsePigment(scanner)
+			tx.hasPigment = true
+		case "normal":
+			tx.normalPattern, err = parseNormal(scanner)
+			tx.hasNormal = true
+		case "finish":
+			err = obj.parseFinish(scanner, &tx.finish)
+			tx.hasFinish = true
+		case "checker":
+			// Up to two textures to alternate between
+			tx.pigment.pattern = token
+			tx.textureMap = []textureEntry{{0, defaultTexture()}, {1, defaultTexture()}}
+			for i := range tx.textureMap {
+				if !scanner.Scan() {
+					return texture{}, eofErr
+				}
+				if scanner.Text() != "texture" {
+					scanner.Unscan()
+					break
+				}
+				if tx.textureMap[i].texture, err = obj.parseTexture(scanner, defaultTexture()); err != nil {
+					return texture{}, err
+				}
+			}
+		case "texture_map":
+			tx.textureMap, err = obj.parseTextureMap(scanner)
+		case "material_map":
+			err = obj.parseMaterialMap(scanner, &tx)
+		default:
+			return texture{}, errors.New("Unexpected token in texture: '" + token + "'")
+		}
+		if err != nil {
+			return texture{}, err
+		}
+	}
+	return texture{}, eofErr
+}
+
+// parseTextureMap reads entries of the form [value texture {...}], which
+// must come in increasing order
+func (obj *object) parseTextureMap(scanner *povScanner) ([]textureEntry, error) {
+	if !scanner.Scan() || scanner.Text() != "{" {
+		return nil, errors.New("Missing '{' token")
+	}
+	var entries []textureEntry
+	for scanner.Scan() {
+		switch token := scanner.Text(); token {
+		case "}":
+			if len(entries) == 0 {
+				return nil, errors.New("Texture map needs at least one entry")
+			}
+			return entries, nil
+		case "[":
+			value, err := parseFloat(scanner)
+			if err != nil {
+				return nil, err
+			}
+			if n := len(entries); n > 0 && value < entries[n-1].value {
+				return nil, errors.New("Texture map entries must be in increasing order")
+			}
+			if !scanner.Scan() || scanner.Text() != "texture" {
+				return nil, errors.New("Expected a texture in texture map")
+			}
+			tx, err := obj.parseTexture(scanner, defaultTexture())
+			if err != nil {
+				return nil, err
+			}
+			if !scanner.Scan() || scanner.Text() != "]" {
+				return nil, errors.New("Missing ']' in texture map")
+			}
+			entries = append(entries, textureEntry{value: value, texture: tx})
+		default:
+			return nil, errors.New("Unexpected token in texture map: '" + token + "'")
+		}
+	}
+	return nil, eofErr
+}
+
+// parseMaterialMap reads an image followed by the textures its color
+// indices pick between
+func (obj *object) parseMaterialMap(scanner *povScanner, tx *texture) error {
+	var err error
+	tx.materials = nil
+	tx.materialMap, err = parseImageMap(scanner, func(token string) (bool, error) {
+		if token != "texture" {
+			return false, nil
+		}
+		material, err := obj.parseTexture(scanner, defaultTexture())
+		tx.materials = append(tx.materials, material)
+		return true, err
+	})
+	if err == nil && len(tx.materials) == 0 {
+		err = errors.New("Material map needs at least one texture")
+	}
+	return err
+}
+
+// parseMaterial reads a material, which wraps the textures and interior
+// of an object so they can be declared and used together
+func (obj *object) parseMaterial(scanner *povScanner) error {
+	if !scanner.Scan() || scanner.Text() != "{" {
+		return errors.New("Invalid material structure")
+	}
+	for scanner.Scan() {
+		var err error
+		switch scanner.Text() {
+		case "}":
+			return nil
+		case "material":
+			// A #declare'd material used as the starting point
+			err = obj.parseMaterial(scanner)
+		case "texture":
+			err = obj.addTexture(scanner)
+		case "interior":
+			err = obj.parseInterior(scanner)
+			obj.hasInterior = true
+		default:
+			moved := makePlacement()
+			isTransform, tErr := moved.parseTransform(scanner)
+			if !isTransform {
+				return errors.New("Unexpected token in material: '" + scanner.Text() + "'")
+			}
+			for i := range obj.textures {
+				obj.textures[i].place(&moved)
+			}
+			err = tErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return eofErr
+}
+
+// addTexture reads a texture block. The first replaces the object's
+// default texture and each one after is layered on top
+func (obj *object) addTexture(scanner *povScanner) error {
+	if !obj.hasTexture {
+		tx, err := obj.parseTexture(scanner, obj.textures[0])
+		obj.textures = []texture{tx}
+		obj.hasTexture = true
+		return err
+	}
+	tx, err := obj.parseTexture(scanner, defaultTexture())
+	obj.textures = append(obj.textures, tx)
+	return err
+}
+
+// place moves the texture along with everything it picks between
+func (tx *texture) place(other *placement) {
+	tx.pigment.place(other)
+	tx.normalPattern.place(other)
+	for i := range tx.textureMap {
+		tx.textureMap[i].texture.place(other)
+	}
+	for i := range tx.materials {
+		tx.materials[i].place(other)
+	}
+}
+
+// clone copies tx deep enough that placing the copy leaves tx as it was
+func (tx texture) clone() texture {
+	tx.pigment.moves = append([]move(nil), tx.pigment.moves...)
+	tx.normalPattern.moves = append([]move(nil), tx.normalPattern.moves...)
+	if tx.textureMap != nil {
+		entries := make([]textureEntry, len(tx.textureMap))
+		for i, entry := range tx.textureMap {
+			entries[i] = textureEntry{entry.value, entry.texture.clone()}
+		}
+		tx.textureMap = entries
+	}
+	if tx.materials != nil {
+		materials := make([]texture, len(tx.materials))
+		for i := range tx.materials {
+			materials[i] = tx.materials[i].clone()
+		}
+		tx.materials = materials
+	}
+	return tx
+}
+
+// resolve appends the plain textures tx is made of where ray hits pt to
+// shown, each weighted by its share of weight
+func (tx *texture) resolve(pt Point3D, ray Ray, weight float64, shown []shownTexture) []shownTexture {
+	switch {
+	case tx.textureMap != nil:
+		p, _ := tx.pigment.local(pt, ray)
+		lo, hi, f := between(tx.pigment.value(p), len(tx.textureMap), func(i int) float64 {
+			return tx.textureMap[i].value
+		})
+		if f < 1 {
+			shown = tx.textureMap[lo].texture.resolve(pt, ray, weight*(1-f), shown)
+		}
+		if f > 0 {
+			shown = tx.textureMap[hi].texture.resolve(pt, ray, weight*f, shown)
+		}
+		return shown
+	case tx.materials != nil:
+		_, inv := tx.pigment.placement.at(ray.Time)
+		i := tx.materialMap.index(pt.Transform(inv), len(tx.materials))
+		return tx.materials[i].resolve(pt, ray, weight, shown)
+	}
+	return append(shown, shownTexture{tx, weight})
+}
+
+// surfaceAt is the pigment where ray hits pt and the plain textures
+// showing there, weighted by how much of the surface each makes up. Each
+// layer covers the ones under it as far as its pigment is opaque
+func (obj *object) surfaceAt(pt Point3D, ray Ray) (fColor, []shownTexture) {
+	if top := &obj.textures[0]; len(obj.textures) == 1 && top.textureMap == nil && top.materials == nil {
+		return top.pigment.at(pt, ray), []shownTexture{{top, 1}}
+	}
+	var shown []shownTexture
+	color := fColor{}
+	left := 1.0
+	for i := len(obj.textures) - 1; i >= 0; i-- {
+		layer := obj.textures[i].resolve(pt, ray, 1, nil)
+		c := fColor{}
+		for _, s := range layer {
+			pc, w := s.tx.pigment.at(pt, ray), s.weight
+			c = fColor{R: c.R + pc.R*w, G: c.G + pc.G*w, B: c.B + pc.B*w, A: c.A + pc.A*w,
+				T: c.T + pc.T*w}
+		}
+		// The bottom layer takes all that's left, transparent or not
+		cover := left * c.A
+		if i == 0 {
+			cover = left
+			color.T = left * c.T
+		}
+		color.R, color.G, color.B = color.R+cover*c.R, color.G+cover*c.G, color.B+cover*c.B
+		color.A += left * c.A
+		for _, s := range layer {
+			shown = append(shown, shownTexture{s.tx, s.weight * cover})
+		}
+		if left *= 1 - c.A; left <= 0 {
+			break
+		}
+	}
+	return color, shown
+}
+
+// blendFinish mixes the finishes of the textures shown by their weights
+func blendFinish(shown []shownTexture) finish {
+	if len(shown) == 1 {
+		return shown[0].tx.finish
+	}
+	var fin finish
+	most := 0.0
+	for _, s := range shown {
+		f, w := s.tx.finish, s.weight
+		fin.ambient += f.ambient * w
+		fin.diffuse += f.diffuse * w
+		fin.specular += f.specular * w
+		fin.roughness += f.roughness * w
+		fin.reflection += f.reflection * w
+		fin.refraction += f.refraction * w
+		fin.reflectionMin += f.reflectionMin * w
+		fin.brilliance += f.brilliance * w
+		fin.phong += f.phong * w
+		fin.phongSize += f.phongSize * w
+		fin.metallic += f.metallic * w
+		fin.anisotropy += f.anisotropy * w
+		fin.emission = fColor{R: fin.emission.R + f.emission.R*w, G: fin.emission.G + f.emission.G*w,
+			B: fin.emission.B + f.emission.B*w, A: 1}
+		// fresnel and the brdf can't be mixed, so take them from the texture
+		// that shows most
+		if w > most {
+			fin.fresnel, fin.brdf, most = f.fresnel, f.brdf, w
+		}
+	}
+	fin.roughness = math.Max(fin.roughness, exprEpsilon)
+	return fin
+}
+
+// blendNormal tilts normal by each shown texture's normal pattern, mixed
+// by their weights
+func blendNormal(shown []shownTexture, pt Point3D, normal Vector3D, ray Ray) Vector3D {
+	if len(shown) == 1 {
+		return shown[0].tx.normalPattern.perturb(pt, normal, ray)
+	}
+	sum := Vector3D{}
+	for _, s := range shown {
+		sum = sum.Add(s.tx.normalPattern.perturb(pt, normal, ray).Scale(s.weight))
+	}
+	if sum.Length() < exprEpsilon {
+		return normal
+	}
+	return sum.Normalize()
+}
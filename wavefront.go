@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// loadOBJ reads the faces of a Wavefront OBJ file, looked for like an
+// include file, as triangles. Faces with more corners are split into a
+// fan, and corners with a vt index carry its uv. Normals, groups and
+// materials are ignored
+func loadOBJ(name, dir string) ([]triangle, error) {
+	path, err := findInclude(name, dir)
+	if err != nil {
+		return nil, errors.New("Cannot find OBJ file: '" + name + "'")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var points, uvs []Point3D
+	var tris []triangle
+	lines := bufio.NewScanner(file)
+	for line := 1; lines.Scan(); line++ {
+		fields := strings.Fields(lines.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		bad := func(what string) error {
+			return errors.New("Bad " + what + " in OBJ file '" + name + "' line " + strconv.Itoa(line))
+		}
+		switch fields[0] {
+		case "v":
+			pt, ok := objFloats(fields[1:], 3)
+			if !ok {
+				return nil, bad("vertex")
+			}
+			points = append(points, pt)
+		case "vt":
+			uv, ok := objFloats(fields[1:], 2)
+			if !ok {
+				return nil, bad("texture vertex")
+			}
+			uvs = append(uvs, Point3D{uv.X, uv.Y, 0})
+		case "f":
+			if len(fields) < 4 {
+				return nil, bad("face")
+			}
+			var corners []Point3D
+			var cornerUVs []Point3D
+			hasUV := true
+			for _, field := range fields[1:] {
+				refs := strings.Split(field, "/")
+				ndx, ok := objIndex(refs[0], len(points))
+				if !ok {
+					return nil, bad("face")
+				}
+				corners = append(corners, points[ndx])
+				if len(refs) < 2 || refs[1] == "" {
+					hasUV = false
+					cornerUVs = append(cornerUVs, Point3D{})
+					continue
+				}
+				if ndx, ok = objIndex(refs[1], len(uvs)); !ok {
+					return nil, bad("face")
+				}
+				cornerUVs = append(cornerUVs, uvs[ndx])
+			}
+			for i := 2; i < len(corners); i++ {
+				tri := triangle{corner1: corners[0], corner2: corners[i-1], corner3: corners[i]}
+				if hasUV {
+					tri.uv = [3]Point3D{cornerUVs[0], cornerUVs[i-1], cornerUVs[i]}
+					tri.hasUV = true
+				}
+				tris = append(tris, tri)
+			}
+		}
+	}
+	return tris, lines.Err()
+}
+
+// objFloats reads the first n of fields, ignoring any optional ones after
+func objFloats(fields []string, n int) (pt Point3D, ok bool) {
+	if len(fields) < n {
+		return
+	}
+	var v [3]float64
+	for i := 0; i < n; i++ {
+		f, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return
+		}
+		v[i] = f
+	}
+	return Point3D{v[0], v[1], v[2]}, true
+}
+
+// objIndex turns an OBJ index, counting from 1 or back from the end of the
+// n read so far when negative, into a slice index
+func objIndex(field string, n int) (int, bool) {
+	i, err := strconv.Atoi(field)
+	if err != nil || i == 0 {
+		return 0, false
+	}
+	if i < 0 {
+		i += n
+	} else {
+		i--
+	}
+	return i, i >= 0 && i < n
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadOBJ(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, src string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("quad.obj", `# a unit square and a triangle without uvs
+o quad
+v 0 0 0
+v 1 0 0
+v 1 1 0
+v 0 1 0 1.0
+vt 0 0
+vt 1 0
+vt 1 1
+vt 0 1 0
+vn 0 0 1
+usemtl none
+f 1/1/1 2/2/1 3/3/1 4/4/1
+f -4//1 -3//1 -1//1
+`)
+	tris, err := loadOBJ("quad.obj", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tris) != 3 {
+		t.Fatalf("%d triangles, want 3", len(tris))
+	}
+	// The quad is split into a fan about its first corner
+	if want := (triangle{corner1: Point3D{0, 0, 0}, corner2: Point3D{1, 1, 0}, corner3: Point3D{0, 1, 0},
+		uv: [3]Point3D{{0, 0, 0}, {1, 1, 0}, {0, 1, 0}}, hasUV: true}); tris[1] != want {
+		t.Errorf("second triangle %v, want %v", tris[1], want)
+	}
+	if want := (triangle{corner1: Point3D{0, 0, 0}, corner2: Point3D{1, 0, 0}, corner3: Point3D{0, 1, 0}}); tris[2] != want {
+		t.Errorf("triangle without uvs %v, want %v", tris[2], want)
+	}
+	sc := loadTestScene(t, `mesh { obj "`+filepath.Join(dir, "quad.obj")+`" }`)
+	if m, ok := sc.objects[0].(*mesh); !ok || len(m.triangles) != 3 {
+		t.Errorf("mesh loaded as %v", sc.objects[0])
+	}
+
+	for name, src := range map[string]string{
+		"index.obj":  "v 0 0 0\nv 1 0 0\nv 0 1 0\nf 1 2 4\n",
+		"zero.obj":   "v 0 0 0\nv 1 0 0\nv 0 1 0\nf 0 1 2\n",
+		"short.obj":  "v 0 0\n",
+		"number.obj": "v 0 0 x\n",
+		"uv.obj":     "v 0 0 0\nv 1 0 0\nv 0 1 0\nvt 0 0\nf 1/1 2/2 3/1\n",
+		"face.obj":   "v 0 0 0\nv 1 0 0\nf 1 2\n",
+	} {
+		write(name, src)
+		if _, err := loadOBJ(name, dir); err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("%s: error %v", name, err)
+		}
+	}
+	if _, err := loadOBJ("missing.obj", dir); err == nil {
+		t.Errorf("missing file loaded")
+	}
+}